@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 
 	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
 	"github.com/rerost/bqv/domain/query"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
@@ -13,6 +14,7 @@ import (
 func NewCmd(
 	ctx context.Context,
 	queryService query.QueryService,
+	p printer.Printer,
 ) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "query",
@@ -44,7 +46,15 @@ func NewCmd(
 					return errors.WithStack(err)
 				}
 
-				return errors.WithStack(queryService.BulkExec(ctx, queries))
+				if err := queryService.BulkExec(ctx, queries); err != nil {
+					return errors.WithStack(err)
+				}
+
+				results := make(printer.Results, 0, len(args))
+				for _, file := range args {
+					results = append(results, printer.Result{Name: file, Status: printer.StatusSucceeded})
+				}
+				return errors.WithStack(p.Print(results))
 			},
 			Args: cobra.MinimumNArgs(1),
 		},
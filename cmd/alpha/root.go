@@ -6,6 +6,7 @@ import (
 	"github.com/rerost/bqv/cmd/alpha/query"
 	"github.com/rerost/bqv/cmd/alpha/template"
 	"github.com/rerost/bqv/cmd/alpha/tester"
+	"github.com/rerost/bqv/cmd/printer"
 	dquery "github.com/rerost/bqv/domain/query"
 	dtemplate "github.com/rerost/bqv/domain/template"
 	dtester "github.com/rerost/bqv/domain/tester"
@@ -17,6 +18,7 @@ func NewCmd(
 	queryService dquery.QueryService,
 	templateService dtemplate.TemplateService,
 	testService dtester.TestService,
+	p printer.Printer,
 ) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "alpha",
@@ -24,9 +26,9 @@ func NewCmd(
 	}
 
 	cmd.AddCommand(
-		query.NewCmd(ctx, queryService),
-		template.NewCmd(ctx, templateService),
-		tester.NewCmd(ctx, testService),
+		query.NewCmd(ctx, queryService, p),
+		template.NewCmd(ctx, templateService, p),
+		tester.NewCmd(ctx, testService, p),
 	)
 
 	return cmd
@@ -4,13 +4,16 @@ import (
 	"context"
 
 	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
 	"github.com/rerost/bqv/domain/template"
+	"github.com/rerost/bqv/domain/viewservice"
 	"github.com/spf13/cobra"
 )
 
 func NewCmd(
 	ctx context.Context,
 	templateService template.TemplateService,
+	p printer.Printer,
 ) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "template",
@@ -23,12 +26,16 @@ func NewCmd(
 			RunE: func(_ *cobra.Command, args []string) error {
 				viewsDirPath := args[0]
 				templateFilePath := args[1:]
-				err := templateService.Run(ctx, viewsDirPath, templateFilePath)
+				rendered, err := templateService.Run(ctx, viewsDirPath, templateFilePath)
 				if err != nil {
 					return errors.WithStack(err)
 				}
 
-				return nil
+				views := make(printer.Views, 0, len(rendered))
+				for _, r := range rendered {
+					views = append(views, *printer.NewView(r.DataSet, r.Name, &viewservice.Definition{Query: r.Query}))
+				}
+				return errors.WithStack(p.Print(views))
 			},
 			Args: cobra.MinimumNArgs(2),
 		},
@@ -2,9 +2,13 @@ package tester
 
 import (
 	"context"
-	"os"
+	"io/ioutil"
+	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
+	ctester "github.com/rerost/bqv/cmd/tester"
 	"github.com/rerost/bqv/domain/tester"
 	"github.com/spf13/cobra"
 )
@@ -12,31 +16,87 @@ import (
 func NewCmd(
 	ctx context.Context,
 	testService tester.TestService,
+	p printer.Printer,
 ) *cobra.Command {
+	var junitReport, jsonReport string
+
 	cmd := &cobra.Command{
-		Use: "test",
-		RunE: func(_ *cobra.Command, args []string) error {
-			viewQueryFile := args[0]
-			assertQueryFile := args[1]
-
-			viewQuery, err := os.ReadFile(viewQueryFile)
-			if err != nil {
-				return errors.WithStack(err)
+		Use:          "test VIEW_QUERY_FILE ASSERT_QUERY_FILE [VIEW_QUERY_FILE ASSERT_QUERY_FILE]...",
+		Short:        "Run assert queries against views",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			report := tester.Report{Timestamp: time.Now()}
+			// Files that cannot be read or parsed fail their pair, and the other pairs still run.
+			fail := func(viewQueryFile, assertQueryFile string, err error) {
+				result := tester.Result{View: viewQueryFile, Name: assertQueryFile, Failure: err.Error()}
+				ctester.PrintFailure(cmd.ErrOrStderr(), result)
+				report.Results = append(report.Results, result)
 			}
+			for i := 0; i < len(args); i += 2 {
+				viewQueryFile, assertQueryFile := args[i], args[i+1]
 
-			assertQuery, err := os.ReadFile(assertQueryFile)
-			if err != nil {
-				return errors.WithStack(err)
-			}
+				viewQuery, err := ioutil.ReadFile(viewQueryFile)
+				if err != nil {
+					fail(viewQueryFile, assertQueryFile, err)
+					continue
+				}
+				assertQuery, err := ioutil.ReadFile(assertQueryFile)
+				if err != nil {
+					fail(viewQueryFile, assertQueryFile, err)
+					continue
+				}
+
+				if ext := filepath.Ext(assertQueryFile); ext != ".yml" && ext != ".yaml" {
+					start := time.Now()
+					jobID, err := testService.Test(ctx, string(viewQuery), string(assertQuery))
+					result := tester.Result{
+						View:     viewQueryFile,
+						Name:     assertQueryFile,
+						Duration: time.Since(start),
+						JobID:    jobID,
+					}
+					if err != nil {
+						result.Failure = err.Error()
+					}
+					ctester.PrintFailure(cmd.ErrOrStderr(), result)
+					report.Results = append(report.Results, result)
+					continue
+				}
 
-			if err := testService.Test(ctx, string(viewQuery), string(assertQuery)); err != nil {
-				return errors.WithStack(err)
+				assertions, err := tester.ParseAssertions(assertQuery)
+				if err != nil {
+					fail(viewQueryFile, assertQueryFile, errors.WithMessagef(err, "Failed to parse %s", assertQueryFile))
+					continue
+				}
+				for _, a := range assertions {
+					start := time.Now()
+					r, err := testService.Assert(ctx, string(viewQuery), a)
+					result := tester.Result{
+						View:     viewQueryFile,
+						Name:     assertQueryFile + ":" + a.String(),
+						Duration: time.Since(start),
+						JobID:    r.JobID,
+						Failure:  r.Failure,
+					}
+					if err != nil {
+						result.Failure = err.Error()
+					}
+					ctester.PrintFailure(cmd.ErrOrStderr(), result)
+					report.Results = append(report.Results, result)
+				}
 			}
 
+			return errors.WithStack(ctester.Finish(report, p, junitReport, jsonReport))
+		},
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 || len(args)%2 != 0 {
+				return errors.New("requires pairs of a view query file and an assert query file")
+			}
 			return nil
 		},
-		Args: cobra.ExactArgs(2),
 	}
 
+	ctester.AddReportFlags(cmd, &junitReport, &jsonReport)
+
 	return cmd
 }
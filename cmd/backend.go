@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+// Backend is the clients of the BigQuery selected by --backend.
+type Backend struct {
+	BQ   bqiface.Client
+	REST viewmanager.RESTClient
+}
+
+// backends are the backends other than BackendBigQuery by name, which files built with build tags add.
+var backends = map[string]func(ctx context.Context, cfg Config) (Backend, error){}
+
+func NewBackend(ctx context.Context, cfg Config) (Backend, error) {
+	switch cfg.Backend {
+	case "", BackendBigQuery:
+	default:
+		if newBackend, ok := backends[cfg.Backend]; ok {
+			return newBackend(ctx, cfg)
+		}
+		return Backend{}, errors.Errorf("Unknown backend %q", cfg.Backend)
+	}
+
+	c, err := bigquery.NewClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return Backend{}, errors.WithStack(err)
+	}
+	rest, err := viewmanager.NewRESTClient(ctx, cfg.ProjectID)
+	if err != nil {
+		return Backend{}, errors.WithStack(err)
+	}
+	return Backend{BQ: bqiface.AdaptClient(c), REST: rest}, nil
+}
@@ -0,0 +1,18 @@
+//go:build fake
+// +build fake
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/rerost/bqv/mocks/bqfake"
+)
+
+// The fake backend is in binaries built with `-tags fake` only, so that bqv itself does not have the test fake.
+func init() {
+	backends[BackendFake] = func(ctx context.Context, cfg Config) (Backend, error) {
+		c := bqfake.New(cfg.ProjectID)
+		return Backend{BQ: c, REST: c}, nil
+	}
+}
@@ -6,18 +6,9 @@ import (
 	"fmt"
 
 	"github.com/pkg/errors"
-	"github.com/spf13/pflag"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
-type Config struct {
-	ProjectID string
-	Dir       string
-	Debug     bool
-	Verbose   bool
-}
-
 func Run() error {
 	ctx := context.TODO()
 
@@ -62,18 +53,3 @@ func NewLogger(cfg Config) (*zap.Logger, error) {
 	l, err := zcfg.Build()
 	return l, errors.WithStack(err)
 }
-
-func NewConfig() (Config, error) {
-	pflag.StringP("projectid", "", "", "GCP ProjectID")
-	pflag.StringP("dir", "", "", "Dir for datasets")
-	pflag.BoolP("verbose", "v", false, "")
-	pflag.BoolP("debug", "d", false, "")
-
-	viper.AutomaticEnv()
-	viper.BindPFlags(pflag.CommandLine)
-
-	var cfg Config
-	pflag.Parse()
-	err := viper.Unmarshal(&cfg)
-	return cfg, errors.WithStack(err)
-}
@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// ConfigFileName is the name of the config file, which is searched from the working directory upward.
+const ConfigFileName = "bqv.yaml"
+
+type Config struct {
+	ProjectID   string
+	Dir         string
+	Debug       bool
+	Verbose     bool
+	Output      string
+	Protected   []string
+	Location    string
+	Datasets    DatasetsConfig
+	Concurrency int
+	Env         string
+	Profiles    map[string]Profile
+	// DatasetPrefix, DatasetSuffix and DatasetNames map dataset names in Dir to those in BigQuery.
+	DatasetPrefix string            `mapstructure:"dataset_prefix"`
+	DatasetSuffix string            `mapstructure:"dataset_suffix"`
+	DatasetNames  map[string]string `mapstructure:"dataset_names"`
+	// DirProjectID is the project that references in the views in Dir refer to, which is ProjectID before the profile is applied.
+	DirProjectID string `mapstructure:"-"`
+	// Vars are the variables of templates in .sql files.
+	Vars map[string]string
+	// HistoryDir is the directory where apply keeps the previous definitions of views. The history is disabled unless it is set.
+	HistoryDir string `mapstructure:"history_dir"`
+	// Retry is how requests to BigQuery that fail with transient errors are retried. Zero values are the defaults, except Jitter.
+	Retry RetryConfig
+	// Routines lists routines in every dataset in BigQuery, not only in the datasets that have routines in Dir.
+	Routines bool
+	// Backend is the BigQuery to use. BackendFake is an empty in-memory BigQuery for demos, in binaries built with `-tags fake`.
+	Backend string
+	// Config is the path of the config file. It is empty when no config file is used.
+	Config string
+}
+
+const (
+	BackendBigQuery = "bigquery"
+	BackendFake     = "fake"
+)
+
+// DatasetsConfig is the glob patterns of datasets that bqv manages.
+// All datasets are managed when Include is empty.
+type DatasetsConfig struct {
+	Include []string
+	Exclude []string
+}
+
+// RetryConfig overrides viewmanager.DefaultRetryPolicy.
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	// Jitter is nil unless set, since 0 disables jitter.
+	Jitter *float64
+}
+
+// Profile overrides Config for an environment selected by --env.
+type Profile struct {
+	ProjectID     string
+	Dir           string
+	Location      string
+	Datasets      *DatasetsConfig
+	Concurrency   int
+	DatasetPrefix string            `mapstructure:"dataset_prefix"`
+	DatasetSuffix string            `mapstructure:"dataset_suffix"`
+	DatasetNames  map[string]string `mapstructure:"dataset_names"`
+	Vars          map[string]string
+}
+
+func NewConfig() (Config, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return Config{}, errors.WithStack(err)
+	}
+	return LoadConfig(pflag.CommandLine, os.Args[1:], wd)
+}
+
+// LoadConfig defines the global flags in flags, and reads Config from them in args, environment variables and the config file.
+// The config file is searched from dir upward unless --config is given. Flags win over environment variables, which win over the config file.
+func LoadConfig(flags *pflag.FlagSet, args []string, dir string) (Config, error) {
+	flags.StringP("config", "", "", "Config file (default "+ConfigFileName+" in the working directory or its parents)")
+	flags.StringP("projectid", "", "", "GCP ProjectID")
+	flags.StringP("dir", "", "", "Dir for datasets")
+	flags.BoolP("verbose", "v", false, "")
+	flags.BoolP("debug", "d", false, "")
+	flags.StringP("output", "o", "", "Output format. One of table, json, yaml, name (default human readable)")
+	flags.StringSliceP("protected", "", []string{}, "Views never deleted by prune, as <dataset>.<name> glob patterns")
+	flags.StringP("location", "", "US", "Location of datasets created by bqv")
+	flags.IntP("concurrency", "", 1, "Number of concurrent requests to BigQuery")
+	flags.StringP("env", "", "", "Profile in the config file to use")
+	flags.StringToStringP("var", "", map[string]string{}, "Variable of templates in .sql files as <name>=<value>. Can be repeated")
+	flags.StringP("history-dir", "", "", "Dir where apply keeps the previous definitions of views for rollback (default disabled)")
+	flags.IntP("retry-max-attempts", "", 0, "Attempts of a request to BigQuery that fails with a transient error such as a rate limit, including the first one. 1 disables retries (default 5)")
+	flags.BoolP("routines", "", false, "List routines in every dataset in BigQuery, e.g. to dump routines that are not in --dir yet (default only datasets with routines in --dir)")
+	flags.StringP("backend", "", BackendBigQuery, "BigQuery to use. One of bigquery, fake (in-memory, nothing is sent to BigQuery; only in binaries built with -tags fake)")
+
+	v := viper.New()
+	v.AutomaticEnv()
+	v.BindPFlags(flags)
+	v.BindPFlag("history_dir", flags.Lookup("history-dir"))
+	v.BindPFlag("retry.max_attempts", flags.Lookup("retry-max-attempts"))
+
+	// Sub commands have their own flags. cobra parses all flags again and rejects unknown ones.
+	if err := flags.Parse(globalArgs(flags, args)); err != nil {
+		return Config{}, errors.WithStack(err)
+	}
+
+	configFile := v.GetString("config")
+	if configFile == "" {
+		configFile = findConfigFile(dir)
+	}
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return Config{}, errors.WithMessagef(err, "Failed to read %s", configFile)
+		}
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return Config{}, errors.WithStack(err)
+	}
+	cfg.Config = configFile
+
+	if err := cfg.applyProfile(func(name string) bool { return flags.Changed(name) }); err != nil {
+		return Config{}, errors.WithStack(err)
+	}
+
+	vars, err := flags.GetStringToString("var")
+	if err != nil {
+		return Config{}, errors.WithStack(err)
+	}
+	cfg.Vars = mergeVars(cfg.Vars, vars)
+
+	// Dir and HistoryDir in the config file are relative to the config file.
+	if configFile != "" && !flags.Changed("dir") && cfg.Dir != "" && !filepath.IsAbs(cfg.Dir) {
+		cfg.Dir = filepath.Join(filepath.Dir(configFile), cfg.Dir)
+	}
+	if configFile != "" && !flags.Changed("history-dir") && cfg.HistoryDir != "" && !filepath.IsAbs(cfg.HistoryDir) {
+		cfg.HistoryDir = filepath.Join(filepath.Dir(configFile), cfg.HistoryDir)
+	}
+
+	return cfg, nil
+}
+
+// globalArgs returns the flags in args that are defined in flags with their values.
+func globalArgs(flags *pflag.FlagSet, args []string) []string {
+	res := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		var f *pflag.Flag
+		if strings.HasPrefix(arg, "--") {
+			f = flags.Lookup(name)
+		} else if len(name) == 1 {
+			f = flags.ShorthandLookup(name)
+		}
+		if f == nil {
+			continue
+		}
+		res = append(res, arg)
+		if !strings.Contains(arg, "=") && f.NoOptDefVal == "" && i+1 < len(args) {
+			i++
+			res = append(res, args[i])
+		}
+	}
+	return res
+}
+
+// findConfigFile returns the path of ConfigFileName in dir or its nearest parent. It returns "" if not found.
+func findConfigFile(dir string) string {
+	for {
+		p := filepath.Join(dir, ConfigFileName)
+		if stat, err := os.Stat(p); err == nil && !stat.IsDir() {
+			return p
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// applyProfile overrides cfg with the profile selected by cfg.Env. Values given by flags are kept.
+func (cfg *Config) applyProfile(changed func(name string) bool) error {
+	if cfg.Env == "" {
+		return nil
+	}
+	// Keys of the config file, including the names of profiles, are case insensitive and read as lower case.
+	profile, ok := cfg.Profiles[strings.ToLower(cfg.Env)]
+	if !ok {
+		return errors.Errorf("profile %q is not found in the config file", cfg.Env)
+	}
+
+	cfg.DirProjectID = cfg.ProjectID
+	if profile.ProjectID != "" && !changed("projectid") {
+		cfg.ProjectID = profile.ProjectID
+	}
+	if profile.Dir != "" && !changed("dir") {
+		cfg.Dir = profile.Dir
+	}
+	if profile.Location != "" && !changed("location") {
+		cfg.Location = profile.Location
+	}
+	if profile.Datasets != nil {
+		cfg.Datasets = *profile.Datasets
+	}
+	if profile.Concurrency != 0 && !changed("concurrency") {
+		cfg.Concurrency = profile.Concurrency
+	}
+	if profile.DatasetPrefix != "" {
+		cfg.DatasetPrefix = profile.DatasetPrefix
+	}
+	if profile.DatasetSuffix != "" {
+		cfg.DatasetSuffix = profile.DatasetSuffix
+	}
+	if profile.DatasetNames != nil {
+		cfg.DatasetNames = profile.DatasetNames
+	}
+	cfg.Vars = mergeVars(cfg.Vars, profile.Vars)
+	return nil
+}
+
+// mergeVars returns vars with overrides. Values in overrides win.
+func mergeVars(vars map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(vars)+len(overrides))
+	for k, v := range vars {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
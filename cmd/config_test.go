@@ -0,0 +1,148 @@
+package cmd_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/cmd"
+	"github.com/spf13/pflag"
+)
+
+const testConfig = `
+projectid: my-project
+dir: views
+location: EU
+retry:
+  jitter: 0
+vars:
+  team: sales
+profiles:
+  staging:
+    projectid: my-project-staging
+    dataset_suffix: _stg
+    vars:
+      team: sales-stg
+`
+
+func loadConfig(t *testing.T, args []string, dir string) (cmd.Config, error) {
+	t.Helper()
+	return cmd.LoadConfig(pflag.NewFlagSet("bqv", pflag.ContinueOnError), args, dir)
+}
+
+func writeConfig(t *testing.T) (string, func()) {
+	t.Helper()
+	root, err := ioutil.TempDir("", "bqv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, cmd.ConfigFileName), []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, func() { os.RemoveAll(root) }
+}
+
+func TestLoadConfigDiscovery(t *testing.T) {
+	root, cleanup := writeConfig(t)
+	defer cleanup()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(t, nil, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Config != filepath.Join(root, cmd.ConfigFileName) {
+		t.Errorf("unexpected config file %s", cfg.Config)
+	}
+	if cfg.ProjectID != "my-project" || cfg.Location != "EU" {
+		t.Errorf("config file is not read: %+v", cfg)
+	}
+	// Dir in the config file is relative to the config file.
+	if cfg.Dir != filepath.Join(root, "views") {
+		t.Errorf("unexpected dir %s", cfg.Dir)
+	}
+
+	empty, err := ioutil.TempDir("", "bqv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	cfg, err = loadConfig(t, []string{"--config", filepath.Join(root, cmd.ConfigFileName)}, empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProjectID != "my-project" {
+		t.Errorf("--config is not read: %+v", cfg)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	root, cleanup := writeConfig(t)
+	defer cleanup()
+
+	os.Setenv("LOCATION", "asia-northeast1")
+	defer os.Unsetenv("LOCATION")
+
+	// Flags of sub commands are left to cobra.
+	cfg, err := loadConfig(t, []string{"view", "plan", "--out", "plan.json", "--projectid=flag-project", "--dir", "local", "--var", "team=flag"}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProjectID != "flag-project" || cfg.Dir != "local" {
+		t.Errorf("flags do not win over the config file: %+v", cfg)
+	}
+	if cfg.Location != "asia-northeast1" {
+		t.Errorf("environment variables do not win over the config file: %s", cfg.Location)
+	}
+	if cfg.Retry.Jitter == nil || *cfg.Retry.Jitter != 0 {
+		t.Errorf("want jitter disabled by the config file, got %v", cfg.Retry.Jitter)
+	}
+	if cfg.Concurrency != 1 {
+		t.Errorf("want the default concurrency, got %d", cfg.Concurrency)
+	}
+	if diff := cmp.Diff(map[string]string{"team": "flag"}, cfg.Vars); diff != "" {
+		t.Error(diff)
+	}
+
+	cfg, err = loadConfig(t, []string{"--location", "US"}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Location != "US" {
+		t.Errorf("flags do not win over environment variables: %s", cfg.Location)
+	}
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	root, cleanup := writeConfig(t)
+	defer cleanup()
+
+	// Names of profiles are case insensitive.
+	cfg, err := loadConfig(t, []string{"--env", "Staging"}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProjectID != "my-project-staging" || cfg.DirProjectID != "my-project" || cfg.DatasetSuffix != "_stg" {
+		t.Errorf("profile is not applied: %+v", cfg)
+	}
+	if diff := cmp.Diff(map[string]string{"team": "sales-stg"}, cfg.Vars); diff != "" {
+		t.Error(diff)
+	}
+
+	cfg, err = loadConfig(t, []string{"--env", "staging", "--projectid", "flag-project"}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ProjectID != "flag-project" {
+		t.Errorf("flags do not win over the profile: %s", cfg.ProjectID)
+	}
+
+	if _, err := loadConfig(t, []string{"--env", "prod"}, root); err == nil {
+		t.Error("want error for an unknown profile")
+	}
+}
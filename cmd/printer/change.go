@@ -0,0 +1,233 @@
+package printer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rerost/bqv/domain/textdiff"
+	"github.com/rerost/bqv/domain/viewservice"
+)
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// Change is the output of a change to a view.
+// Before is nil when the view is created, and After is nil when the view is deleted.
+type Change struct {
+	DataSet string               `json:"dataset" yaml:"dataset"`
+	Name    string               `json:"name" yaml:"name"`
+	Actions []viewservice.Action `json:"actions" yaml:"actions"`
+	Before  *View                `json:"before,omitempty" yaml:"before,omitempty"`
+	After   *View                `json:"after,omitempty" yaml:"after,omitempty"`
+	// Fields are the changed metadata fields of a modified view.
+	Fields []viewservice.FieldDiff `json:"fields,omitempty" yaml:"fields,omitempty"`
+
+	query []textdiff.Hunk
+}
+
+// DatasetChange is the output of a change to the settings of a dataset in _dataset.yml.
+type DatasetChange struct {
+	DataSet string                  `json:"dataset" yaml:"dataset"`
+	Create  bool                    `json:"create,omitempty" yaml:"create,omitempty"`
+	Fields  []viewservice.FieldDiff `json:"fields,omitempty" yaml:"fields,omitempty"`
+	// Location is set when the dataset is in another location than in _dataset.yml, which apply cannot fix.
+	Location *viewservice.FieldDiff `json:"location,omitempty" yaml:"location,omitempty"`
+}
+
+// Changes is the output of diff, plan and apply.
+type Changes struct {
+	Datasets []DatasetChange     `json:"datasets,omitempty" yaml:"datasets,omitempty"`
+	Changes  []Change            `json:"changes" yaml:"changes"`
+	Summary  viewservice.Summary `json:"summary" yaml:"summary"`
+}
+
+// WithDatasets returns cs with the changes to datasets.
+func (cs Changes) WithDatasets(diffs []viewservice.DatasetDiff) Changes {
+	cs.Datasets = make([]DatasetChange, 0, len(diffs))
+	for _, d := range diffs {
+		c := DatasetChange{DataSet: d.Name, Create: d.Destination == nil, Fields: d.Fields}
+		if d.LocationDrift {
+			c.Location = &viewservice.FieldDiff{Field: "location", Before: d.Destination.Location, After: d.Source.Location}
+		}
+		cs.Datasets = append(cs.Datasets, c)
+	}
+	return cs
+}
+
+func (c DatasetChange) actions() string {
+	actions := []string{}
+	switch {
+	case c.Create:
+		actions = append(actions, "create_dataset")
+	case len(c.Fields) != 0:
+		actions = append(actions, "update_dataset")
+	}
+	if c.Location != nil {
+		actions = append(actions, "location_drift")
+	}
+	return strings.Join(actions, ",")
+}
+
+func NewChanges(diffs []viewservice.ViewDiff) Changes {
+	changes := make([]Change, 0, len(diffs))
+	for _, d := range diffs {
+		changes = append(changes, Change{
+			DataSet: d.DataSet,
+			Name:    d.Name,
+			Actions: d.Actions,
+			Before:  NewView(d.DataSet, d.Name, viewservice.NewDefinition(d.Destination)),
+			After:   NewView(d.DataSet, d.Name, viewservice.NewDefinition(d.Source)),
+			Fields:  d.Fields,
+			query:   d.Query,
+		})
+	}
+	return Changes{
+		Changes: changes,
+		Summary: viewservice.Summarize(diffs),
+	}
+}
+
+func NewPlanChanges(plan viewservice.Plan) Changes {
+	changes := make([]Change, 0, len(plan.Changes))
+	for _, c := range plan.Changes {
+		var before, after string
+		var fields []viewservice.FieldDiff
+		if c.Before != nil {
+			before = c.Before.Query
+		}
+		if c.After != nil {
+			after = c.After.Query
+		}
+		if c.Before != nil && c.After != nil {
+			fields = viewservice.DiffMetadata(c.Before.Metadata, c.After.Metadata)
+		}
+		changes = append(changes, Change{
+			DataSet: c.DataSet,
+			Name:    c.Name,
+			Actions: c.Actions,
+			Before:  NewView(c.DataSet, c.Name, c.Before),
+			After:   NewView(c.DataSet, c.Name, c.After),
+			Fields:  fields,
+			query:   textdiff.Hunks(before, after, viewservice.DiffContext),
+		})
+	}
+
+	return Changes{Changes: changes, Summary: plan.Summary()}.WithDatasets(plan.DatasetDiffs())
+}
+
+func (cs Changes) Header() []string {
+	return []string{"DATASET", "NAME", "ACTIONS", "BEFORE", "AFTER"}
+}
+
+func (cs Changes) Rows() [][]string {
+	rows := make([][]string, 0, len(cs.Datasets)+len(cs.Changes))
+	for _, c := range cs.Datasets {
+		rows = append(rows, []string{c.DataSet, "-", c.actions(), "-", "-"})
+	}
+	for _, c := range cs.Changes {
+		actions := make([]string, len(c.Actions))
+		for i, a := range c.Actions {
+			actions[i] = string(a)
+		}
+		before, after := "-", "-"
+		if c.Before != nil {
+			before = shortHash(c.Before.QueryHash)
+		}
+		if c.After != nil {
+			after = shortHash(c.After.QueryHash)
+		}
+		rows = append(rows, []string{c.DataSet, c.Name, strings.Join(actions, ","), before, after})
+	}
+	return rows
+}
+
+func (cs Changes) Names() []string {
+	names := make([]string, 0, len(cs.Datasets)+len(cs.Changes))
+	for _, c := range cs.Datasets {
+		names = append(names, c.DataSet)
+	}
+	for _, c := range cs.Changes {
+		names = append(names, c.DataSet+"."+c.Name)
+	}
+	return names
+}
+
+// Render prints changes as unified diff followed by the summary.
+func (cs Changes) Render(w io.Writer, color bool) error {
+	colorize := func(c string, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	for _, c := range cs.Datasets {
+		header := "dataset " + c.DataSet
+		if c.Create {
+			header += " (create)"
+		}
+		fmt.Fprintln(w, colorize(colorBold, header))
+		for _, f := range c.Fields {
+			fmt.Fprintln(w, colorize(colorCyan, fmt.Sprintf("# %s: %s -> %s", f.Field, formatValue(f.Before), formatValue(f.After))))
+		}
+		if c.Location != nil {
+			fmt.Fprintln(w, colorize(colorRed, fmt.Sprintf("# location: %s -> %s cannot be changed; recreate the dataset to move it", formatValue(c.Location.Before), formatValue(c.Location.After))))
+		}
+		fmt.Fprintln(w)
+	}
+
+	for _, c := range cs.Changes {
+		id := c.DataSet + "." + c.Name
+		from, to := "a/"+id, "b/"+id
+		if c.Before == nil {
+			from = "/dev/null"
+		}
+		if c.After == nil {
+			to = "/dev/null"
+		}
+		fmt.Fprintln(w, colorize(colorBold, "--- "+from))
+		fmt.Fprintln(w, colorize(colorBold, "+++ "+to))
+
+		if len(c.query) == 0 && c.Before != nil && c.After != nil {
+			fmt.Fprintln(w, colorize(colorCyan, "# query unchanged"))
+		}
+		for _, h := range c.query {
+			fmt.Fprintln(w, colorize(colorCyan, fmt.Sprintf("@@ -%d,%d +%d,%d @@", h.FromLine, h.FromCount, h.ToLine, h.ToCount)))
+			for _, l := range h.Lines {
+				switch l.Op {
+				case textdiff.Delete:
+					fmt.Fprintln(w, colorize(colorRed, "-"+l.Text))
+				case textdiff.Insert:
+					fmt.Fprintln(w, colorize(colorGreen, "+"+l.Text))
+				default:
+					fmt.Fprintln(w, " "+l.Text)
+				}
+			}
+		}
+		for _, f := range c.Fields {
+			fmt.Fprintln(w, colorize(colorCyan, fmt.Sprintf("# %s: %s -> %s", f.Field, formatValue(f.Before), formatValue(f.After))))
+		}
+		fmt.Fprintln(w)
+	}
+
+	_, err := fmt.Fprintln(w, colorize(colorBold, cs.Summary.String()))
+	return err
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "(none)"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
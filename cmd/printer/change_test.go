@@ -0,0 +1,181 @@
+package printer_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/cmd/printer"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/domain/viewservice"
+)
+
+// testChanges returns changes to a created, an updated, a relabeled and a deleted view, and to two datasets.
+func testChanges() printer.Changes {
+	plan := viewservice.Plan{Changes: []viewservice.PlannedChange{
+		{
+			DataSet: "sales", Name: "daily",
+			Actions: []viewservice.Action{viewservice.ActionCreate},
+			After:   &viewservice.Definition{Query: "SELECT 1 AS id\n"},
+		},
+		{
+			DataSet: "sales", Name: "orders",
+			Actions: []viewservice.Action{viewservice.ActionUpdateQuery},
+			Before:  &viewservice.Definition{Query: "SELECT\n  id,\n  status\nFROM raw.orders\n"},
+			After:   &viewservice.Definition{Query: "SELECT\n  id,\n  state\nFROM raw.orders\n"},
+		},
+		{
+			DataSet: "sales", Name: "summary",
+			Actions: []viewservice.Action{viewservice.ActionUpdateMetadata},
+			Before:  &viewservice.Definition{Query: "SELECT 1\n", Metadata: map[string]interface{}{"description": "Old"}},
+			After:   &viewservice.Definition{Query: "SELECT 1\n", Metadata: map[string]interface{}{"description": "New", "labels": map[string]interface{}{"team": "sales"}}},
+		},
+		{
+			DataSet: "sales", Name: "legacy",
+			Actions: []viewservice.Action{viewservice.ActionDelete},
+			Before:  &viewservice.Definition{Query: "SELECT 0\n"},
+		},
+	}}
+	return printer.NewPlanChanges(plan).WithDatasets([]viewservice.DatasetDiff{
+		{Name: "report", Source: &viewservice.DatasetSetting{Location: "US"}},
+		{
+			Name:          "sales",
+			Source:        &viewservice.DatasetSetting{Location: "EU", Description: "Sales"},
+			Destination:   &viewservice.DatasetSetting{Location: "US"},
+			Fields:        []viewservice.FieldDiff{{Field: "description", After: "Sales"}},
+			LocationDrift: true,
+		},
+	})
+}
+
+func TestChangesPrint(t *testing.T) {
+	cases := []struct {
+		format printer.Format
+		golden string
+	}{
+		{printer.FormatDefault, "changes.txt"},
+		{printer.FormatTable, "changes_table.txt"},
+		{printer.FormatJSON, "changes.json"},
+		{printer.FormatYAML, "changes.yaml"},
+		{printer.FormatName, "changes_name.txt"},
+	}
+	for _, c := range cases {
+		want, err := ioutil.ReadFile(filepath.Join("testdata", c.golden))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A bytes.Buffer is not a terminal, so the default format is not colored.
+		var buf bytes.Buffer
+		p, err := printer.New(c.format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Print(testChanges()); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(want), buf.String()); diff != "" {
+			t.Errorf("%s: unexpected output (-want +got):\n%s", c.golden, diff)
+		}
+	}
+}
+
+func TestChangesRenderColor(t *testing.T) {
+	plan := viewservice.Plan{Changes: []viewservice.PlannedChange{{
+		DataSet: "sales", Name: "orders",
+		Actions: []viewservice.Action{viewservice.ActionUpdateQuery},
+		Before:  &viewservice.Definition{Query: "SELECT\n  status\n"},
+		After:   &viewservice.Definition{Query: "SELECT\n  state\n"},
+	}}}
+	want := "\x1b[1m--- a/sales.orders\x1b[0m\n" +
+		"\x1b[1m+++ b/sales.orders\x1b[0m\n" +
+		"\x1b[36m@@ -1,2 +1,2 @@\x1b[0m\n" +
+		" SELECT\n" +
+		"\x1b[31m-  status\x1b[0m\n" +
+		"\x1b[32m+  state\x1b[0m\n" +
+		"\n" +
+		"\x1b[1m0 to create, 1 to change, 0 to delete\x1b[0m\n"
+
+	var buf bytes.Buffer
+	if err := printer.NewPlanChanges(plan).Render(&buf, true); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+// renderDiff renders the diff from the view in dst to the view in src, which are the .sql and the .yml of sales.orders.
+func renderDiff(t *testing.T, dst, src [2]string) string {
+	t.Helper()
+	dirs := make([]string, 2)
+	for i, files := range [][2]string{dst, src} {
+		dir, err := ioutil.TempDir("", "printer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := os.Mkdir(filepath.Join(dir, "sales"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "sales", "orders.sql"), []byte(files[0]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "sales", "orders.yml"), []byte(files[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dirs[i] = dir
+	}
+
+	diffs, err := viewservice.NewService().Diff(context.Background(), viewmanager.NewFileManager(dirs[1]), viewmanager.NewFileManager(dirs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := printer.NewChanges(diffs).Render(&buf, false); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestChangesRenderQueryDiff(t *testing.T) {
+	got := renderDiff(t,
+		[2]string{"SELECT\n  id,\n  status\nFROM raw.orders\nWHERE id > 0\n", ""},
+		[2]string{"SELECT\n  id,\n  state,\n  total\nFROM raw.orders\nWHERE id > 0\n", ""},
+	)
+	want := "--- a/sales.orders\n" +
+		"+++ b/sales.orders\n" +
+		"@@ -1,5 +1,6 @@\n" +
+		" SELECT\n" +
+		"   id,\n" +
+		"-  status\n" +
+		"+  state,\n" +
+		"+  total\n" +
+		" FROM raw.orders\n" +
+		" WHERE id > 0\n" +
+		"\n" +
+		"0 to create, 1 to change, 0 to delete\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
+
+func TestChangesRenderMetadataDiff(t *testing.T) {
+	got := renderDiff(t,
+		[2]string{"SELECT 1 AS id\n", "metadata:\n  description: Orders\n  labels:\n    team: sales\n"},
+		[2]string{"SELECT 1 AS id\n", "metadata:\n  description: All orders\n"},
+	)
+	want := "--- a/sales.orders\n" +
+		"+++ b/sales.orders\n" +
+		"# query unchanged\n" +
+		"# description: \"Orders\" -> \"All orders\"\n" +
+		"# labels.team: \"sales\" -> (none)\n" +
+		"\n" +
+		"0 to create, 1 to change, 0 to delete\n"
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected output (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,74 @@
+package printer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/rerost/bqv/domain/history"
+)
+
+// Apply is the output of an apply in the history.
+type Apply struct {
+	ID        string        `json:"id" yaml:"id"`
+	CreatedAt time.Time     `json:"created_at" yaml:"created_at"`
+	Status    string        `json:"status" yaml:"status"`
+	Error     string        `json:"error,omitempty" yaml:"error,omitempty"`
+	Datasets  []string      `json:"datasets,omitempty" yaml:"datasets,omitempty"`
+	Changes   []ApplyChange `json:"changes" yaml:"changes"`
+}
+
+type ApplyChange struct {
+	DataSet string   `json:"dataset" yaml:"dataset"`
+	Name    string   `json:"name" yaml:"name"`
+	Actions []string `json:"actions" yaml:"actions"`
+}
+
+type Applies []Apply
+
+func NewApplies(entries []history.Entry) Applies {
+	res := make(Applies, 0, len(entries))
+	for _, e := range entries {
+		changes := make([]ApplyChange, 0, len(e.Changes))
+		for _, c := range e.Changes {
+			actions := make([]string, 0, len(c.Actions))
+			for _, a := range c.Actions {
+				actions = append(actions, string(a))
+			}
+			changes = append(changes, ApplyChange{DataSet: c.DataSet, Name: c.Name, Actions: actions})
+		}
+		var datasets []string
+		for _, d := range e.Datasets {
+			datasets = append(datasets, d.Name)
+		}
+		res = append(res, Apply{
+			ID:        e.ID,
+			CreatedAt: e.CreatedAt,
+			Status:    string(e.Status),
+			Error:     e.Error,
+			Datasets:  datasets,
+			Changes:   changes,
+		})
+	}
+	return res
+}
+
+func (as Applies) Header() []string {
+	return []string{"ID", "CREATED_AT", "STATUS", "CHANGES"}
+}
+
+func (as Applies) Rows() [][]string {
+	rows := make([][]string, 0, len(as))
+	for _, a := range as {
+		rows = append(rows, []string{a.ID, a.CreatedAt.Local().Format(time.RFC3339), a.Status, strconv.Itoa(len(a.Datasets) + len(a.Changes))})
+	}
+	return rows
+}
+
+// Names returns the apply IDs.
+func (as Applies) Names() []string {
+	names := make([]string, 0, len(as))
+	for _, a := range as {
+		names = append(names, a.ID)
+	}
+	return names
+}
@@ -0,0 +1,122 @@
+package printer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type Format string
+
+const (
+	// FormatDefault prints human readable output. It is a table except for outputs that have their own rendering (e.g. diff).
+	FormatDefault Format = ""
+	FormatTable   Format = "table"
+	FormatJSON    Format = "json"
+	FormatYAML    Format = "yaml"
+	// FormatName prints one `<dataset>.<name>` per line.
+	FormatName Format = "name"
+)
+
+var Formats = []Format{FormatTable, FormatJSON, FormatYAML, FormatName}
+
+// Table is implemented by outputs that can be printed as a table.
+type Table interface {
+	Header() []string
+	Rows() [][]string
+}
+
+// Namer is implemented by outputs that can be printed with FormatName.
+type Namer interface {
+	Names() []string
+}
+
+// Renderer is implemented by outputs that have their own human readable rendering.
+type Renderer interface {
+	Render(w io.Writer, color bool) error
+}
+
+type Printer interface {
+	Print(v interface{}) error
+}
+
+type printerImpl struct {
+	format Format
+	w      io.Writer
+}
+
+func New(format Format, w io.Writer) (Printer, error) {
+	switch format {
+	case FormatDefault, FormatTable, FormatJSON, FormatYAML, FormatName:
+	default:
+		formats := make([]string, len(Formats))
+		for i, f := range Formats {
+			formats[i] = string(f)
+		}
+		return nil, errors.Errorf("unknown output format %q (must be one of %s)", format, strings.Join(formats, ", "))
+	}
+
+	return printerImpl{format: format, w: w}, nil
+}
+
+func (p printerImpl) Print(v interface{}) error {
+	switch p.format {
+	case FormatJSON:
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(v))
+	case FormatYAML:
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = p.w.Write(out)
+		return errors.WithStack(err)
+	case FormatName:
+		n, ok := v.(Namer)
+		if !ok {
+			return errors.Errorf("%T can not be printed as %s", v, p.format)
+		}
+		for _, name := range n.Names() {
+			if _, err := fmt.Fprintln(p.w, name); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	case FormatDefault:
+		if r, ok := v.(Renderer); ok {
+			return errors.WithStack(r.Render(p.w, p.color()))
+		}
+	}
+
+	t, ok := v.(Table)
+	if !ok {
+		return errors.Errorf("%T can not be printed as %s", v, FormatTable)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.Header(), "\t"))
+	for _, row := range t.Rows() {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return errors.WithStack(tw.Flush())
+}
+
+func (p printerImpl) color() bool {
+	f, ok := p.w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+// isTerminal reports whether f is a character device such as a TTY.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,52 @@
+package printer
+
+import "github.com/rerost/bqv/domain/tester"
+
+// Result is the output of a query or a test.
+type Result struct {
+	Name   string `json:"name" yaml:"name"`
+	Status string `json:"status" yaml:"status"`
+	JobID  string `json:"job_id,omitempty" yaml:"job_id,omitempty"`
+	// Message is why it failed.
+	Message string `json:"message,omitempty" yaml:"message,omitempty"`
+}
+
+type Results []Result
+
+// NewTestResults returns the results of tests in report.
+func NewTestResults(report tester.Report) Results {
+	results := make(Results, 0, len(report.Results))
+	for _, r := range report.Results {
+		result := Result{Name: r.View + "/" + r.Name, Status: StatusSucceeded, JobID: r.JobID, Message: r.Failure}
+		if !r.Passed() {
+			result.Status = StatusFailed
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+func (rs Results) Header() []string {
+	return []string{"NAME", "STATUS"}
+}
+
+func (rs Results) Rows() [][]string {
+	rows := make([][]string, 0, len(rs))
+	for _, r := range rs {
+		rows = append(rows, []string{r.Name, r.Status})
+	}
+	return rows
+}
+
+func (rs Results) Names() []string {
+	names := make([]string, 0, len(rs))
+	for _, r := range rs {
+		names = append(names, r.Name)
+	}
+	return names
+}
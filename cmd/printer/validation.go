@@ -0,0 +1,85 @@
+package printer
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/rerost/bqv/domain/viewservice"
+)
+
+// Validation is the output of a dry run of a view. File, Line and Column are the position of Error.
+type Validation struct {
+	DataSet             string `json:"dataset" yaml:"dataset"`
+	Name                string `json:"name" yaml:"name"`
+	Status              string `json:"status" yaml:"status"`
+	TotalBytesProcessed int64  `json:"total_bytes_processed" yaml:"total_bytes_processed"`
+	File                string `json:"file,omitempty" yaml:"file,omitempty"`
+	Line                int    `json:"line,omitempty" yaml:"line,omitempty"`
+	Column              int    `json:"column,omitempty" yaml:"column,omitempty"`
+	Error               string `json:"error,omitempty" yaml:"error,omitempty"`
+	SkippedBy           string `json:"skipped_by,omitempty" yaml:"skipped_by,omitempty"`
+}
+
+type Validations []Validation
+
+const (
+	StatusValid   = "valid"
+	StatusInvalid = "invalid"
+	StatusSkipped = "skipped"
+)
+
+// NewValidations returns the output of validations. path returns the file of a view.
+func NewValidations(validations []viewservice.Validation, path func(dataset string, name string) string) Validations {
+	res := make(Validations, 0, len(validations))
+	for _, v := range validations {
+		out := Validation{
+			DataSet:             v.DataSet,
+			Name:                v.Name,
+			Status:              StatusValid,
+			TotalBytesProcessed: v.TotalBytesProcessed,
+			File:                path(v.DataSet, v.Name),
+			SkippedBy:           v.SkippedBy,
+		}
+		switch {
+		case !v.Valid():
+			out.Status = StatusInvalid
+			out.Line, out.Column, out.Error = v.Err.Line, v.Err.Column, v.Err.Message
+		case v.SkippedBy != "":
+			out.Status = StatusSkipped
+		}
+		res = append(res, out)
+	}
+	return res
+}
+
+// Position returns `<file>:<line>:<column>` of the error.
+func (v Validation) Position() string {
+	if v.Line == 0 {
+		return v.File
+	}
+	return fmt.Sprintf("%s:%d:%d", v.File, v.Line, v.Column)
+}
+
+func (vs Validations) Header() []string {
+	return []string{"DATASET", "NAME", "STATUS", "BYTES"}
+}
+
+func (vs Validations) Rows() [][]string {
+	rows := make([][]string, 0, len(vs))
+	for _, v := range vs {
+		bytes := strconv.FormatInt(v.TotalBytesProcessed, 10)
+		if v.Status != StatusValid {
+			bytes = "-"
+		}
+		rows = append(rows, []string{v.DataSet, v.Name, v.Status, bytes})
+	}
+	return rows
+}
+
+func (vs Validations) Names() []string {
+	names := make([]string, 0, len(vs))
+	for _, v := range vs {
+		names = append(names, v.DataSet+"."+v.Name)
+	}
+	return names
+}
@@ -0,0 +1,72 @@
+package printer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/domain/viewservice"
+)
+
+// View is the output of a view.
+// QueryHash is the hex encoded SHA-256 of the query, and Metadata is the metadata managed by bqv.
+type View struct {
+	DataSet   string                 `json:"dataset" yaml:"dataset"`
+	Name      string                 `json:"name" yaml:"name"`
+	QueryHash string                 `json:"query_hash" yaml:"query_hash"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+}
+
+type Views []View
+
+func NewView(dataset string, name string, definition *viewservice.Definition) *View {
+	if definition == nil {
+		return nil
+	}
+	return &View{
+		DataSet:   dataset,
+		Name:      name,
+		QueryHash: hash(definition.Query),
+		Metadata:  definition.Metadata,
+	}
+}
+
+func NewViews(views []viewmanager.View) Views {
+	res := make(Views, 0, len(views))
+	for _, v := range views {
+		res = append(res, *NewView(v.DataSet(), v.Name(), viewservice.NewDefinition(v)))
+	}
+	return res
+}
+
+func (vs Views) Header() []string {
+	return []string{"DATASET", "NAME", "QUERY_HASH"}
+}
+
+func (vs Views) Rows() [][]string {
+	rows := make([][]string, 0, len(vs))
+	for _, v := range vs {
+		rows = append(rows, []string{v.DataSet, v.Name, shortHash(v.QueryHash)})
+	}
+	return rows
+}
+
+func (vs Views) Names() []string {
+	names := make([]string, 0, len(vs))
+	for _, v := range vs {
+		names = append(names, v.DataSet+"."+v.Name)
+	}
+	return names
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 
 	"github.com/rerost/bqv/cmd/alpha"
+	"github.com/rerost/bqv/cmd/printer"
+	"github.com/rerost/bqv/cmd/tester"
 	"github.com/rerost/bqv/cmd/view"
+	"github.com/rerost/bqv/domain/history"
 	"github.com/rerost/bqv/domain/query"
 	"github.com/rerost/bqv/domain/template"
-	"github.com/rerost/bqv/domain/tester"
+	dtester "github.com/rerost/bqv/domain/tester"
 	"github.com/rerost/bqv/domain/viewmanager"
 	"github.com/rerost/bqv/domain/viewservice"
 	"github.com/spf13/cobra"
@@ -18,9 +21,11 @@ func NewCmdRoot(
 	viewService viewservice.ViewService,
 	bqManager viewmanager.BQManager,
 	fileManager viewmanager.FileManager,
+	h history.History,
 	queryService query.QueryService,
 	templateService template.TemplateService,
-	testService tester.TestService,
+	testService dtester.TestService,
+	p printer.Printer,
 ) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "bqv",
@@ -28,8 +33,9 @@ func NewCmdRoot(
 	}
 
 	cmd.AddCommand(
-		view.NewCmd(ctx, viewService, bqManager, fileManager),
-		alpha.NewCmd(ctx, queryService, templateService, testService),
+		view.NewCmd(ctx, viewService, bqManager, fileManager, h, p),
+		tester.NewCmd(ctx, fileManager, testService, p),
+		alpha.NewCmd(ctx, queryService, templateService, testService, p),
 	)
 
 	return cmd
@@ -0,0 +1,121 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
+	"github.com/rerost/bqv/domain/tester"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/spf13/cobra"
+)
+
+func NewCmd(
+	ctx context.Context,
+	fileManager viewmanager.FileManager,
+	testService tester.TestService,
+	p printer.Printer,
+) *cobra.Command {
+	var junitReport, jsonReport string
+
+	cmd := &cobra.Command{
+		Use:   "test [DATASET[/VIEW]]",
+		Short: "Run [bqv:TEST] blocks in view files",
+		Args:  cobra.MaximumNArgs(1),
+		// Failed tests are not usage errors.
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var dataset, name string
+			if len(args) == 1 {
+				parts := strings.SplitN(strings.TrimSuffix(args[0], ".sql"), "/", 2)
+				dataset = parts[0]
+				if len(parts) == 2 {
+					name = parts[1]
+				}
+			}
+
+			views, err := fileManager.List(ctx)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			report := tester.Report{Timestamp: time.Now()}
+			for _, v := range views {
+				if (dataset != "" && v.DataSet() != dataset) || (name != "" && v.Name() != name) {
+					continue
+				}
+
+				cases, err := tester.ParseCases(v.Query())
+				// A file whose tests cannot be parsed fails, and the tests in the other files still run.
+				if err != nil {
+					result := tester.Result{
+						View:    v.DataSet() + "." + v.Name(),
+						Name:    filepath.Base(fileManager.Path(v)),
+						Failure: errors.WithMessagef(err, "Failed to parse tests in %s", fileManager.Path(v)).Error(),
+					}
+					PrintFailure(cmd.ErrOrStderr(), result)
+					report.Results = append(report.Results, result)
+					continue
+				}
+				for _, c := range cases {
+					start := time.Now()
+					r, err := testService.RunCase(ctx, v, c)
+					result := tester.Result{
+						View:     v.DataSet() + "." + v.Name(),
+						Name:     c.Name,
+						Duration: time.Since(start),
+						JobID:    r.JobID,
+						Failure:  r.Failure(),
+					}
+					if err != nil {
+						result.Failure = err.Error()
+					}
+					PrintFailure(cmd.ErrOrStderr(), result)
+					report.Results = append(report.Results, result)
+				}
+			}
+
+			return errors.WithStack(Finish(report, p, junitReport, jsonReport))
+		},
+	}
+
+	AddReportFlags(cmd, &junitReport, &jsonReport)
+
+	return cmd
+}
+
+// AddReportFlags adds the flags of report files to cmd.
+func AddReportFlags(cmd *cobra.Command, junitReport *string, jsonReport *string) {
+	cmd.Flags().StringVar(junitReport, "junit-report", "", "Write the results as JUnit XML to the file")
+	cmd.Flags().StringVar(jsonReport, "json-report", "", "Write the results as JSON to the file")
+}
+
+// PrintFailure prints why result failed. It prints nothing if result passed.
+func PrintFailure(w io.Writer, result tester.Result) {
+	if result.Passed() {
+		return
+	}
+	fmt.Fprintf(w, "--- FAIL: %s/%s\n", result.View, result.Name)
+	for _, line := range strings.Split(result.Failure, "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+// Finish prints and saves report, and returns an error if any test failed.
+func Finish(report tester.Report, p printer.Printer, junitReport string, jsonReport string) error {
+	if err := p.Print(printer.NewTestResults(report)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := report.Save(junitReport, jsonReport); err != nil {
+		return errors.WithStack(err)
+	}
+	if n := report.Failures(); n != 0 {
+		return errors.Errorf("%d of %d tests failed", n, len(report.Results))
+	}
+	return nil
+}
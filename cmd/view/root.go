@@ -1,41 +1,63 @@
 package view
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
+	"github.com/rerost/bqv/domain/history"
 	"github.com/rerost/bqv/domain/viewmanager"
 	"github.com/rerost/bqv/domain/viewservice"
 	"github.com/spf13/cobra"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
 )
 
-func NewCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, fileManager viewmanager.FileManager) *cobra.Command {
+func NewCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, fileManager viewmanager.FileManager, h history.History, p printer.Printer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "view",
 	}
+	sel := &selection{}
+	sel.addFlags(cmd.PersistentFlags())
 
 	cmd.AddCommand(
 		&cobra.Command{
-			Use: "diff",
+			Use:   "diff [SELECTOR]...",
+			Short: "Show the changes that apply would make. SELECTOR is a <dataset>.<name> glob pattern",
 			RunE: func(_ *cobra.Command, args []string) error {
-				res, err := viewService.Diff(ctx, fileManager, bqManager)
+				f := sel.filter(args)
+				datasets, err := viewService.DiffDatasets(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f))
 				if err != nil {
 					return errors.WithStack(err)
 				}
-				if len(res) == 0 {
-					return nil
+				res, err := viewService.Diff(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f))
+				if err != nil {
+					return errors.WithStack(err)
 				}
-				// TODO color & format
-				fmt.Println(res)
-
-				return nil
+				return errors.WithStack(p.Print(printer.NewChanges(res).WithDatasets(datasets)))
 			},
 		},
+		newPlanCmd(ctx, viewService, bqManager, fileManager, sel, p),
+		newValidateCmd(ctx, viewService, bqManager, fileManager, sel, p),
+		newApplyCmd(ctx, viewService, bqManager, fileManager, h, sel, p),
+		newHistoryCmd(h, p),
+		newRollbackCmd(ctx, viewService, bqManager, h, sel, p),
 		&cobra.Command{
-			Use: "apply",
+			Use: "dump [SELECTOR]...",
 			RunE: func(_ *cobra.Command, args []string) error {
-				err := viewService.Copy(ctx, fileManager, bqManager)
+				f := sel.filter(args)
+				err := viewService.Copy(ctx, bqManager.WithViewFilter(f), fileManager.WithViewFilter(f))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				err = viewService.CopyDatasets(ctx, bqManager.WithViewFilter(f), fileManager.WithViewFilter(f))
 				if err != nil {
 					return errors.WithStack(err)
 				}
@@ -44,43 +66,388 @@ func NewCmd(ctx context.Context, viewService viewservice.ViewService, bqManager
 			},
 		},
 		&cobra.Command{
-			Use: "dump",
+			Use: "flist [SELECTOR]...",
 			RunE: func(_ *cobra.Command, args []string) error {
-				err := viewService.Copy(ctx, bqManager, fileManager)
+				views, err := viewService.List(ctx, fileManager.WithViewFilter(sel.filter(args)))
 				if err != nil {
 					return errors.WithStack(err)
 				}
-
-				return nil
+				return errors.WithStack(p.Print(printer.NewViews(views)))
 			},
 		},
 		&cobra.Command{
-			Use: "flist",
+			Use: "blist [SELECTOR]...",
 			RunE: func(_ *cobra.Command, args []string) error {
-				views, err := viewService.List(ctx, fileManager)
+				views, err := viewService.List(ctx, bqManager.WithViewFilter(sel.filter(args)))
 				if err != nil {
 					return errors.WithStack(err)
 				}
-				// TODO color & format
-				fmt.Println(views)
-
-				return nil
+				return errors.WithStack(p.Print(printer.NewViews(views)))
 			},
 		},
-		&cobra.Command{
-			Use: "blist",
-			RunE: func(_ *cobra.Command, args []string) error {
-				views, err := viewService.List(ctx, bqManager)
+	)
+
+	return cmd
+}
+
+func newPlanCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, fileManager viewmanager.FileManager, sel *selection, p printer.Printer) *cobra.Command {
+	var (
+		out   string
+		prune bool
+	)
+	cmd := &cobra.Command{
+		Use:   "plan [SELECTOR]...",
+		Short: "Print the changes that apply would make, and write them to --out",
+		RunE: func(_ *cobra.Command, args []string) error {
+			f := sel.filter(args)
+			datasets, err := viewService.DiffDatasets(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			printLocationDrifts(os.Stderr, datasets)
+
+			plan, err := viewService.Plan(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f), viewservice.ApplyOptions{Prune: prune, Datasets: datasets})
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			if out != "" {
+				b, err := json.MarshalIndent(plan, "", "  ")
 				if err != nil {
 					return errors.WithStack(err)
 				}
-				// TODO color & format
-				fmt.Println(views)
+				if err := ioutil.WriteFile(out, b, 0644); err != nil {
+					return errors.WithStack(err)
+				}
+			}
 
-				return nil
-			},
+			return errors.WithStack(p.Print(printer.NewPlanChanges(plan)))
+		},
+	}
+	cmd.Flags().StringVar(&out, "out", "", "File to write the plan to, for apply --plan")
+	cmd.Flags().BoolVar(&prune, "prune", false, "Plan deletion of views that are not in dir, in datasets that dir manages")
+
+	return cmd
+}
+
+func newApplyCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, fileManager viewmanager.FileManager, h history.History, sel *selection, p printer.Printer) *cobra.Command {
+	var (
+		prune          bool
+		yes            bool
+		skipValidation bool
+		atomic         bool
+		planFile       string
+	)
+	cmd := &cobra.Command{
+		Use:          "apply [SELECTOR]...",
+		Short:        "Apply views to BigQuery. With --plan, apply the plan only if BigQuery has not changed since the plan was made. SELECTOR is a <dataset>.<name> glob pattern",
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			opts := viewservice.ApplyOptions{Prune: prune, SkipValidation: skipValidation, Atomic: atomic}
+			if !yes {
+				opts.Confirm = confirmDeletion(os.Stdin, os.Stderr)
+			}
+			finish := recordHistory(ctx, h, os.Stderr, &opts)
+
+			if planFile == "" {
+				f := sel.filter(args)
+				// Datasets are written first so that views are created in them with their settings.
+				datasets, err := viewService.DiffDatasets(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				printLocationDrifts(os.Stderr, datasets)
+				opts.Datasets = datasets
+
+				applied, err := viewService.Apply(ctx, fileManager.WithViewFilter(f), bqManager.WithViewFilter(f), opts)
+				finish(err)
+				printValidationError(os.Stderr, err, fileManager)
+				printRollbackError(os.Stderr, err)
+				printConflictErrors(os.Stderr, err)
+				if perr := p.Print(printer.NewChanges(applied.Views).WithDatasets(applied.Datasets)); perr != nil {
+					return errors.WithStack(perr)
+				}
+				return errors.WithStack(err)
+			}
+
+			if len(args) != 0 || !sel.empty() {
+				return errors.New("Selectors, --include and --exclude cannot be used with --plan")
+			}
+			b, err := ioutil.ReadFile(planFile)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			var plan viewservice.Plan
+			if err := json.Unmarshal(b, &plan); err != nil {
+				return errors.WithMessagef(err, "Failed to parse %s", planFile)
+			}
+
+			err = viewService.ApplyPlan(ctx, plan, bqManager, opts)
+			finish(err)
+			if err != nil {
+				printValidationError(os.Stderr, err, fileManager)
+				printRollbackError(os.Stderr, err)
+				printConflictErrors(os.Stderr, err)
+				return errors.WithStack(err)
+			}
+
+			return errors.WithStack(p.Print(printer.NewPlanChanges(plan)))
+		},
+	}
+	cmd.Flags().BoolVar(&prune, "prune", false, "Delete views that are not in dir, in datasets that dir manages")
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Delete views without confirmation")
+	cmd.Flags().BoolVar(&skipValidation, "skip-validation", false, "Apply without dry-running the views first")
+	cmd.Flags().BoolVar(&atomic, "atomic", false, "Stop at the first failure and revert the views applied before it")
+	cmd.Flags().StringVar(&planFile, "plan", "", "Plan file written by plan --out to apply instead of dir")
+
+	return cmd
+}
+
+func newHistoryCmd(h history.History, p printer.Printer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "history",
+		Short: "List applies kept in the history, from the oldest",
+		RunE: func(_ *cobra.Command, args []string) error {
+			entries, err := h.List()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			return errors.WithStack(p.Print(printer.NewApplies(entries)))
 		},
+	}
+}
+
+func newRollbackCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, h history.History, sel *selection, p printer.Printer) *cobra.Command {
+	var (
+		yes    bool
+		atomic bool
 	)
+	cmd := &cobra.Command{
+		Use:          "rollback APPLY_ID [SELECTOR]...",
+		Short:        "Restore views in BigQuery to their definitions before an apply. Views created by the apply are deleted",
+		SilenceUsage: true,
+		Args:         cobra.MinimumNArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			if !h.Enabled() {
+				return errors.New("history is disabled; set --history-dir or history_dir in bqv.yaml")
+			}
+			entry, err := h.Get(args[0])
+			if err == history.NotFoundError {
+				return errors.Errorf("apply %s is not found in the history", args[0])
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			f := sel.filter(args[1:])
+			snapshots, err := h.Snapshots(ctx, entry, f.Match)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			datasets, err := viewService.DiffDatasets(ctx, h.Datasets(entry).WithViewFilter(f), bqManager.WithViewFilter(f))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if len(snapshots) == 0 && len(datasets) == 0 {
+				return errors.Errorf("no selected view was changed by apply %s", entry.ID)
+			}
+
+			opts := viewservice.ApplyOptions{Atomic: atomic, Datasets: datasets}
+			if !yes {
+				opts.Confirm = confirmDeletion(os.Stdin, os.Stderr)
+			}
+			// A rollback is an apply too, so that it can be rolled back.
+			finish := recordHistory(ctx, h, os.Stderr, &opts)
+
+			restored, err := viewService.Restore(ctx, snapshots, bqManager, opts)
+			finish(err)
+			printRollbackError(os.Stderr, err)
+			printConflictErrors(os.Stderr, err)
+			if perr := p.Print(printer.NewChanges(restored.Views).WithDatasets(restored.Datasets)); perr != nil {
+				return errors.WithStack(perr)
+			}
+			return errors.WithStack(err)
+		},
+	}
+	cmd.Flags().BoolVarP(&yes, "yes", "y", false, "Delete views created by the apply without confirmation")
+	cmd.Flags().BoolVar(&atomic, "atomic", false, "Stop at the first failure and revert the views restored before it")
 
 	return cmd
 }
+
+// recordHistory makes opts keep the changes in h before they are written, and prints the apply ID to w.
+// The returned function records the result of the apply.
+func recordHistory(ctx context.Context, h history.History, w io.Writer, opts *viewservice.ApplyOptions) func(err error) {
+	if !h.Enabled() {
+		return func(error) {}
+	}
+
+	var entry *history.Entry
+	opts.BeforeWrite = func(changes []viewservice.ViewDiff, datasets []viewservice.DatasetDiff) error {
+		e, err := h.Record(ctx, changes, datasets)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to keep the previous views and datasets in the history")
+		}
+		entry = &e
+		fmt.Fprintf(w, "Apply ID: %s\n", e.ID)
+		return nil
+	}
+	return func(err error) {
+		if entry == nil {
+			return
+		}
+		if _, herr := h.Finish(*entry, err); herr != nil {
+			zap.L().Warn("Failed to record the result in the history", zap.String("id", entry.ID), zap.Error(herr))
+		}
+	}
+}
+
+func newValidateCmd(ctx context.Context, viewService viewservice.ViewService, bqManager viewmanager.BQManager, fileManager viewmanager.FileManager, sel *selection, p printer.Printer) *cobra.Command {
+	return &cobra.Command{
+		Use:          "validate [SELECTOR]...",
+		Short:        "Dry-run every view in dir and report errors and the bytes that the views would process",
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			f := sel.filter(args)
+			bqManager := bqManager.WithViewFilter(f)
+			validations, err := viewService.Validate(ctx, fileManager.WithViewFilter(f), bqManager, bqManager)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			out := printer.NewValidations(validations, fileManager.QueryPath)
+			invalid := 0
+			for _, v := range out {
+				switch v.Status {
+				case printer.StatusInvalid:
+					invalid++
+					fmt.Fprintf(os.Stderr, "%s: %s\n", v.Position(), v.Error)
+				case printer.StatusSkipped:
+					fmt.Fprintf(os.Stderr, "%s: skipped because %s does not exist yet\n", v.File, v.SkippedBy)
+				}
+			}
+			if err := p.Print(out); err != nil {
+				return errors.WithStack(err)
+			}
+			if invalid != 0 {
+				return errors.Errorf("%d of %d views are invalid", invalid, len(out))
+			}
+			return nil
+		},
+	}
+}
+
+// printValidationError prints the positions of invalid queries if err is viewservice.ValidationError.
+func printValidationError(w io.Writer, err error, fileManager viewmanager.FileManager) {
+	verr, ok := errors.Cause(err).(viewservice.ValidationError)
+	if !ok {
+		return
+	}
+	for _, v := range printer.NewValidations(verr.Validations, fileManager.QueryPath) {
+		if v.Status == printer.StatusInvalid {
+			fmt.Fprintf(w, "%s: %s\n", v.Position(), v.Error)
+		}
+	}
+}
+
+// printLocationDrifts warns about datasets in another location than in their settings, which apply cannot fix.
+func printLocationDrifts(w io.Writer, diffs []viewservice.DatasetDiff) {
+	for _, d := range diffs {
+		if d.LocationDrift {
+			fmt.Fprintf(w, "Dataset %s is in %s, not in %s as in %s. The location of a dataset cannot be changed; recreate the dataset to move it.\n", d.Name, d.Destination.Location, d.Source.Location, viewmanager.DatasetFileName)
+		}
+	}
+}
+
+// printRollbackError prints what was rolled back if err is viewservice.RollbackError.
+func printRollbackError(w io.Writer, err error) {
+	rerr, ok := errors.Cause(err).(viewservice.RollbackError)
+	if !ok {
+		return
+	}
+	fmt.Fprintf(w, "Failed to apply %s.%s: %v\n", rerr.Failed.DataSet, rerr.Failed.Name, rerr.Err)
+	if len(rerr.RolledBack) != 0 {
+		fmt.Fprintln(w, "Rolled back:")
+		for _, d := range rerr.RolledBack {
+			fmt.Fprintf(w, "  %s.%s (%s)\n", d.DataSet, d.Name, rollbackAction(d))
+		}
+	}
+	if len(rerr.NotRolledBack) != 0 {
+		fmt.Fprintf(w, "Failed to roll back, these views are still applied: %v\n", rerr.RollbackErr)
+		for _, d := range rerr.NotRolledBack {
+			fmt.Fprintf(w, "  %s.%s\n", d.DataSet, d.Name)
+		}
+	}
+	if len(rerr.RolledBackDatasets) != 0 {
+		fmt.Fprintln(w, "Restored the settings of datasets:")
+		for _, d := range rerr.RolledBackDatasets {
+			fmt.Fprintf(w, "  %s\n", d.Name)
+		}
+	}
+	if len(rerr.NotRolledBackDatasets) != 0 {
+		fmt.Fprintf(w, "Failed to roll back, these datasets still have the applied settings: %v\n", rerr.DatasetRollbackErr)
+		for _, d := range rerr.NotRolledBackDatasets {
+			fmt.Fprintf(w, "  %s\n", d.Name)
+		}
+	}
+}
+
+// printConflictErrors prints the views that were changed in BigQuery by someone else, with their definitions in BigQuery now.
+func printConflictErrors(w io.Writer, err error) {
+	for _, cerr := range conflictErrors(err) {
+		if cerr.Remote == nil {
+			fmt.Fprintf(w, "%s.%s was deleted from BigQuery since diff, so it was not written.\n", cerr.DataSet, cerr.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s.%s was changed in BigQuery since diff, so it was not written. It is now:\n", cerr.DataSet, cerr.Name)
+		for _, line := range strings.Split(cerr.Remote.Query(), "\n") {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
+
+// conflictErrors returns the ConflictErrors in err, which may combine errors of views.
+func conflictErrors(err error) []viewmanager.ConflictError {
+	if err == nil {
+		return nil
+	}
+	res := []viewmanager.ConflictError{}
+	for _, e := range multierr.Errors(errors.Cause(err)) {
+		switch e := errors.Cause(e).(type) {
+		case viewmanager.ConflictError:
+			res = append(res, e)
+		case viewservice.RollbackError:
+			res = append(res, conflictErrors(e.Err)...)
+		}
+	}
+	return res
+}
+
+func rollbackAction(d viewservice.ViewDiff) string {
+	switch {
+	case d.Has(viewservice.ActionCreate):
+		return "deleted the created view"
+	case d.Has(viewservice.ActionDelete):
+		return "recreated the deleted view"
+	default:
+		return "restored the previous definition"
+	}
+}
+
+// confirmDeletion asks on out whether the views may be deleted, and reads the answer from in.
+func confirmDeletion(in io.Reader, out io.Writer) func([]viewservice.ViewDiff) bool {
+	return func(deletions []viewservice.ViewDiff) bool {
+		fmt.Fprintln(out, "The following views will be deleted:")
+		for _, d := range deletions {
+			fmt.Fprintf(out, "  %s.%s\n", d.DataSet, d.Name)
+		}
+		fmt.Fprint(out, "Delete these views? [y/N]: ")
+
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true
+		}
+		return false
+	}
+}
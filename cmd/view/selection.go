@@ -0,0 +1,29 @@
+package view
+
+import (
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/spf13/pflag"
+)
+
+// selection is the views that a command reads and writes, selected by positional arguments and --include/--exclude.
+type selection struct {
+	include []string
+	exclude []string
+}
+
+func (s *selection) addFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVar(&s.include, "include", []string{}, "Only views matching these <dataset>.<name> glob patterns. A pattern without a dot selects a dataset")
+	flags.StringSliceVar(&s.exclude, "exclude", []string{}, "Skip views matching these <dataset>.<name> glob patterns. A pattern without a dot selects a dataset")
+}
+
+// filter returns the filter of args and the flags. All views are selected when neither args nor --include is given.
+func (s selection) filter(args []string) viewmanager.ViewFilter {
+	include := make([]string, 0, len(args)+len(s.include))
+	include = append(include, args...)
+	include = append(include, s.include...)
+	return viewmanager.ViewFilter{Include: include, Exclude: s.exclude}
+}
+
+func (s selection) empty() bool {
+	return len(s.include) == 0 && len(s.exclude) == 0
+}
@@ -6,10 +6,11 @@
 package cmd
 
 import (
-	"cloud.google.com/go/bigquery"
 	"context"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/pkg/errors"
+	"github.com/rerost/bqv/cmd/printer"
+	"github.com/rerost/bqv/domain/history"
 	"github.com/rerost/bqv/domain/query"
 	"github.com/rerost/bqv/domain/template"
 	"github.com/rerost/bqv/domain/template/resolver"
@@ -17,49 +18,117 @@ import (
 	"github.com/rerost/bqv/domain/viewmanager"
 	"github.com/rerost/bqv/domain/viewservice"
 	"github.com/spf13/cobra"
+	"os"
 )
 
 // Injectors from wire.go:
 
 func InitializeCmd(ctx context.Context, cfg Config) (*cobra.Command, error) {
-	viewService := viewservice.NewService()
-	bqClient, err := NewBQClient(ctx, cfg)
+	viewService := NewViewService(cfg)
+	backend, err := NewBackend(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
-	bqManager := viewmanager.NewBQManager(bqClient)
+	client := NewRawBQClient(backend)
+	bqClient := NewBQClient(client)
+	restClient := NewRESTClient(backend)
 	fileManager := NewFileManager(cfg)
-	client, err := NewRawBQClient(ctx, cfg)
-	if err != nil {
-		return nil, err
-	}
+	bqManager := NewBQManager(bqClient, restClient, fileManager, cfg)
+	historyHistory := NewHistory(cfg)
 	queryService := query.NewQueryService(client)
 	queryResolver := resolver.NewQueryResolver(client)
 	templateService := template.NewTemplateService(queryResolver)
-	testService := tester.NewTestService(queryService)
-	command := NewCmdRoot(ctx, viewService, bqManager, fileManager, queryService, templateService, testService)
+	testService := NewTestService(queryService, cfg)
+	printerPrinter, err := NewPrinter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	command := NewCmdRoot(ctx, viewService, bqManager, fileManager, historyHistory, queryService, templateService, testService, printerPrinter)
 	return command, nil
 }
 
 // wire.go:
 
-func NewRawBQClient(ctx context.Context, cfg Config) (bqiface.Client, error) {
-	c, err := bigquery.NewClient(ctx, cfg.ProjectID)
-	if err != nil {
-		return nil, errors.WithStack(err)
-	}
+func NewRawBQClient(b Backend) bqiface.Client {
+	return b.BQ
+}
 
-	return bqiface.AdaptClient(c), nil
+func NewBQClient(c bqiface.Client) viewmanager.BQClient {
+	return viewmanager.BQClient(c)
 }
 
-func NewBQClient(ctx context.Context, cfg Config) (viewmanager.BQClient, error) {
-	c, err := NewRawBQClient(ctx, cfg)
-	if err != nil {
-		return nil, errors.WithStack(err)
+func NewRESTClient(b Backend) viewmanager.RESTClient {
+	return b.REST
+}
+
+func NewViewService(cfg Config) viewservice.ViewService {
+	return viewservice.NewService(
+		viewservice.WithProtected(cfg.Protected...),
+		viewservice.WithConcurrency(cfg.Concurrency),
+	)
+}
+
+func NewTestService(queryService query.QueryService, cfg Config) tester.TestService {
+	return tester.NewTestService(queryService, tester.WithProject(cfg.ProjectID))
+}
+
+func NewBQManager(bqClient viewmanager.BQClient, restClient viewmanager.RESTClient, fileManager viewmanager.FileManager, cfg Config) viewmanager.BQManager {
+	bqManager := viewmanager.NewBQManager(bqClient).
+		WithRESTClient(restClient).
+		WithLocation(cfg.Location).
+		WithConcurrency(cfg.Concurrency).
+		WithRetryPolicy(retryPolicy(cfg)).
+		WithDatasetFilter(datasetFilter(cfg)).
+		WithDatasetMapper(viewmanager.DatasetMapper{
+			Project:      cfg.ProjectID,
+			LocalProject: cfg.DirProjectID,
+			Prefix:       cfg.DatasetPrefix,
+			Suffix:       cfg.DatasetSuffix,
+			Names:        cfg.DatasetNames,
+		})
+	// Listing routines takes a request per dataset, so they are listed only where the dir has them unless --routines.
+	if !cfg.Routines {
+		bqManager = bqManager.WithRoutineDatasets(fileManager.RoutineDatasets)
+	}
+	// Authorizations are looked up only in the datasets that a view refers to or declares in authorized_for.
+	return bqManager.WithAuthorizingDatasets(fileManager.AuthorizingDatasets)
+}
+
+func retryPolicy(cfg Config) viewmanager.RetryPolicy {
+	policy := viewmanager.DefaultRetryPolicy
+	if cfg.Retry.MaxAttempts > 0 {
+		policy.MaxAttempts = cfg.Retry.MaxAttempts
+	}
+	if cfg.Retry.InitialBackoff > 0 {
+		policy.InitialBackoff = cfg.Retry.InitialBackoff
+	}
+	if cfg.Retry.MaxBackoff > 0 {
+		policy.MaxBackoff = cfg.Retry.MaxBackoff
+	}
+	if cfg.Retry.Jitter != nil {
+		policy.Jitter = *cfg.Retry.Jitter
 	}
-	return viewmanager.BQClient(c), nil
+	return policy
 }
 
 func NewFileManager(cfg Config) viewmanager.FileManager {
-	return viewmanager.NewFileManager(cfg.Dir)
+	return viewmanager.NewFileManager(cfg.Dir).
+		WithDatasetFilter(datasetFilter(cfg)).
+		WithVars(mergeVars(map[string]string{"project": cfg.ProjectID}, cfg.Vars))
+}
+
+func NewHistory(cfg Config) history.History {
+	return history.New(cfg.HistoryDir)
+}
+
+func datasetFilter(cfg Config) viewmanager.DatasetFilter {
+	return viewmanager.DatasetFilter{
+		Include: cfg.Datasets.Include,
+		Exclude: cfg.Datasets.Exclude,
+	}
+}
+
+func NewPrinter(cfg Config) (printer.Printer, error) {
+	p, err := printer.New(printer.Format(cfg.Output), os.Stdout)
+	return p, errors.WithStack(err)
 }
@@ -0,0 +1,247 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/domain/viewservice"
+	"gopkg.in/yaml.v2"
+)
+
+// EntryFileName is the name of the file of an entry in its directory.
+const EntryFileName = "apply.yaml"
+
+// idFormat is the format of apply IDs. IDs sort in the order of the applies.
+const idFormat = "20060102T150405.000Z"
+
+type Status string
+
+const (
+	StatusStarted   Status = "started"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// NotFoundError is returned when an apply ID is not in the history.
+var NotFoundError = errors.New("apply is not found in the history")
+
+// History keeps the remote definitions of views and settings of datasets before each apply in dir. History with an empty dir is disabled.
+// An apply is kept in `<dir>/<apply ID>/`: EntryFileName and the previous views and datasets in the format of viewmanager.FileManager.
+type History struct {
+	dir string
+	now func() time.Time
+}
+
+// Entry is an apply in the history. Its Datasets are written before its Changes.
+type Entry struct {
+	ID        string          `yaml:"id"`
+	CreatedAt time.Time       `yaml:"created_at"`
+	Status    Status          `yaml:"status"`
+	Error     string          `yaml:"error,omitempty"`
+	Datasets  []DatasetChange `yaml:"datasets,omitempty"`
+	Changes   []Change        `yaml:"changes"`
+}
+
+// DatasetChange is the settings of a dataset written by an apply. Existed is false if the apply created the dataset.
+type DatasetChange struct {
+	Name    string `yaml:"name"`
+	Existed bool   `yaml:"existed"`
+}
+
+// Change is a view written by an apply, in the order they were written.
+// Existed is false if the view did not exist before the apply. Routine is whether the view is a routine.
+type Change struct {
+	DataSet string               `yaml:"dataset"`
+	Name    string               `yaml:"name"`
+	Actions []viewservice.Action `yaml:"actions"`
+	Existed bool                 `yaml:"existed"`
+	Routine bool                 `yaml:"routine,omitempty"`
+}
+
+func New(dir string) History {
+	return History{dir: dir, now: time.Now}
+}
+
+// Enabled returns whether h keeps applies.
+func (h History) Enabled() bool {
+	return h.dir != ""
+}
+
+// WithClock returns History that uses now as the current time.
+func (h History) WithClock(now func() time.Time) History {
+	h.now = now
+	return h
+}
+
+// Record adds an apply of changes and datasets to the history with the previous definitions of the views and settings of the datasets,
+// and returns the entry. The status of the entry is StatusStarted until Finish is called.
+func (h History) Record(ctx context.Context, changes []viewservice.ViewDiff, datasets []viewservice.DatasetDiff) (Entry, error) {
+	now := h.now().UTC()
+	entry := Entry{
+		ID:        now.Format(idFormat),
+		CreatedAt: now,
+		Status:    StatusStarted,
+		Changes:   make([]Change, 0, len(changes)),
+	}
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return Entry{}, errors.WithStack(err)
+	}
+	// Two applies in the same millisecond get different IDs.
+	for i := 2; ; i++ {
+		err := os.Mkdir(h.entryDir(entry.ID), 0755)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return Entry{}, errors.WithStack(err)
+		}
+		entry.ID = fmt.Sprintf("%s-%d", now.Format(idFormat), i)
+	}
+
+	if err := os.Mkdir(h.viewsDir(entry.ID), 0755); err != nil {
+		return Entry{}, errors.WithStack(err)
+	}
+
+	views := h.views(entry.ID)
+	for _, d := range datasets {
+		entry.Datasets = append(entry.Datasets, DatasetChange{Name: d.Name, Existed: d.Destination != nil})
+		if d.Destination == nil {
+			continue
+		}
+		if err := views.CreateDataset(ctx, *d.Destination); err != nil {
+			return Entry{}, errors.WithMessagef(err, "Failed to keep dataset %s in the history", d.Name)
+		}
+	}
+	for _, d := range changes {
+		entry.Changes = append(entry.Changes, Change{
+			DataSet: d.DataSet,
+			Name:    d.Name,
+			Actions: d.Actions,
+			Existed: d.Destination != nil,
+			Routine: (d.Source != nil && viewmanager.IsRoutine(d.Source)) || (d.Destination != nil && viewmanager.IsRoutine(d.Destination)),
+		})
+		if d.Destination == nil {
+			continue
+		}
+		if _, err := views.Create(ctx, d.Destination); err != nil {
+			return Entry{}, errors.WithMessagef(err, "Failed to keep %s.%s in the history", d.DataSet, d.Name)
+		}
+	}
+
+	return entry, errors.WithStack(h.write(entry))
+}
+
+// Finish sets the status of the entry by the result of the apply.
+func (h History) Finish(entry Entry, err error) (Entry, error) {
+	entry.Status = StatusSucceeded
+	entry.Error = ""
+	if err != nil {
+		entry.Status = StatusFailed
+		entry.Error = err.Error()
+	}
+	return entry, errors.WithStack(h.write(entry))
+}
+
+// List returns the entries from the oldest.
+func (h History) List() ([]Entry, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Entry{}, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+
+	entries := []Entry{}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		entry, err := h.Get(file.Name())
+		if err == NotFoundError {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries, nil
+}
+
+func (h History) Get(id string) (Entry, error) {
+	p := filepath.Join(h.entryDir(id), EntryFileName)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Entry{}, NotFoundError
+		}
+		return Entry{}, errors.WithStack(err)
+	}
+
+	var entry Entry
+	if err := yaml.Unmarshal(b, &entry); err != nil {
+		return Entry{}, errors.WithMessagef(err, "Failed to parse %s", p)
+	}
+	return entry, nil
+}
+
+// Snapshots returns the views of entry before the apply, in the order they were written.
+// If match is not nil, only the views for which it returns true are returned.
+func (h History) Snapshots(ctx context.Context, entry Entry, match func(dataset, name string) bool) ([]viewservice.Snapshot, error) {
+	views := h.views(entry.ID)
+	snapshots := []viewservice.Snapshot{}
+	for _, c := range entry.Changes {
+		if match != nil && !match(c.DataSet, c.Name) {
+			continue
+		}
+
+		snapshot := viewservice.Snapshot{DataSet: c.DataSet, Name: c.Name, Routine: c.Routine}
+		if c.Existed {
+			v, err := views.Get(ctx, c.DataSet, c.Name)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "Failed to read %s.%s of %s", c.DataSet, c.Name, entry.ID)
+			}
+			snapshot.View = v
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// Datasets returns the settings of the datasets of entry before the apply, for viewservice.DiffDatasets.
+// Datasets that the apply created are not in it.
+func (h History) Datasets(entry Entry) viewmanager.FileManager {
+	return h.views(entry.ID)
+}
+
+func (h History) entryDir(id string) string {
+	return filepath.Join(h.dir, id)
+}
+
+func (h History) viewsDir(id string) string {
+	return filepath.Join(h.entryDir(id), "views")
+}
+
+func (h History) views(id string) viewmanager.FileManager {
+	return viewmanager.NewFileManager(h.viewsDir(id))
+}
+
+func (h History) write(entry Entry) error {
+	b, err := yaml.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(h.entryDir(entry.ID), EntryFileName), b, 0644))
+}
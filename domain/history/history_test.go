@@ -0,0 +1,199 @@
+package history_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/history"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/domain/viewservice"
+	"github.com/rerost/bqv/mocks/bqfake"
+)
+
+func writeFiles(dir string, files map[string]string) error {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHistoryRollback(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "views")
+	h := history.New(filepath.Join(dir, "history"))
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	bq := viewmanager.NewBQManager(bqfake.New("project"))
+
+	apply := func() history.Entry {
+		t.Helper()
+		var entry history.Entry
+		opts := viewservice.ApplyOptions{Prune: true, BeforeWrite: func(changes []viewservice.ViewDiff, datasets []viewservice.DatasetDiff) error {
+			entry, err = h.Record(ctx, changes, datasets)
+			return err
+		}}
+		_, err := service.Apply(ctx, files, bq, opts)
+		if entry, err = h.Finish(entry, err); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	err = writeFiles(srcDir, map[string]string{
+		"sales/orders.sql": "SELECT 1 AS id",
+		"sales/orders.yml": "metadata:\n  description: Orders\n",
+		"sales/old.sql":    "SELECT 1 AS id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := apply()
+
+	err = writeFiles(srcDir, map[string]string{
+		"sales/orders.sql": "SELECT 2 AS id",
+		"sales/orders.yml": "metadata:\n  description: New orders\n",
+		"sales/new.sql":    "SELECT 3 AS id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(srcDir, "sales/old.sql")); err != nil {
+		t.Fatal(err)
+	}
+	second := apply()
+
+	got, err := h.Get(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []history.Change{
+		{DataSet: "sales", Name: "new", Actions: []viewservice.Action{viewservice.ActionCreate}},
+		{DataSet: "sales", Name: "orders", Actions: []viewservice.Action{viewservice.ActionUpdateQuery, viewservice.ActionUpdateMetadata}, Existed: true},
+		{DataSet: "sales", Name: "old", Actions: []viewservice.Action{viewservice.ActionDelete}, Existed: true},
+	}
+	if diff := cmp.Diff(want, got.Changes); diff != "" {
+		t.Errorf("unexpected changes (-want +got):\n%s", diff)
+	}
+	if got.Status != history.StatusSucceeded {
+		t.Errorf("unexpected status %q", got.Status)
+	}
+
+	snapshots, err := h.Snapshots(ctx, got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Restore(ctx, snapshots, bq, viewservice.ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// BigQuery is back to the first apply.
+	firstDir := filepath.Join(dir, "first")
+	err = writeFiles(firstDir, map[string]string{
+		"sales/orders.sql": "SELECT 1 AS id",
+		"sales/orders.yml": "metadata:\n  description: Orders\n",
+		"sales/old.sql":    "SELECT 1 AS id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := service.Diff(ctx, viewmanager.NewFileManager(firstDir), bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after rollback, got %v", diffs)
+	}
+
+	entries, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	if diff := cmp.Diff([]string{first.ID, second.ID}, ids); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+}
+
+func TestHistoryRollbackDatasets(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "history_datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := history.New(filepath.Join(dir, "history"))
+	service := viewservice.NewService()
+	bq := viewmanager.NewBQManager(bqfake.New("project"))
+	if err := bq.CreateDataset(ctx, viewmanager.DatasetSetting{Name: "sales", Description: "Sales"}); err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(files map[string]string) history.Entry {
+		t.Helper()
+		srcDir, err := ioutil.TempDir(dir, "views")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFiles(srcDir, files); err != nil {
+			t.Fatal(err)
+		}
+		src := viewmanager.NewFileManager(srcDir)
+		datasets, err := service.DiffDatasets(ctx, src, bq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry history.Entry
+		opts := viewservice.ApplyOptions{Datasets: datasets, BeforeWrite: func(changes []viewservice.ViewDiff, datasets []viewservice.DatasetDiff) error {
+			entry, err = h.Record(ctx, changes, datasets)
+			return err
+		}}
+		if _, err := service.Apply(ctx, src, bq, opts); err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	entry := apply(map[string]string{
+		"sales/_dataset.yml":  "description: Sales views\n",
+		"report/_dataset.yml": "description: Reports\n",
+	})
+	want := []history.DatasetChange{{Name: "report"}, {Name: "sales", Existed: true}}
+	if diff := cmp.Diff(want, entry.Datasets); diff != "" {
+		t.Errorf("unexpected datasets (-want +got):\n%s", diff)
+	}
+
+	// The settings of the updated dataset are restored. The created dataset is kept.
+	datasets, err := service.DiffDatasets(ctx, h.Datasets(entry), bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Restore(ctx, nil, bq, viewservice.ApplyOptions{Datasets: datasets}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bq.GetDataset(ctx, "sales"); err != nil || got.Description != "Sales" {
+		t.Errorf("want the settings of sales restored, got %v, %v", got, err)
+	}
+	if got, err := bq.GetDataset(ctx, "report"); err != nil || got.Description != "Reports" {
+		t.Errorf("want report kept, got %v, %v", got, err)
+	}
+}
@@ -3,15 +3,20 @@ package query
 import (
 	"context"
 
+	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
 )
 
 type QueryService interface {
-	Exec(ctx context.Context, query string) error
+	// Exec runs query and returns the job ID, which is set even when the query fails once the job has started.
+	Exec(ctx context.Context, query string) (string, error)
 	BulkExec(ctx context.Context, queries []string) error
+	// Read runs query and returns its rows and the job ID. For a script, they are the rows of the last statement.
+	Read(ctx context.Context, query string) ([]map[string]bigquery.Value, string, error)
 }
 
 type queryServiceImpl struct {
@@ -24,10 +29,10 @@ func NewQueryService(bqClient bqiface.Client) QueryService {
 	}
 }
 
-func (q *queryServiceImpl) Exec(ctx context.Context, query string) (err error) {
+func (q *queryServiceImpl) Exec(ctx context.Context, query string) (string, error) {
 	j, err := q.bqClient.Query(query).Run(ctx)
 	if err != nil {
-		return errors.WithStack(err)
+		return "", errors.WithStack(err)
 	}
 	zap.L().Debug("Exec query", zap.String("job_id", j.ID()), zap.String("query", query))
 
@@ -35,14 +40,14 @@ func (q *queryServiceImpl) Exec(ctx context.Context, query string) (err error) {
 	zap.L().Debug("End query", zap.String("job_id", j.ID()))
 	if err != nil {
 		zap.L().Debug("Wait err", zap.String("job_id", j.ID()), zap.String("query", query))
-		return errors.WithStack(err)
+		return j.ID(), errors.WithStack(err)
 	}
 	if err := status.Err(); err != nil {
 		zap.L().Debug("Status err", zap.String("job_id", j.ID()), zap.String("query", query))
-		return errors.WithStack(err)
+		return j.ID(), errors.WithStack(err)
 	}
 
-	return nil
+	return j.ID(), nil
 }
 
 func (q *queryServiceImpl) BulkExec(ctx context.Context, queries []string) error {
@@ -51,7 +56,8 @@ func (q *queryServiceImpl) BulkExec(ctx context.Context, queries []string) error
 	for _, query := range queries {
 		query := query
 		eg.Go(func() error {
-			return errors.WithStack(q.Exec(ctx, query))
+			_, err := q.Exec(ctx, query)
+			return errors.WithStack(err)
 		})
 	}
 
@@ -61,3 +67,30 @@ func (q *queryServiceImpl) BulkExec(ctx context.Context, queries []string) error
 
 	return nil
 }
+
+func (q *queryServiceImpl) Read(ctx context.Context, query string) ([]map[string]bigquery.Value, string, error) {
+	j, err := q.bqClient.Query(query).Run(ctx)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	zap.L().Debug("Read query", zap.String("job_id", j.ID()), zap.String("query", query))
+
+	it, err := j.Read(ctx)
+	if err != nil {
+		return nil, j.ID(), errors.WithStack(err)
+	}
+
+	rows := []map[string]bigquery.Value{}
+	for {
+		row := map[string]bigquery.Value{}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, j.ID(), errors.WithStack(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, j.ID(), nil
+}
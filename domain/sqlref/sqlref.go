@@ -0,0 +1,311 @@
+package sqlref
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Reference is a table reference found in a query.
+// Start and End are byte offsets of the whole reference (including backquotes) in the query,
+// and ProjectStart, ProjectEnd, DataSetStart and DataSetEnd are those of the project and the dataset name.
+// ProjectStart and ProjectEnd are zero when the reference has no project.
+type Reference struct {
+	Project      string
+	DataSet      string
+	Name         string
+	Start        int
+	End          int
+	ProjectStart int
+	ProjectEnd   int
+	DataSetStart int
+	DataSetEnd   int
+}
+
+// ID returns `<dataset>.<name>`.
+func (r Reference) ID() string {
+	return r.DataSet + "." + r.Name
+}
+
+// functionNamespaces are the prefixes of BigQuery functions such as `SAFE.PARSE_DATE`, which are not datasets.
+var functionNamespaces = map[string]bool{
+	"SAFE": true, "NET": true, "HLL_COUNT": true, "KLL_QUANTILES": true, "AEAD": true, "KEYS": true,
+	"DETERMINISTIC_ENCRYPT": true, "ML": true,
+}
+
+var (
+	identifier = "(?:`[^`]+`|[A-Za-z_][A-Za-z0-9_\\-]*)"
+	path       = identifier + "(?:\\s*\\.\\s*" + identifier + ")*"
+	tableRef   = regexp.MustCompile("(?i)\\b(FROM|JOIN)\\s+(" + path + ")")
+	// aliasRef is the alias of a table such as `x` in `FROM a.t x`, which follows a table.
+	aliasRef = regexp.MustCompile("^\\s+((?i:AS)\\s+)?(" + identifier + ")")
+	// commaRef is a table after a comma join such as `FROM a.t x, b.u`, which follows a table or its alias.
+	commaRef = regexp.MustCompile("^\\s*,\\s*(" + path + ")")
+	callRef  = regexp.MustCompile("(" + path + ")\\s*\\(")
+)
+
+// clauseKeywords are the keywords that can follow a table in FROM, which are not aliases unless after AS.
+var clauseKeywords = map[string]bool{
+	"WHERE": true, "GROUP": true, "ORDER": true, "LIMIT": true, "HAVING": true, "QUALIFY": true, "WINDOW": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true, "ON": true, "USING": true,
+	"UNION": true, "INTERSECT": true, "EXCEPT": true, "FOR": true, "TABLESAMPLE": true, "WITH": true, "SELECT": true,
+	"FROM": true, "PIVOT": true, "UNPIVOT": true,
+}
+
+// Find returns table references that follow FROM or JOIN, including the tables joined by commas after them.
+// References written in comments or string literals are ignored, and so are unqualified names (e.g. CTEs).
+// Paths that start with an alias declared earlier in the FROM clause, such as `o.items` in `FROM t o, o.items`,
+// are arrays of the aliased table and are ignored too.
+func Find(query string) []Reference {
+	masked := Mask(query)
+
+	// aliases are the aliases declared in the current FROM clause at each depth of parentheses.
+	aliases := map[int]map[string]bool{}
+	isAlias := func(depth int, span [2]int) bool {
+		parts := splitPath(masked[span[0]:span[1]])
+		if len(parts) != 2 {
+			return false
+		}
+		for d := depth; d >= 0; d-- {
+			if aliases[d][strings.ToLower(parts[0].text)] {
+				return true
+			}
+		}
+		return false
+	}
+
+	spans := [][2]int{}
+	depth, pos := 0, 0
+	for _, m := range tableRef.FindAllStringSubmatchIndex(masked, -1) {
+		depth += strings.Count(masked[pos:m[0]], "(") - strings.Count(masked[pos:m[0]], ")")
+		pos = m[0]
+		if strings.EqualFold(masked[m[2]:m[3]], "FROM") || aliases[depth] == nil {
+			aliases[depth] = map[string]bool{}
+		}
+
+		span := [2]int{m[4], m[5]}
+		for {
+			if !isAlias(depth, span) {
+				spans = append(spans, span)
+			}
+			end := span[1]
+			if a := aliasRef.FindStringSubmatchIndex(masked[end:]); a != nil {
+				alias := strings.Trim(masked[end+a[4]:end+a[5]], "`")
+				if a[2] >= 0 || !clauseKeywords[strings.ToUpper(alias)] {
+					aliases[depth][strings.ToLower(alias)] = true
+					end += a[1]
+				}
+			}
+			c := commaRef.FindStringSubmatchIndex(masked[end:])
+			if c == nil {
+				break
+			}
+			span = [2]int{end + c[2], end + c[3]}
+		}
+	}
+	return references(masked, spans)
+}
+
+// FindCalls returns qualified calls of functions such as `dataset.function(...)`, which may be calls of routines.
+// Calls of functions in BigQuery namespaces (e.g. `SAFE.PARSE_DATE(...)`) are returned as well, and table-valued functions
+// after FROM or JOIN are returned by Find too.
+func FindCalls(query string) []Reference {
+	masked := Mask(query)
+
+	spans := [][2]int{}
+	for _, m := range callRef.FindAllStringSubmatchIndex(masked, -1) {
+		spans = append(spans, [2]int{m[2], m[3]})
+	}
+	return references(masked, spans)
+}
+
+// FindAll returns the table references and the calls of routines in query in the order they appear.
+// Unlike FindCalls, it does not return calls of functions in BigQuery namespaces.
+func FindAll(query string) []Reference {
+	refs := Find(query)
+	seen := make(map[int]bool, len(refs))
+	for _, ref := range refs {
+		seen[ref.Start] = true
+	}
+	for _, ref := range FindCalls(query) {
+		if seen[ref.Start] || (ref.Project == "" && functionNamespaces[strings.ToUpper(ref.DataSet)]) {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Start < refs[j].Start })
+	return refs
+}
+
+// references returns the qualified references at spans, which are the start and end offsets of paths in masked.
+func references(masked string, spans [][2]int) []Reference {
+	refs := []Reference{}
+	for _, span := range spans {
+		start, end := span[0], span[1]
+		parts := splitPath(masked[start:end])
+
+		var ref Reference
+		var dataset segment
+		switch len(parts) {
+		case 2:
+			dataset = parts[0]
+			ref = Reference{DataSet: parts[0].text, Name: parts[1].text}
+		case 3:
+			dataset = parts[1]
+			ref = Reference{Project: parts[0].text, DataSet: parts[1].text, Name: parts[2].text}
+			ref.ProjectStart = start + parts[0].start
+			ref.ProjectEnd = start + parts[0].end
+		default:
+			continue
+		}
+		ref.Start = start
+		ref.End = end
+		ref.DataSetStart = start + dataset.start
+		ref.DataSetEnd = start + dataset.end
+		refs = append(refs, ref)
+	}
+
+	return refs
+}
+
+// Mask returns query with comments and string literals replaced by spaces.
+// Byte offsets in the result are the same as in query.
+func Mask(query string) string {
+	b := []byte(query)
+	blank := func(from, to int) {
+		for i := from; i < to && i < len(b); i++ {
+			if b[i] != '\n' {
+				b[i] = ' '
+			}
+		}
+	}
+
+	for i := 0; i < len(b); {
+		switch {
+		case strings.HasPrefix(query[i:], "--") || b[i] == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			blank(i, i+end)
+			i += end
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 2
+			} else {
+				end += 2
+			}
+			blank(i, i+2+end)
+			i += 2 + end
+		case b[i] == '\'' || b[i] == '"':
+			quote := query[i : i+1]
+			if strings.HasPrefix(query[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			end := closingQuote(query, i+len(quote), quote)
+			blank(i+len(quote), end)
+			i = end + len(quote)
+		case b[i] == '`':
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				return string(b)
+			}
+			i += end + 2
+		default:
+			i++
+		}
+	}
+
+	return string(b)
+}
+
+func closingQuote(query string, from int, quote string) int {
+	for i := from; i < len(query); i++ {
+		if query[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(query[i:], quote) {
+			return i
+		}
+	}
+	return len(query)
+}
+
+type segment struct {
+	text  string
+	start int
+	end   int
+}
+
+// splitPath splits a path such as `a`.b or `a.b` into names with their offsets in path.
+// Dots separate names whether they are quoted or not.
+func splitPath(path string) []segment {
+	segments := []segment{}
+	current := segment{start: -1}
+	flush := func() {
+		if current.start >= 0 {
+			segments = append(segments, current)
+		}
+		current = segment{start: -1}
+	}
+
+	for i, r := range path {
+		switch r {
+		case '.':
+			flush()
+		case '`', ' ', '\t', '\n', '\r':
+		default:
+			if current.start < 0 {
+				current.start = i
+			}
+			current.text += string(r)
+			current.end = i + len(string(r))
+		}
+	}
+	flush()
+
+	return segments
+}
+
+// Replace returns query with the project and the dataset name of each reference found by FindAll replaced by rename.
+// The project is replaced only in references that have one. References for which rename returns false are kept as they are.
+func Replace(query string, rename func(ref Reference) (project string, dataset string, ok bool)) string {
+	var sb strings.Builder
+	last := 0
+	for _, ref := range FindAll(query) {
+		project, dataset, ok := rename(ref)
+		if !ok {
+			continue
+		}
+		if ref.Project != "" {
+			sb.WriteString(query[last:ref.ProjectStart])
+			sb.WriteString(project)
+			last = ref.ProjectEnd
+		}
+		sb.WriteString(query[last:ref.DataSetStart])
+		sb.WriteString(dataset)
+		last = ref.DataSetEnd
+	}
+	sb.WriteString(query[last:])
+	return sb.String()
+}
+
+// ReplaceReference returns query with each whole reference replaced by replace, e.g. with a temporary table name.
+// References for which replace returns false are kept as they are.
+func ReplaceReference(query string, replace func(ref Reference) (string, bool)) string {
+	var sb strings.Builder
+	last := 0
+	for _, ref := range Find(query) {
+		s, ok := replace(ref)
+		if !ok {
+			continue
+		}
+		sb.WriteString(query[last:ref.Start])
+		sb.WriteString(s)
+		last = ref.End
+	}
+	sb.WriteString(query[last:])
+	return sb.String()
+}
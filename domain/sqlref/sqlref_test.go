@@ -0,0 +1,66 @@
+package sqlref_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/sqlref"
+)
+
+func TestFind(t *testing.T) {
+	query := "/* FROM commented.out */\n" +
+		"WITH cte AS (SELECT * FROM `proj.staging.base`)\n" +
+		"SELECT 'FROM quoted.out' FROM cte\n" +
+		"JOIN reporting.summary USING (id) -- JOIN commented.out\n" +
+		"LEFT JOIN `proj`.`staging`.`other` USING (id)\n" +
+		"CROSS JOIN (SELECT * FROM reporting.a AS a, reporting.b b\n, `reporting.c`, UNNEST(a.items) WHERE a.id IN (1, 2))\n"
+
+	var ids []string
+	for _, ref := range sqlref.Find(query) {
+		ids = append(ids, ref.ID())
+	}
+
+	expected := []string{"staging.base", "reporting.summary", "staging.other", "reporting.a", "reporting.b", "reporting.c"}
+	if diff := cmp.Diff(expected, ids); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestFindAliasPaths(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"SELECT item FROM sales.orders o, o.items", []string{"sales.orders"}},
+		{"SELECT item FROM sales.orders AS o, o.items AS item, sales.customers c", []string{"sales.orders", "sales.customers"}},
+		{"SELECT item FROM sales.orders `O` CROSS JOIN o.items LEFT JOIN sales.returns r ON r.id = o.id", []string{"sales.orders", "sales.returns"}},
+		{"SELECT (SELECT COUNT(*) FROM o.items) FROM sales.orders o", []string{"o.items", "sales.orders"}},
+		// An alias is not in scope in another FROM clause.
+		{"SELECT id FROM sales.orders o UNION ALL SELECT id FROM o.items", []string{"sales.orders", "o.items"}},
+		{"SELECT id FROM (SELECT id FROM sales.orders o) JOIN o.items USING (id)", []string{"sales.orders", "o.items"}},
+	}
+	for _, c := range cases {
+		var ids []string
+		for _, ref := range sqlref.Find(c.query) {
+			ids = append(ids, ref.ID())
+		}
+		if diff := cmp.Diff(c.expected, ids); diff != "" {
+			t.Errorf("%s: %s", c.query, diff)
+		}
+	}
+}
+
+func TestFindCalls(t *testing.T) {
+	query := "SELECT udf.normalize(name), `proj.udf.parse` (payload), COUNT(*), 'udf.quoted(x)'\n" +
+		"FROM tvf.recent_orders(7) -- udf.commented(x)\n"
+
+	var ids []string
+	for _, ref := range sqlref.FindCalls(query) {
+		ids = append(ids, ref.ID())
+	}
+
+	expected := []string{"udf.normalize", "udf.parse", "tvf.recent_orders"}
+	if diff := cmp.Diff(expected, ids); diff != "" {
+		t.Error(diff)
+	}
+}
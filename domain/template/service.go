@@ -14,7 +14,15 @@ import (
 )
 
 type TemplateService interface {
-	Run(ctx context.Context, viewDirPath string, templateFilePaths []string) error
+	Run(ctx context.Context, viewDirPath string, templateFilePaths []string) ([]Rendered, error)
+}
+
+// Rendered is a view query rendered from a template.
+type Rendered struct {
+	DataSet string
+	Name    string
+	Query   string
+	Path    string
 }
 
 type templateServiceImpl struct {
@@ -29,28 +37,35 @@ func NewTemplateService(
 	}
 }
 
-func (t *templateServiceImpl) Run(ctx context.Context, viewDirPath string, templateFilePaths []string) error {
+func (t *templateServiceImpl) Run(ctx context.Context, viewDirPath string, templateFilePaths []string) ([]Rendered, error) {
 	var eg errgroup.Group
 
-	for _, templateFilePath := range templateFilePaths {
+	results := make([][]Rendered, len(templateFilePaths))
+	for i, templateFilePath := range templateFilePaths {
+		i := i
 		templateFilePath := templateFilePath
 		eg.Go(func() error {
-			err := t.run(ctx, viewDirPath, templateFilePath)
+			rendered, err := t.run(ctx, viewDirPath, templateFilePath)
+			results[i] = rendered
 			return errors.WithStack(err)
 		})
 	}
 
 	if err := eg.Wait(); err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	return nil
+	rendered := []Rendered{}
+	for _, r := range results {
+		rendered = append(rendered, r...)
+	}
+	return rendered, nil
 }
 
-func (t *templateServiceImpl) run(ctx context.Context, viewDirPath string, templateFilePath string) error {
+func (t *templateServiceImpl) run(ctx context.Context, viewDirPath string, templateFilePath string) ([]Rendered, error) {
 	queries, err := t.queryResolver.Resolve(ctx, templateFilePath)
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
 	var dataset string
@@ -58,7 +73,7 @@ func (t *templateServiceImpl) run(ctx context.Context, viewDirPath string, templ
 		paths := strings.Split(templateFilePath, "/")
 		pathLength := len(paths)
 		if pathLength < 2 {
-			return errors.New("Not valid template. template path must be `foo/<dataset_name>/<template_name>.sql`")
+			return nil, errors.New("Not valid template. template path must be `foo/<dataset_name>/<template_name>.sql`")
 		}
 
 		zap.L().Debug("pick dataset", zap.Strings("paths", paths), zap.Int("pathLength", pathLength))
@@ -66,27 +81,29 @@ func (t *templateServiceImpl) run(ctx context.Context, viewDirPath string, templ
 		zap.L().Debug("pick dataset", zap.String("dataset", dataset))
 	}
 
+	rendered := make([]Rendered, 0, len(queries))
 	for _, query := range queries {
-		err := t.save(ctx, viewDirPath, dataset, query)
+		filename, err := t.save(ctx, viewDirPath, dataset, query)
 		if err != nil {
-			return errors.WithStack(err)
+			return nil, errors.WithStack(err)
 		}
+		rendered = append(rendered, Rendered{DataSet: dataset, Name: query.Name, Query: query.Query, Path: filename})
 	}
 
-	return nil
+	return rendered, nil
 }
 
-func (t *templateServiceImpl) save(ctx context.Context, viewDirPath string, dataset string, query resolver.Query) error {
+func (t *templateServiceImpl) save(ctx context.Context, viewDirPath string, dataset string, query resolver.Query) (string, error) {
 	outDir := fmt.Sprintf("%s/%s", viewDirPath, dataset)
 
 	if _, err := os.Stat(outDir); err != nil {
 		if os.IsNotExist(err) {
 			err := os.Mkdir(outDir, 0777)
 			if err != nil {
-				return errors.WithStack(err)
+				return "", errors.WithStack(err)
 			}
 		} else {
-			return errors.WithStack(err)
+			return "", errors.WithStack(err)
 		}
 	}
 
@@ -94,5 +111,5 @@ func (t *templateServiceImpl) save(ctx context.Context, viewDirPath string, data
 
 	zap.L().Debug("Output", zap.String("filename", filename))
 	err := ioutil.WriteFile(filename, []byte(query.Query), 0644)
-	return errors.WithStack(err)
+	return filename, errors.WithStack(err)
 }
@@ -0,0 +1,218 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"gopkg.in/yaml.v2"
+)
+
+// maxOffendingRows is the number of rows shown in the failure message of an Assertion.
+const maxOffendingRows = 10
+
+// Assertion is a check of the rows of a view. Exactly one of the checks is set.
+//
+//   - row_count: 5
+//   - rows: [{id: 1}, {id: 2}]
+//     order_by: [id]      # Compare in this order. Rows are compared in any order without order_by.
+//   - unique: [id]        # The combination of the columns is unique.
+//   - not_null: [id, name]
+//   - accepted_values: {column: status, values: [active, closed]}
+//   - name: no_negative_amount
+//     sql: SELECT * FROM BQV_TESTING_TABLE WHERE amount < 0   # Must return no rows.
+type Assertion struct {
+	// Name is the name of the assertion in reports. It is derived from the check unless specified.
+	Name           string                   `yaml:"name"`
+	RowCount       *int                     `yaml:"row_count"`
+	Rows           []map[string]interface{} `yaml:"rows"`
+	OrderBy        []string                 `yaml:"order_by"`
+	Unique         []string                 `yaml:"unique"`
+	NotNull        []string                 `yaml:"not_null"`
+	AcceptedValues *AcceptedValues          `yaml:"accepted_values"`
+	SQL            string                   `yaml:"sql"`
+}
+
+type AcceptedValues struct {
+	Column string   `yaml:"column"`
+	Values []string `yaml:"values"`
+}
+
+// ParseAssertions parses a YAML list of Assertion.
+func ParseAssertions(b []byte) ([]Assertion, error) {
+	var assertions []Assertion
+	if err := yaml.UnmarshalStrict(b, &assertions); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for i, a := range assertions {
+		if n := a.checks(); n != 1 {
+			return nil, errors.Errorf("Assertion %d has %d checks, want 1", i+1, n)
+		}
+		if a.AcceptedValues != nil && a.AcceptedValues.Column == "" {
+			return nil, errors.Errorf("Assertion %d: accepted_values needs column", i+1)
+		}
+		if a.AcceptedValues != nil && len(a.AcceptedValues.Values) == 0 {
+			return nil, errors.Errorf("Assertion %d: accepted_values needs values", i+1)
+		}
+		if a.OrderBy != nil && a.Rows == nil {
+			return nil, errors.Errorf("Assertion %d: order_by is only for rows", i+1)
+		}
+	}
+	return assertions, nil
+}
+
+func (a Assertion) checks() int {
+	n := 0
+	for _, set := range []bool{a.RowCount != nil, a.Rows != nil, a.Unique != nil, a.NotNull != nil, a.AcceptedValues != nil, a.SQL != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func (a Assertion) String() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	switch {
+	case a.RowCount != nil:
+		return fmt.Sprintf("row_count(%d)", *a.RowCount)
+	case a.Rows != nil:
+		return "rows"
+	case a.Unique != nil:
+		return "unique(" + strings.Join(a.Unique, ", ") + ")"
+	case a.NotNull != nil:
+		return "not_null(" + strings.Join(a.NotNull, ", ") + ")"
+	case a.AcceptedValues != nil:
+		return "accepted_values(" + a.AcceptedValues.Column + ")"
+	default:
+		return "sql"
+	}
+}
+
+// AssertResult is the result of an Assertion.
+type AssertResult struct {
+	JobID string
+	// Failure is why the assertion failed with the offending rows. It is empty when the assertion passed.
+	Failure string
+}
+
+func (t *testServiceImpl) Assert(ctx context.Context, viewQuery string, a Assertion) (AssertResult, error) {
+	check, describe := t.assertQuery(a)
+	query := t.testQuery(viewQuery, check)
+
+	rows, jobID, err := t.queryService.Read(ctx, query)
+	if err != nil {
+		return AssertResult{JobID: jobID}, errors.WithStack(err)
+	}
+	actual := canonicalRows(rows)
+
+	result := AssertResult{JobID: jobID}
+	switch {
+	case a.Rows != nil:
+		result.Failure = compareExpectedRows(a, actual)
+	case a.RowCount != nil && len(rows) != 0:
+		result.Failure = fmt.Sprintf("%s %v", describe, rows[0]["row_count"])
+	case len(actual) != 0:
+		lines := []string{describe}
+		for i, row := range actual {
+			if i == maxOffendingRows {
+				lines = append(lines, "...")
+				break
+			}
+			lines = append(lines, row)
+		}
+		result.Failure = strings.Join(lines, "\n")
+	}
+	return result, nil
+}
+
+// assertQuery returns the query of a against the view and the failure message.
+// Except for rows, the query returns the offending rows, and the assertion passes when it returns no rows.
+func (t *testServiceImpl) assertQuery(a Assertion) (string, string) {
+	table := t.targetViewName
+	limit := fmt.Sprintf("LIMIT %d", maxOffendingRows+1)
+
+	switch {
+	case a.RowCount != nil:
+		return fmt.Sprintf("SELECT COUNT(*) AS row_count FROM %s HAVING COUNT(*) != %d", table, *a.RowCount),
+			fmt.Sprintf("want %d rows, got", *a.RowCount)
+	case a.Rows != nil:
+		query := "SELECT * FROM " + table
+		if len(a.OrderBy) != 0 {
+			query += " ORDER BY " + columnList(a.OrderBy)
+		}
+		return query, ""
+	case a.Unique != nil:
+		columns := columnList(a.Unique)
+		return fmt.Sprintf("SELECT %s, COUNT(*) AS count FROM %s GROUP BY %s HAVING COUNT(*) > 1 %s", columns, table, columns, limit),
+			"duplicated values of " + strings.Join(a.Unique, ", ") + ":"
+	case a.NotNull != nil:
+		conditions := make([]string, 0, len(a.NotNull))
+		for _, c := range a.NotNull {
+			conditions = append(conditions, quoteColumn(c)+" IS NULL")
+		}
+		return fmt.Sprintf("SELECT * FROM %s WHERE %s %s", table, strings.Join(conditions, " OR "), limit),
+			"rows with null in " + strings.Join(a.NotNull, ", ") + ":"
+	case a.AcceptedValues != nil:
+		column := quoteColumn(a.AcceptedValues.Column)
+		values := make([]string, 0, len(a.AcceptedValues.Values))
+		for _, v := range a.AcceptedValues.Values {
+			values = append(values, quoteString(v))
+		}
+		return fmt.Sprintf("SELECT %s, COUNT(*) AS count FROM %s WHERE %s IS NOT NULL AND CAST(%s AS STRING) NOT IN (%s) GROUP BY %s %s",
+				column, table, column, column, strings.Join(values, ", "), column, limit),
+			"values of " + a.AcceptedValues.Column + " not in " + strings.Join(a.AcceptedValues.Values, ", ") + ":"
+	default:
+		sql := strings.TrimRight(strings.TrimSpace(a.SQL), ";")
+		return fmt.Sprintf("SELECT * FROM (\n%s\n) %s", sql, limit), "rows returned by sql:"
+	}
+}
+
+func compareExpectedRows(a Assertion, actual []string) string {
+	expect := make([]string, 0, len(a.Rows))
+	for _, row := range a.Rows {
+		// Nested values such as STRUCT are decoded from YAML as map[interface{}]interface{}.
+		expect = append(expect, canonicalRow(viewmanager.NormalizeMetadata(row)))
+	}
+
+	if len(a.OrderBy) == 0 {
+		return compareRows(expect, actual).Failure()
+	}
+
+	lines := []string{}
+	for i := 0; i < len(expect) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			lines = append(lines, fmt.Sprintf("row %d: want %s, got nothing", i+1, expect[i]))
+		case i >= len(expect):
+			lines = append(lines, fmt.Sprintf("row %d: want nothing, got %s", i+1, actual[i]))
+		case expect[i] != actual[i]:
+			lines = append(lines, fmt.Sprintf("row %d: want %s, got %s", i+1, expect[i], actual[i]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func columnList(columns []string) string {
+	quoted := make([]string, 0, len(columns))
+	for _, c := range columns {
+		quoted = append(quoted, quoteColumn(c))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteColumn(column string) string {
+	return "`" + strings.Trim(column, "`") + "`"
+}
+
+// stringEscaper escapes the characters that cannot be written as they are in BigQuery string literals quoted by '.
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`)
+
+// quoteString returns s as a BigQuery string literal.
+func quoteString(s string) string {
+	return "'" + stringEscaper.Replace(s) + "'"
+}
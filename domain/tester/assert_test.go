@@ -0,0 +1,107 @@
+package tester_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/tester"
+)
+
+func TestParseAssertions(t *testing.T) {
+	assertions, err := tester.ParseAssertions([]byte(`
+- row_count: 2
+- unique: [id]
+- accepted_values: {column: status, values: [active, 1]}
+- name: no_negative
+  sql: SELECT * FROM BQV_TESTING_TABLE WHERE amount < 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range assertions {
+		names = append(names, a.String())
+	}
+	if diff := cmp.Diff([]string{"row_count(2)", "unique(id)", "accepted_values(status)", "no_negative"}, names); diff != "" {
+		t.Error(diff)
+	}
+
+	if _, err := tester.ParseAssertions([]byte("- {row_count: 2, unique: [id]}")); err == nil {
+		t.Error("want error for an assertion with two checks")
+	}
+	if _, err := tester.ParseAssertions([]byte("- accepted_values: {column: status, values: []}")); err == nil {
+		t.Error("want error for accepted_values without values")
+	}
+}
+
+func TestAssert(t *testing.T) {
+	ctx := context.Background()
+	viewQuery := "SELECT 1 AS id"
+
+	for _, tc := range []struct {
+		name      string
+		assertion string
+		rows      []map[string]bigquery.Value
+		query     string
+		failure   string
+	}{
+		{
+			name:      "row count",
+			assertion: "- row_count: 2",
+			rows:      []map[string]bigquery.Value{{"row_count": int64(1)}},
+			query:     "SELECT COUNT(*) AS row_count FROM bqv_testing_table HAVING COUNT(*) != 2",
+			failure:   "want 2 rows, got 1",
+		},
+		{
+			name:      "unique",
+			assertion: "- unique: [id]",
+			rows:      []map[string]bigquery.Value{{"id": int64(1), "count": int64(2)}},
+			query:     "SELECT `id`, COUNT(*) AS count FROM bqv_testing_table GROUP BY `id` HAVING COUNT(*) > 1 LIMIT 11",
+			failure:   "duplicated values of id:\n{\"count\":\"2\",\"id\":\"1\"}",
+		},
+		{
+			name:      "not null passes",
+			assertion: "- not_null: [id, name]",
+			query:     "SELECT * FROM bqv_testing_table WHERE `id` IS NULL OR `name` IS NULL LIMIT 11",
+		},
+		{
+			name:      "accepted values",
+			assertion: `- accepted_values: {column: status, values: ["it's", 'a\b']}`,
+			query:     "SELECT `status`, COUNT(*) AS count FROM bqv_testing_table WHERE `status` IS NOT NULL AND CAST(`status` AS STRING) NOT IN ('it\\'s', 'a\\\\b') GROUP BY `status` LIMIT 11",
+		},
+		{
+			name:      "unordered rows",
+			assertion: "- rows: [{id: 1}, {id: 2}]",
+			rows:      []map[string]bigquery.Value{{"id": int64(2)}, {"id": int64(1)}},
+			query:     "SELECT * FROM bqv_testing_table",
+		},
+		{
+			name:      "ordered rows",
+			assertion: "- rows: [{id: 1}, {id: 2}]\n  order_by: [id]",
+			rows:      []map[string]bigquery.Value{{"id": int64(2)}, {"id": int64(1)}},
+			query:     "SELECT * FROM bqv_testing_table ORDER BY `id`",
+			failure:   "row 1: want {\"id\":\"1\"}, got {\"id\":\"2\"}\nrow 2: want {\"id\":\"2\"}, got {\"id\":\"1\"}",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assertions, err := tester.ParseAssertions([]byte(tc.assertion))
+			if err != nil {
+				t.Fatal(err)
+			}
+			qs := &fakeQueryService{rows: tc.rows}
+			r, err := tester.NewTestService(qs).Assert(ctx, viewQuery, assertions[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.failure, r.Failure); diff != "" {
+				t.Error(diff)
+			}
+			if len(qs.queries) != 1 || !strings.HasSuffix(strings.TrimSpace(qs.queries[0]), tc.query) {
+				t.Errorf("unexpected query %v", qs.queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package tester
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Case is a test written in a `/*[bqv:TEST] ... */` block of a view file.
+//
+//	/*[bqv:TEST]
+//	- test_count
+//	  - mock:
+//	    - table: project.dataset.table
+//	      sql: |
+//	        SELECT 1 AS id
+//	  - target: |
+//	    SELECT id FROM dataset.view
+//	  - expect: |
+//	    [{"id": "1"}]
+//	*/
+//
+// Target is run against the view, whose references to the mock tables are replaced with the mock queries.
+// Expect is a JSON array of the rows that Target returns, in any order.
+type Case struct {
+	Name   string
+	Mocks  []Mock
+	Target string
+	Expect string
+}
+
+// Mock replaces Table with the result of SQL while testing.
+type Mock struct {
+	Table string `yaml:"table"`
+	SQL   string `yaml:"sql"`
+}
+
+var (
+	testBlock   = regexp.MustCompile(`(?s)/\*\[bqv:TEST\](.*?)\*/`)
+	caseHeader  = regexp.MustCompile(`^-\s+(\S+)\s*$`)
+	caseSection = regexp.MustCompile(`^\s+-\s+(mock|target|expect):[ \t]*(.*)$`)
+)
+
+// ParseCases returns the test cases in `/*[bqv:TEST] ... */` blocks of query.
+func ParseCases(query string) ([]Case, error) {
+	cases := []Case{}
+	for _, m := range testBlock.FindAllStringSubmatch(query, -1) {
+		cs, err := parseBlock(m[1])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cases = append(cases, cs...)
+	}
+	return cases, nil
+}
+
+// parseBlock parses a test block. The block looks like YAML, but the contents of the sections are not indented
+// deeper than their keys, so it is parsed line by line.
+func parseBlock(block string) ([]Case, error) {
+	type section struct {
+		key   string
+		lines []string
+	}
+	type rawCase struct {
+		name     string
+		sections []*section
+	}
+
+	var raws []*rawCase
+	var current *section
+	for i, line := range dedent(strings.Split(block, "\n")) {
+		if m := caseHeader.FindStringSubmatch(line); m != nil {
+			raws = append(raws, &rawCase{name: m[1]})
+			current = nil
+			continue
+		}
+		if m := caseSection.FindStringSubmatch(line); m != nil && len(raws) != 0 {
+			current = &section{key: m[1]}
+			if inline := strings.TrimSpace(m[2]); inline != "" && inline != "|" {
+				current.lines = append(current.lines, inline)
+			}
+			raw := raws[len(raws)-1]
+			raw.sections = append(raw.sections, current)
+			continue
+		}
+		if current == nil {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			return nil, errors.Errorf("Unexpected line %d in test block: %s", i+1, line)
+		}
+		current.lines = append(current.lines, line)
+	}
+
+	cases := make([]Case, 0, len(raws))
+	for _, raw := range raws {
+		c := Case{Name: raw.name}
+		for _, s := range raw.sections {
+			text := strings.Join(dedent(s.lines), "\n")
+			switch s.key {
+			case "mock":
+				var mocks []Mock
+				if err := yaml.Unmarshal([]byte(text), &mocks); err != nil {
+					return nil, errors.WithMessagef(err, "Invalid mock in test %s", c.Name)
+				}
+				c.Mocks = append(c.Mocks, mocks...)
+			case "target":
+				c.Target = strings.TrimSpace(text)
+			case "expect":
+				c.Expect = strings.TrimSpace(text)
+			}
+		}
+		if c.Target == "" || c.Expect == "" {
+			return nil, errors.Errorf("Test %s needs target and expect", c.Name)
+		}
+		cases = append(cases, c)
+	}
+	return cases, nil
+}
+
+// dedent removes the common leading whitespace of non-blank lines and trailing blank lines.
+func dedent(lines []string) []string {
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if len(line) >= indent && indent > 0 {
+			line = line[indent:]
+		} else if strings.TrimSpace(line) == "" {
+			line = ""
+		}
+		out = append(out, line)
+	}
+	for len(out) != 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
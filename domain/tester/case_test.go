@@ -0,0 +1,129 @@
+package tester_test
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/query"
+	"github.com/rerost/bqv/domain/tester"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+type fakeQueryService struct {
+	query.QueryService
+	rows    []map[string]bigquery.Value
+	queries []string
+}
+
+func (f *fakeQueryService) Read(ctx context.Context, query string) ([]map[string]bigquery.Value, string, error) {
+	f.queries = append(f.queries, query)
+	return f.rows, "job", nil
+}
+
+type testView struct {
+	query string
+}
+
+func (v testView) DataSet() string                  { return "dataset" }
+func (v testView) Name() string                     { return "view" }
+func (v testView) Query() string                    { return v.query }
+func (v testView) Setting() viewmanager.Setting     { return v }
+func (v testView) Metadata() map[string]interface{} { return nil }
+
+func TestParseCases(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/answer_counts.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases, err := tester.ParseCases(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 1 {
+		t.Fatalf("want 1 case, got %d", len(cases))
+	}
+	c := cases[0]
+	if c.Name != "test_count" {
+		t.Errorf("name: %s", c.Name)
+	}
+	want := []tester.Mock{{
+		Table: "bigquery-public-data.stackoverflow.posts_answers",
+		SQL:   "SELECT owner_user_id\nFROM UNNEST([1,2,3,4,5]) AS owner_user_id",
+	}}
+	if diff := cmp.Diff(want, c.Mocks); diff != "" {
+		t.Error(diff)
+	}
+	if c.Target != "SELECT owner_user_id\nFROM dataset.answer_counts\nGROUP BY owner_user_id" {
+		t.Errorf("target: %q", c.Target)
+	}
+	if !strings.HasPrefix(c.Expect, "[\n  {") {
+		t.Errorf("expect: %q", c.Expect)
+	}
+}
+
+func TestRunCase(t *testing.T) {
+	ctx := context.Background()
+	qs := &fakeQueryService{rows: []map[string]bigquery.Value{
+		{"owner_user_id": int64(1)},
+		{"owner_user_id": int64(1)},
+		{"owner_user_id": int64(3)},
+	}}
+	view := testView{query: "SELECT id AS owner_user_id FROM `bigquery-public-data.stackoverflow.posts_answers`"}
+	c := tester.Case{
+		Name:   "test",
+		Mocks:  []tester.Mock{{Table: "bigquery-public-data.stackoverflow.posts_answers", SQL: "SELECT 1 AS id"}},
+		Target: "SELECT owner_user_id FROM dataset.view",
+		Expect: `[{"owner_user_id": "1"}, {"owner_user_id": 1}, {"owner_user_id": "2"}]`,
+	}
+
+	r, err := tester.NewTestService(qs).RunCase(ctx, view, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tester.CaseResult{
+		JobID:      "job",
+		Missing:    []string{`{"owner_user_id":"2"}`},
+		Unexpected: []string{`{"owner_user_id":"3"}`},
+	}
+	if diff := cmp.Diff(want, r); diff != "" {
+		t.Error(diff)
+	}
+
+	wantQuery := "CREATE TEMP TABLE posts_answers AS (\nSELECT 1 AS id\n);\n\n" +
+		"CREATE TEMP TABLE bqv_testing_table AS (\nSELECT id AS owner_user_id FROM posts_answers\n);\n\n" +
+		"SELECT owner_user_id FROM bqv_testing_table"
+	if diff := cmp.Diff([]string{wantQuery}, qs.queries); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRunCaseMockProject(t *testing.T) {
+	ctx := context.Background()
+	qs := &fakeQueryService{}
+	view := testView{query: "SELECT * FROM sales.orders JOIN `project.sales.customers` USING (id) JOIN other.sales.customers USING (id)"}
+	c := tester.Case{
+		Name: "test",
+		Mocks: []tester.Mock{
+			{Table: "project.sales.orders", SQL: "SELECT 1 AS id"},
+			{Table: "sales.customers", SQL: "SELECT 1 AS id"},
+		},
+		Target: "SELECT * FROM dataset.view",
+		Expect: `[]`,
+	}
+
+	if _, err := tester.NewTestService(qs, tester.WithProject("project")).RunCase(ctx, view, c); err != nil {
+		t.Fatal(err)
+	}
+	wantQuery := "CREATE TEMP TABLE orders AS (\nSELECT 1 AS id\n);\n\n" +
+		"CREATE TEMP TABLE customers AS (\nSELECT 1 AS id\n);\n\n" +
+		"CREATE TEMP TABLE bqv_testing_table AS (\nSELECT * FROM orders JOIN customers USING (id) JOIN other.sales.customers USING (id)\n);\n\n" +
+		"SELECT * FROM bqv_testing_table"
+	if diff := cmp.Diff([]string{wantQuery}, qs.queries); diff != "" {
+		t.Error(diff)
+	}
+}
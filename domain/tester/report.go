@@ -0,0 +1,208 @@
+package tester
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result is the result of a test.
+type Result struct {
+	// View is the view that the test belongs to, e.g. `dataset.view` or a view file.
+	View     string
+	Name     string
+	Duration time.Duration
+	JobID    string
+	// Failure is why the test failed. It is empty when the test passed.
+	Failure string
+}
+
+func (r Result) Passed() bool {
+	return r.Failure == ""
+}
+
+// Report is the results of a test run.
+type Report struct {
+	Timestamp time.Time
+	Results   []Result
+}
+
+func (r Report) Failures() int {
+	n := 0
+	for _, result := range r.Results {
+		if !result.Passed() {
+			n++
+		}
+	}
+	return n
+}
+
+func (r Report) Duration() time.Duration {
+	var d time.Duration
+	for _, result := range r.Results {
+		d += result.Duration
+	}
+	return d
+}
+
+type jsonReport struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Tests     int          `json:"tests"`
+	Failures  int          `json:"failures"`
+	Duration  float64      `json:"duration_seconds"`
+	Results   []jsonResult `json:"results"`
+}
+
+type jsonResult struct {
+	View     string  `json:"view"`
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	Duration float64 `json:"duration_seconds"`
+	JobID    string  `json:"job_id,omitempty"`
+	Failure  string  `json:"failure,omitempty"`
+}
+
+// WriteJSON writes r as JSON.
+func (r Report) WriteJSON(w io.Writer) error {
+	out := jsonReport{
+		Timestamp: r.Timestamp,
+		Tests:     len(r.Results),
+		Failures:  r.Failures(),
+		Duration:  r.Duration().Seconds(),
+		Results:   make([]jsonResult, 0, len(r.Results)),
+	}
+	for _, result := range r.Results {
+		out.Results = append(out.Results, jsonResult{
+			View:     result.View,
+			Name:     result.Name,
+			Passed:   result.Passed(),
+			Duration: result.Duration.Seconds(),
+			JobID:    result.JobID,
+			Failure:  result.Failure,
+		})
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return errors.WithStack(e.Encode(out))
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes r as JUnit XML. Each view is a test suite, and the job ID of a test is in its system-out.
+func (r Report) WriteJUnit(w io.Writer) error {
+	out := junitTestSuites{
+		Tests:    len(r.Results),
+		Failures: r.Failures(),
+		Time:     r.Duration().Seconds(),
+	}
+
+	suites := map[string]int{}
+	for _, result := range r.Results {
+		i, ok := suites[result.View]
+		if !ok {
+			i = len(out.Suites)
+			suites[result.View] = i
+			out.Suites = append(out.Suites, junitTestSuite{
+				Name:      result.View,
+				Timestamp: r.Timestamp.UTC().Format("2006-01-02T15:04:05"),
+			})
+		}
+
+		c := junitTestCase{
+			Name:      result.Name,
+			ClassName: result.View,
+			Time:      result.Duration.Seconds(),
+		}
+		if result.JobID != "" {
+			c.SystemOut = "job_id: " + result.JobID
+		}
+		suite := &out.Suites[i]
+		if !result.Passed() {
+			c.Failure = &junitFailure{Message: firstLine(result.Failure), Text: result.Failure}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Time += c.Time
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.WithStack(err)
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(out); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := io.WriteString(w, "\n")
+	return errors.WithStack(err)
+}
+
+// Save writes r as JUnit XML to junitPath and as JSON to jsonPath. Empty paths are skipped.
+func (r Report) Save(junitPath string, jsonPath string) error {
+	for _, out := range []struct {
+		path  string
+		write func(io.Writer) error
+	}{
+		{junitPath, r.WriteJUnit},
+		{jsonPath, r.WriteJSON},
+	} {
+		if out.path == "" {
+			continue
+		}
+		f, err := os.Create(out.path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := out.write(f); err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+		if err := f.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	for i, c := range s {
+		if c == '\n' {
+			return s[:i]
+		}
+	}
+	return s
+}
@@ -0,0 +1,42 @@
+package tester_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/tester"
+)
+
+func TestReportWriteJUnit(t *testing.T) {
+	report := tester.Report{
+		Timestamp: time.Date(2019, 11, 1, 9, 0, 0, 0, time.UTC),
+		Results: []tester.Result{
+			{View: "dataset.view", Name: "test_count", Duration: 1500 * time.Millisecond, JobID: "job_1"},
+			{View: "dataset.view", Name: "test_sum", Duration: time.Second, JobID: "job_2", Failure: "1 missing rows, 0 unexpected rows\n- {\"sum\":\"3\"}"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites tests="2" failures="1" time="2.5">
+  <testsuite name="dataset.view" tests="2" failures="1" time="2.5" timestamp="2019-11-01T09:00:00">
+    <testcase name="test_count" classname="dataset.view" time="1.5">
+      <system-out>job_id: job_1</system-out>
+    </testcase>
+    <testcase name="test_sum" classname="dataset.view" time="1">
+      <failure message="1 missing rows, 0 unexpected rows">1 missing rows, 0 unexpected rows&#xA;- {&#34;sum&#34;:&#34;3&#34;}</failure>
+      <system-out>job_id: job_2</system-out>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,185 @@
+package tester
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/sqlref"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+// CaseResult is the result of a Case. Rows are JSON objects whose values are strings (or null).
+type CaseResult struct {
+	JobID string
+	// Missing are the expected rows that the target did not return.
+	Missing []string
+	// Unexpected are the rows that the target returned but were not expected.
+	Unexpected []string
+}
+
+func (r CaseResult) Passed() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// Failure returns the rows expected but missing with `-` and the unexpected rows with `+`.
+// It is empty when r passed.
+func (r CaseResult) Failure() string {
+	if r.Passed() {
+		return ""
+	}
+	lines := make([]string, 0, len(r.Missing)+len(r.Unexpected)+1)
+	lines = append(lines, fmt.Sprintf("%d missing rows, %d unexpected rows", len(r.Missing), len(r.Unexpected)))
+	for _, row := range r.Missing {
+		lines = append(lines, "- "+row)
+	}
+	for _, row := range r.Unexpected {
+		lines = append(lines, "+ "+row)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (t *testServiceImpl) RunCase(ctx context.Context, view viewmanager.View, c Case) (CaseResult, error) {
+	expect, err := expectedRows(c.Expect)
+	if err != nil {
+		return CaseResult{}, errors.WithMessagef(err, "Invalid expect in test %s", c.Name)
+	}
+
+	rows, jobID, err := t.queryService.Read(ctx, t.caseQuery(view, c))
+	if err != nil {
+		return CaseResult{JobID: jobID}, errors.WithStack(err)
+	}
+	actual := canonicalRows(rows)
+
+	result := compareRows(expect, actual)
+	result.JobID = jobID
+	return result, nil
+}
+
+// caseQuery returns a script that creates a temporary table for each mock and for the view, and then runs the target.
+// A mock table is named after the table it replaces, so that qualified column names such as `orders.id` keep working.
+// Mocks and references are matched as `project.dataset.table`, where the project is t.project unless written.
+func (t *testServiceImpl) caseQuery(view viewmanager.View, c Case) string {
+	var sb strings.Builder
+
+	mocks := map[string]string{}
+	used := map[string]bool{t.tmpTableName: true}
+	for _, m := range c.Mocks {
+		parts := strings.Split(strings.Trim(m.Table, "`"), ".")
+		name := parts[len(parts)-1]
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s_%d", parts[len(parts)-1], i)
+		}
+		used[name] = true
+		if len(parts) == 2 {
+			parts = append([]string{t.project}, parts...)
+		}
+		mocks[strings.Join(parts, ".")] = name
+
+		fmt.Fprintf(&sb, "CREATE TEMP TABLE %s AS (\n%s\n);\n\n", name, strings.TrimSpace(m.SQL))
+	}
+
+	replace := func(ref sqlref.Reference) (string, bool) {
+		if ref.DataSet == view.DataSet() && ref.Name == view.Name() {
+			return t.tmpTableName, true
+		}
+		project := ref.Project
+		if project == "" {
+			project = t.project
+		}
+		name, ok := mocks[project+"."+ref.ID()]
+		return name, ok
+	}
+
+	fmt.Fprintf(&sb, "CREATE TEMP TABLE %s AS (\n%s\n);\n\n", t.tmpTableName, strings.TrimSpace(sqlref.ReplaceReference(view.Query(), replace)))
+	sb.WriteString(sqlref.ReplaceReference(c.Target, replace))
+	return sb.String()
+}
+
+func expectedRows(expect string) ([]string, error) {
+	d := json.NewDecoder(strings.NewReader(expect))
+	d.UseNumber()
+	var rows []map[string]interface{}
+	if err := d.Decode(&rows); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	canonical := make([]string, 0, len(rows))
+	for _, row := range rows {
+		canonical = append(canonical, canonicalRow(row))
+	}
+	return canonical, nil
+}
+
+func canonicalRows(rows []map[string]bigquery.Value) []string {
+	canonical := make([]string, 0, len(rows))
+	for _, row := range rows {
+		values := make(map[string]interface{}, len(row))
+		for k, v := range row {
+			values[k] = v
+		}
+		canonical = append(canonical, canonicalRow(values))
+	}
+	return canonical
+}
+
+// canonicalRow returns row as JSON with sorted keys and values converted to strings,
+// so that the expected `"1"` or `1` equals INT64 1.
+func canonicalRow(row map[string]interface{}) string {
+	values := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		values[k] = canonicalValue(v)
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []bigquery.Value, map[string]bigquery.Value, []interface{}, map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// compareRows compares rows as multisets.
+func compareRows(expect []string, actual []string) CaseResult {
+	counts := map[string]int{}
+	for _, row := range actual {
+		counts[row]++
+	}
+
+	result := CaseResult{}
+	for _, row := range expect {
+		if counts[row] == 0 {
+			result.Missing = append(result.Missing, row)
+			continue
+		}
+		counts[row]--
+	}
+	for _, row := range actual {
+		if counts[row] > 0 {
+			result.Unexpected = append(result.Unexpected, row)
+			counts[row]--
+		}
+	}
+	return result
+}
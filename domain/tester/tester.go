@@ -8,6 +8,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rerost/bqv/domain/query"
+	"github.com/rerost/bqv/domain/viewmanager"
 )
 
 var (
@@ -15,27 +16,47 @@ var (
 )
 
 type TestService interface {
-	Test(ctx context.Context, viewQuery string, assertQuery string) error
+	// Test runs assertQuery against the result of viewQuery and returns the job ID. The test fails when the query fails.
+	Test(ctx context.Context, viewQuery string, assertQuery string) (string, error)
+	// Assert checks the rows of viewQuery with a.
+	Assert(ctx context.Context, viewQuery string, a Assertion) (AssertResult, error)
+	// RunCase runs a test case written in view.
+	RunCase(ctx context.Context, view viewmanager.View, c Case) (CaseResult, error)
+}
+
+type Option func(*testServiceImpl)
+
+// WithProject sets the project that references without a project refer to, so that a mock of `dataset.table`
+// replaces `project.dataset.table` as well, and the other way around.
+func WithProject(project string) Option {
+	return func(t *testServiceImpl) {
+		t.project = project
+	}
 }
 
 type testServiceImpl struct {
 	queryService query.QueryService
+	project      string
 
 	targetViewName string
 	tmpTableName   string
 }
 
-func NewTestService(queryService query.QueryService) TestService {
-	return &testServiceImpl{
+func NewTestService(queryService query.QueryService, opts ...Option) TestService {
+	t := &testServiceImpl{
 		queryService:   queryService,
 		targetViewName: "BQV_TESTING_TABLE",
 		tmpTableName:   "bqv_testing_table",
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
-func (t *testServiceImpl) Test(ctx context.Context, viewQuery string, assertQuery string) error {
-	err := t.queryService.Exec(ctx, t.testQuery(viewQuery, assertQuery))
-	return err
+func (t *testServiceImpl) Test(ctx context.Context, viewQuery string, assertQuery string) (string, error) {
+	jobID, err := t.queryService.Exec(ctx, t.testQuery(viewQuery, assertQuery))
+	return jobID, err
 }
 
 func (t *testServiceImpl) testQuery(viewQuery string, assertQuery string) string {
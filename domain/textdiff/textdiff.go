@@ -0,0 +1,147 @@
+package textdiff
+
+import (
+	"strings"
+)
+
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// Hunk is a group of changed lines with surrounding context, as in unified diff.
+// FromLine and ToLine are 1-origin. They are 0 when the corresponding side has no line.
+type Hunk struct {
+	FromLine  int
+	FromCount int
+	ToLine    int
+	ToCount   int
+	Lines     []Line
+}
+
+// Lines returns the line-based diff from a to b.
+func Lines(a, b string) []Line {
+	as, bs := splitLines(a), splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of as[i:] and bs[j:].
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := make([]Line, 0, len(as)+len(bs))
+	i, j := 0, 0
+	for i < len(as) && j < len(bs) {
+		switch {
+		case as[i] == bs[j]:
+			lines = append(lines, Line{Op: Equal, Text: as[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, Line{Op: Delete, Text: as[i]})
+			i++
+		default:
+			lines = append(lines, Line{Op: Insert, Text: bs[j]})
+			j++
+		}
+	}
+	for ; i < len(as); i++ {
+		lines = append(lines, Line{Op: Delete, Text: as[i]})
+	}
+	for ; j < len(bs); j++ {
+		lines = append(lines, Line{Op: Insert, Text: bs[j]})
+	}
+
+	return lines
+}
+
+// Hunks returns the diff from a to b grouped into hunks with `context` lines of context.
+// It returns no hunks when a and b are equal.
+func Hunks(a, b string, context int) []Hunk {
+	lines := Lines(a, b)
+
+	// fromLines[i] and toLines[i] are the line numbers of a and b at lines[i].
+	fromLines := make([]int, len(lines)+1)
+	toLines := make([]int, len(lines)+1)
+	fromLine, toLine := 1, 1
+	for i, line := range lines {
+		fromLines[i], toLines[i] = fromLine, toLine
+		if line.Op != Insert {
+			fromLine++
+		}
+		if line.Op != Delete {
+			toLine++
+		}
+	}
+	fromLines[len(lines)], toLines[len(lines)] = fromLine, toLine
+
+	hunks := []Hunk{}
+	for i := 0; i < len(lines); {
+		if lines[i].Op == Equal {
+			i++
+			continue
+		}
+
+		// Extend the hunk while the next change is close enough to share context.
+		last := i
+		for j := i + 1; j < len(lines) && j-last <= 2*context+1; j++ {
+			if lines[j].Op != Equal {
+				last = j
+			}
+		}
+
+		start, end := i-context, last+1+context
+		if start < 0 {
+			start = 0
+		}
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		h := Hunk{
+			FromLine: fromLines[start],
+			ToLine:   toLines[start],
+			Lines:    lines[start:end],
+		}
+		h.FromCount = fromLines[end] - h.FromLine
+		h.ToCount = toLines[end] - h.ToLine
+		// Unified diff uses the line before the hunk for an empty range.
+		if h.FromCount == 0 {
+			h.FromLine--
+		}
+		if h.ToCount == 0 {
+			h.ToLine--
+		}
+		hunks = append(hunks, h)
+
+		i = end
+	}
+
+	return hunks
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,47 @@
+package textdiff_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rerost/bqv/domain/textdiff"
+)
+
+func TestHunks(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	b := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n"
+
+	expected := []textdiff.Hunk{
+		{
+			FromLine: 1, FromCount: 5, ToLine: 1, ToCount: 5,
+			Lines: []textdiff.Line{
+				{Op: textdiff.Equal, Text: "1"},
+				{Op: textdiff.Equal, Text: "2"},
+				{Op: textdiff.Delete, Text: "3"},
+				{Op: textdiff.Insert, Text: "three"},
+				{Op: textdiff.Equal, Text: "4"},
+				{Op: textdiff.Equal, Text: "5"},
+			},
+		},
+		{
+			FromLine: 9, FromCount: 2, ToLine: 9, ToCount: 3,
+			Lines: []textdiff.Line{
+				{Op: textdiff.Equal, Text: "9"},
+				{Op: textdiff.Equal, Text: "10"},
+				{Op: textdiff.Insert, Text: "11"},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, textdiff.Hunks(a, b, 2)); diff != "" {
+		t.Error(diff)
+	}
+
+	if hunks := textdiff.Hunks(a, a, 3); len(hunks) != 0 {
+		t.Errorf("expected no hunks, got %v", hunks)
+	}
+
+	created := textdiff.Hunks("", "SELECT 1\n", 3)
+	if len(created) != 1 || created[0].FromLine != 0 || created[0].FromCount != 0 || created[0].ToLine != 1 || created[0].ToCount != 1 {
+		t.Errorf("unexpected hunks %+v", created)
+	}
+}
@@ -0,0 +1,256 @@
+package viewmanager
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/sqlref"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+)
+
+// authorizations caches the authorized views in the access lists of the datasets that have been read.
+// It is kept up to date by BQManager, and is shared by copies of BQManager.
+// mu is held only while the cache is used, not while BigQuery is requested.
+type authorizations struct {
+	mu sync.Mutex
+	// views are the authorized views of each remote dataset that has been read, keyed by viewKey.
+	views map[string]map[string]bool
+}
+
+func viewKey(remoteDataset, name string) string {
+	return remoteDataset + "." + name
+}
+
+// WithAuthorizingDatasets returns BQManager that also reads the access lists of the local datasets that datasets returns
+// for a view, e.g. FileManager.AuthorizingDatasets, to find the authorizations of the view.
+// Without it, only the access lists of the datasets that the query of the view refers to are read.
+func (b BQManager) WithAuthorizingDatasets(datasets func(ctx context.Context, dataset, name string) ([]string, error)) BQManager {
+	b.authorizingDatasets = datasets
+	return b
+}
+
+// authorizedFor returns the local names of the datasets that authorize the view, sorted.
+// The access lists of the datasets that remoteQuery refers to and of the datasets declared for the view are read.
+func (b BQManager) authorizedFor(ctx context.Context, dataset, name, remoteQuery string) ([]string, error) {
+	key := viewKey(b.datasetMapper.ToRemote(dataset), name)
+	candidates, err := b.candidates(ctx, dataset, name, remoteQuery)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	datasets, err := b.authorizing(ctx, key, candidates)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	res := []string{}
+	for ds := range datasets {
+		if local, ok := b.datasetMapper.ToLocal(ds); ok {
+			ds = local
+		}
+		res = append(res, ds)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// candidates returns the remote datasets that may authorize the view: the datasets in the project that remoteQuery refers to,
+// and the datasets that authorizingDatasets declares.
+func (b BQManager) candidates(ctx context.Context, dataset, name, remoteQuery string) ([]string, error) {
+	res := []string{}
+	for _, ref := range sqlref.Find(remoteQuery) {
+		if ref.Project == "" || ref.Project == b.datasetMapper.Project {
+			res = append(res, ref.DataSet)
+		}
+	}
+	if b.authorizingDatasets == nil {
+		return res, nil
+	}
+	declared, err := b.authorizingDatasets(ctx, dataset, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, ds := range declared {
+		res = append(res, b.datasetMapper.ToRemote(ds))
+	}
+	return res, nil
+}
+
+// authorizing reads the access lists of candidates unless they have been read,
+// and returns the remote datasets that authorize the view of key.
+func (b BQManager) authorizing(ctx context.Context, key string, candidates []string) (map[string]bool, error) {
+	if err := b.readAccess(ctx, candidates); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	a := b.authorizations
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := map[string]bool{}
+	for ds, views := range a.views {
+		if views[key] {
+			res[ds] = true
+		}
+	}
+	return res, nil
+}
+
+// readAccess reads the access lists of remoteDatasets that have not been read.
+// Concurrent calls may read a dataset at once, in which case the first result is kept.
+func (b BQManager) readAccess(ctx context.Context, remoteDatasets []string) error {
+	a := b.authorizations
+	for _, ds := range remoteDatasets {
+		a.mu.Lock()
+		_, ok := a.views[ds]
+		a.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		views, err := b.authorizedViews(ctx, ds)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		a.mu.Lock()
+		if a.views == nil {
+			a.views = map[string]map[string]bool{}
+		}
+		if _, ok := a.views[ds]; !ok {
+			a.views[ds] = views
+		}
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// setAuthorized records in the cache whether remoteDataset authorizes the view of key.
+func (a *authorizations) setAuthorized(remoteDataset, key string, authorized bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.views == nil {
+		a.views = map[string]map[string]bool{}
+	}
+	if a.views[remoteDataset] == nil {
+		a.views[remoteDataset] = map[string]bool{}
+	}
+	if authorized {
+		a.views[remoteDataset][key] = true
+	} else {
+		delete(a.views[remoteDataset], key)
+	}
+}
+
+// authorizedViews returns the authorized views in the project in the access list of remoteDataset, keyed by viewKey.
+func (b BQManager) authorizedViews(ctx context.Context, remoteDataset string) (map[string]bool, error) {
+	ds := b.bqClient.Dataset(remoteDataset)
+	var md *bqiface.DatasetMetadata
+	err := b.retryPolicy.Do(ctx, "datasets.get", func() error {
+		var err error
+		md, err = ds.Metadata(ctx)
+		return err
+	})
+	// A missing dataset authorizes nothing.
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	views := map[string]bool{}
+	for _, e := range md.Access {
+		if e.EntityType == bigquery.ViewEntity && e.View != nil && e.View.ProjectID() == ds.ProjectID() {
+			views[viewKey(e.View.DatasetID(), e.View.TableID())] = true
+		}
+	}
+	return views, nil
+}
+
+// authorize makes the view authorized by exactly datasets, which are local names.
+// The view is removed from the access lists of the other candidates (see candidates), of previous, which are local names,
+// and of the datasets that have been read.
+func (b BQManager) authorize(ctx context.Context, dataset, name, remoteQuery string, datasets []string, previous []string) error {
+	key := viewKey(b.datasetMapper.ToRemote(dataset), name)
+	want := map[string]bool{}
+	for _, ds := range datasets {
+		want[b.datasetMapper.ToRemote(ds)] = true
+	}
+	candidates, err := b.candidates(ctx, dataset, name, remoteQuery)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for ds := range want {
+		candidates = append(candidates, ds)
+	}
+	for _, ds := range previous {
+		candidates = append(candidates, b.datasetMapper.ToRemote(ds))
+	}
+	current, err := b.authorizing(ctx, key, candidates)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for ds := range want {
+		if current[ds] {
+			continue
+		}
+		zap.L().Debug("Authorizing view", zap.String("Dataset", dataset), zap.String("Table", name), zap.String("in", ds))
+		err := b.updateAccess(ctx, ds, dataset, name, true)
+		if err == NotFoundError {
+			return errors.Errorf("dataset %s in authorized_for of %s.%s is not found", ds, dataset, name)
+		}
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to authorize %s.%s in dataset %s", dataset, name, ds)
+		}
+		b.authorizations.setAuthorized(ds, key, true)
+	}
+	for ds := range current {
+		if want[ds] {
+			continue
+		}
+		zap.L().Debug("Removing authorization of view", zap.String("Dataset", dataset), zap.String("Table", name), zap.String("in", ds))
+		if err := b.updateAccess(ctx, ds, dataset, name, false); err != nil && err != NotFoundError {
+			return errors.WithMessagef(err, "Failed to remove the authorization of %s.%s from dataset %s", dataset, name, ds)
+		}
+		b.authorizations.setAuthorized(ds, key, false)
+	}
+	return nil
+}
+
+// updateAccess adds the view to the access list of remoteDataset, or removes it from the list.
+// It returns NotFoundError if remoteDataset does not exist.
+func (b BQManager) updateAccess(ctx context.Context, remoteDataset, dataset, name string, add bool) error {
+	ds := b.bqClient.Dataset(remoteDataset)
+	view := b.bqClient.Dataset(b.datasetMapper.ToRemote(dataset)).Table(name)
+	// The access list is read again on a retry, since other views may be authorized concurrently.
+	err := b.retryPolicy.DoUpdate(ctx, "datasets.update", func() error {
+		md, err := ds.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+
+		access := make([]*bqiface.AccessEntry, 0, len(md.Access)+1)
+		for _, e := range md.Access {
+			if e.EntityType == bigquery.ViewEntity && e.View != nil &&
+				e.View.ProjectID() == view.ProjectID() && e.View.DatasetID() == view.DatasetID() && e.View.TableID() == view.TableID() {
+				continue
+			}
+			access = append(access, e)
+		}
+		if add {
+			access = append(access, &bqiface.AccessEntry{AccessEntry: bigquery.AccessEntry{EntityType: bigquery.ViewEntity}, View: view})
+		}
+
+		_, err = ds.Update(ctx, bqiface.DatasetMetadataToUpdate{Access: access}, md.ETag)
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return NotFoundError
+	}
+	return errors.WithStack(err)
+}
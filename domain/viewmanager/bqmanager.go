@@ -3,22 +3,36 @@ package viewmanager
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"net/http"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
-var (
-	datasetPrefixForTest string
-)
+// DefaultLocation is the location of datasets created by BQManager unless specified.
+const DefaultLocation = "US"
 
 type BQManager struct {
-	bqClient BQClient
+	bqClient      BQClient
+	location      string
+	datasetFilter DatasetFilter
+	viewFilter    ViewFilter
+	datasetMapper DatasetMapper
+	concurrency   int
+	retryPolicy   RetryPolicy
+	restClient    RESTClient
+	// routineDatasets returns the local datasets whose routines List lists. Routines in every dataset are listed if it is nil.
+	routineDatasets func(ctx context.Context) ([]string, error)
+	// authorizingDatasets returns the local datasets whose access lists are read for the view in addition to those its query refers to.
+	authorizingDatasets func(ctx context.Context, dataset, name string) ([]string, error)
+	authorizations      *authorizations
+	// match selects the views that List reads in addition to viewFilter. See ListMatching.
+	match func(dataset, name string) bool
 }
 
 type BQClient interface {
@@ -27,8 +41,54 @@ type BQClient interface {
 
 func NewBQManager(bqClient BQClient) BQManager {
 	return BQManager{
-		bqClient: bqClient,
+		bqClient:       bqClient,
+		location:       DefaultLocation,
+		concurrency:    1,
+		retryPolicy:    DefaultRetryPolicy,
+		authorizations: &authorizations{},
+	}
+}
+
+// WithRetryPolicy returns BQManager that retries requests that fail with transient errors by policy.
+func (b BQManager) WithRetryPolicy(policy RetryPolicy) BQManager {
+	b.retryPolicy = policy
+	return b
+}
+
+// WithConcurrency returns BQManager that fetches the metadata of up to n tables at once in List.
+func (b BQManager) WithConcurrency(n int) BQManager {
+	if n > 0 {
+		b.concurrency = n
+	}
+	return b
+}
+
+// WithDatasetMapper returns BQManager that reads and writes views through mapper.
+// Views returned by BQManager have local dataset names and queries, and views given to BQManager should have them too.
+func (b BQManager) WithDatasetMapper(mapper DatasetMapper) BQManager {
+	b.datasetMapper = mapper
+	return b
+}
+
+// WithLocation returns BQManager that creates missing datasets in location.
+func (b BQManager) WithLocation(location string) BQManager {
+	if location != "" {
+		b.location = location
 	}
+	return b
+}
+
+// WithDatasetFilter returns BQManager that lists views only in datasets matching filter.
+func (b BQManager) WithDatasetFilter(filter DatasetFilter) BQManager {
+	b.datasetFilter = filter
+	return b
+}
+
+// WithViewFilter returns BQManager that lists only views matching filter.
+// Datasets that no view can match are not read, and if filter names datasets without glob patterns, datasets are not listed either.
+func (b BQManager) WithViewFilter(filter ViewFilter) BQManager {
+	b.viewFilter = filter
+	return b
 }
 
 type bqView struct {
@@ -36,6 +96,7 @@ type bqView struct {
 	name    string
 	query   string
 	setting bqSetting
+	etag    string
 }
 
 type bqSetting struct {
@@ -62,9 +123,22 @@ func (b bqView) Setting() Setting {
 	return Setting(b.setting)
 }
 
+func (b bqView) ETag() string {
+	return b.etag
+}
+
 func (b BQManager) List(ctx context.Context) ([]View, error) {
+	routines, err := b.routineDatasetSet(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if datasets, ok := b.viewFilter.Datasets(); ok {
+		return b.listIn(ctx, datasets, routines)
+	}
+
+	tables := []datasetTable{}
 	datasets := b.bqClient.Datasets(ctx)
-	views := []View{}
 	for {
 		dataset, err := datasets.Next()
 		if err == iterator.Done {
@@ -73,40 +147,170 @@ func (b BQManager) List(ctx context.Context) ([]View, error) {
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
+		localDataset, ok := b.datasetMapper.ToLocal(dataset.DatasetID())
+		if !ok || !b.datasetFilter.Match(localDataset) || !b.viewFilter.MatchDataset(localDataset) {
+			continue
+		}
+
+		ts, err := b.listTables(ctx, localDataset, dataset, routines == nil || routines[localDataset])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tables = append(tables, ts...)
+	}
+
+	return b.views(ctx, tables)
+}
+
+// ListMatching lists the views in the local datasets for which match returns true, without reading the others.
+// It is List for a few views out of many, e.g. the views missing from dir.
+func (b BQManager) ListMatching(ctx context.Context, datasets []string, match func(dataset, name string) bool) ([]View, error) {
+	routines, err := b.routineDatasetSet(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	b.match = match
+	return b.listIn(ctx, datasets, routines)
+}
+
+// listIn returns the views in the local datasets, which are skipped if they do not exist.
+// routines is the datasets whose routines are listed, or nil for every dataset.
+func (b BQManager) listIn(ctx context.Context, datasets []string, routines map[string]bool) ([]View, error) {
+	tables := []datasetTable{}
+	for _, dataset := range datasets {
+		if !b.datasetFilter.Match(dataset) || !b.viewFilter.MatchDataset(dataset) {
+			continue
+		}
+		ts, err := b.listTables(ctx, dataset, b.bqClient.Dataset(b.datasetMapper.ToRemote(dataset)), routines == nil || routines[dataset])
+		if e, ok := errors.Cause(err).(*googleapi.Error); ok && e.Code == 404 {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tables = append(tables, ts...)
+	}
+	return b.views(ctx, tables)
+}
+
+// matches returns whether List reads the view.
+func (b BQManager) matches(dataset, name string) bool {
+	return b.viewFilter.Match(dataset, name) && (b.match == nil || b.match(dataset, name))
+}
+
+// datasetTable is a table or a routine with the local name of its dataset.
+type datasetTable struct {
+	localDataset string
+	table        bqiface.Table
+	// routine is the ID of the routine if table is nil.
+	routine string
+}
+
+// listTables returns the tables, and the routines if routines is true, in dataset that List reads (see matches).
+// localDataset is the local name of dataset.
+func (b BQManager) listTables(ctx context.Context, localDataset string, dataset bqiface.Dataset, routines bool) ([]datasetTable, error) {
+	res := []datasetTable{}
+	tables := dataset.Tables(ctx)
+	for {
+		table, err := tables.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if !b.matches(localDataset, table.TableID()) {
+			continue
+		}
+		res = append(res, datasetTable{localDataset: localDataset, table: table})
+	}
+	if !routines {
+		return res, nil
+	}
+
+	rs, err := b.listRoutines(ctx, localDataset)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return append(res, rs...), nil
+}
+
+// views fetches the metadata of tables, up to b.concurrency at once, and returns the views and routines among them in the order of tables.
+func (b BQManager) views(ctx context.Context, tables []datasetTable) ([]View, error) {
+	views := make([]View, len(tables))
+	sem := make(chan struct{}, b.concurrency)
+	eg, ctx := errgroup.WithContext(ctx)
+	for i, t := range tables {
+		i, t := i, t
+		sem <- struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
 
-		tables := dataset.Tables(ctx)
-		for {
-			table, err := tables.Next()
-			if err == iterator.Done {
-				break
+			if t.table == nil {
+				v, err := b.GetRoutine(ctx, t.localDataset, t.routine)
+				// Procedures are not managed.
+				if err == NotFoundError {
+					return nil
+				}
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				views[i] = v
+				return nil
 			}
+
+			var tmd *bigquery.TableMetadata
+			err := b.retryPolicy.Do(ctx, "tables.get", func() error {
+				var err error
+				tmd, err = t.table.Metadata(ctx)
+				return err
+			})
 			if err != nil {
-				return nil, errors.WithStack(err)
+				return errors.WithStack(err)
+			}
+			if !b.isView(tmd) {
+				return nil
 			}
 
-			tmd, err := table.Metadata(ctx)
+			query, metadata, err := b.viewDefinition(ctx, t.localDataset, t.table.TableID(), tmd)
 			if err != nil {
-				return nil, errors.WithStack(err)
+				return errors.WithStack(err)
 			}
-
-			if tmd.Type != bigquery.ViewTable {
-				continue
+			views[i] = bqView{
+				dataSet: t.localDataset,
+				name:    t.table.TableID(),
+				query:   query,
+				setting: bqSetting{
+					metadata: metadata,
+				},
+				etag: tmd.ETag,
 			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-			views = append(views, bqView{
-				dataSet: dataset.DatasetID(),
-				name:    table.TableID(),
-				query:   tmd.ViewQuery,
-			})
+	res := make([]View, 0, len(views))
+	for _, v := range views {
+		if v != nil {
+			res = append(res, v)
 		}
 	}
-
-	return views, nil
+	return res, nil
 }
+
+// Get returns the view. Routines are apart from views in BigQuery, and are returned by GetRoutine.
 func (b BQManager) Get(ctx context.Context, dataset string, name string) (View, error) {
-	ds := b.bqClient.Dataset(dataset)
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(dataset))
 	t := ds.Table(name)
-	tmd, err := t.Metadata(ctx)
+	var tmd *bigquery.TableMetadata
+	err := b.retryPolicy.Do(ctx, "tables.get", func() error {
+		var err error
+		tmd, err = t.Metadata(ctx)
+		return err
+	})
 	if err != nil {
 		zap.L().Debug("Error when get metadata", zap.String("err", err.Error()))
 		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
@@ -115,7 +319,7 @@ func (b BQManager) Get(ctx context.Context, dataset string, name string) (View,
 		return nil, errors.WithStack(err)
 	}
 
-	metadata, err := b.convertTmdToMetadata(tmd)
+	query, metadata, err := b.viewDefinition(ctx, dataset, name, tmd)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -123,56 +327,131 @@ func (b BQManager) Get(ctx context.Context, dataset string, name string) (View,
 	return bqView{
 		dataSet: dataset,
 		name:    name,
-		query:   tmd.ViewQuery,
+		query:   query,
 		setting: bqSetting{
 			metadata: metadata,
 		},
+		etag: tmd.ETag,
 	}, nil
 }
 func (b BQManager) Create(ctx context.Context, view View) (View, error) {
-	fmt.Println(datasetPrefixForTest)
-	ds := b.bqClient.Dataset(datasetPrefixForTest + view.DataSet())
-	_, err := ds.Metadata(ctx)
-	if err != nil {
-		zap.L().Debug("Failed to create dataset", zap.String("err", err.Error()))
-		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
-			err := ds.Create(
-				ctx,
-				&bqiface.DatasetMetadata{DatasetMetadata: bigquery.DatasetMetadata{Location: "US"}})
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(view.DataSet()))
+	if err := b.createDataset(ctx, ds); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if isRoutine(ManagedMetadata(view.Setting())) {
+		if err := b.createRoutine(ctx, view); err != nil {
+			return nil, errors.WithStack(err)
 		}
+		return b.GetRoutine(ctx, view.DataSet(), view.Name())
 	}
 	t := ds.Table(view.Name())
 	tmd, err := b.converToTmd(view)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	descriptions, err := columnDescriptions(view)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-	err = t.Create(
-		ctx,
-		&tmd,
-	)
+	if isMaterialized(ManagedMetadata(view.Setting())) {
+		err = b.createMaterialized(ctx, view, tmd)
+	} else {
+		err = b.retryPolicy.DoInsert(ctx, "tables.insert", func() error {
+			return t.Create(ctx, &tmd)
+		})
+	}
 	if err != nil {
 		zap.L().Debug("Failed to create table", zap.String("Err", err.Error()))
 		return nil, errors.WithStack(err)
 	}
+	if len(descriptions) != 0 {
+		if err := b.describeColumns(ctx, view, descriptions); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if err := b.authorize(ctx, view.DataSet(), view.Name(), b.datasetMapper.QueryToRemote(view.Query()), metadataAuthorizedFor(ManagedMetadata(view.Setting())), nil); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return b.Get(ctx, view.DataSet(), view.Name())
+}
+
+// createDataset creates ds in b.location unless it exists.
+func (b BQManager) createDataset(ctx context.Context, ds bqiface.Dataset) error {
+	err := b.retryPolicy.Do(ctx, "datasets.get", func() error {
+		_, err := ds.Metadata(ctx)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		return errors.WithStack(err)
+	}
 
-	return b.Get(ctx, datasetPrefixForTest+view.DataSet(), view.Name())
+	zap.L().Debug("Creating dataset", zap.String("Dataset", ds.DatasetID()))
+	err = b.retryPolicy.DoInsert(ctx, "datasets.insert", func() error {
+		return ds.Create(ctx, &bqiface.DatasetMetadata{DatasetMetadata: bigquery.DatasetMetadata{Location: b.location}})
+	})
+	// The dataset may have been created by a concurrent Create.
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusConflict {
+		return nil
+	}
+	return errors.WithStack(err)
 }
+
+// Update updates the view in BigQuery to view.
+// If view has an etag (see WithETag), it returns ConflictError unless the view in BigQuery still has the etag.
 func (b BQManager) Update(ctx context.Context, view View) (View, error) {
-	ds := b.bqClient.Dataset(datasetPrefixForTest + view.DataSet())
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(view.DataSet()))
 	t := ds.Table(view.Name())
 	tmd, err := b.converToTmd(view)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	tmdForUpdate, err := b.convertTmdToForUpdate(tmd)
+	etag := ETagOf(view)
+	if isRoutine(ManagedMetadata(view.Setting())) {
+		return b.updateRoutine(ctx, view)
+	}
+	if isMaterialized(ManagedMetadata(view.Setting())) {
+		return b.updateMaterialized(ctx, view)
+	}
+	descriptions, err := columnDescriptions(view)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	_, err = t.Update(ctx, tmdForUpdate, "")
+
+	// The metadata is read again on a retry, since the update is made from it.
+	materialized := false
+	err = b.retryPolicy.Do(ctx, "tables.update", func() error {
+		current, err := t.Metadata(ctx)
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound && etag != "" {
+			return ConflictError{DataSet: view.DataSet(), Name: view.Name()}
+		}
+		if err != nil {
+			zap.L().Debug("Failed to get view", zap.String("err", err.Error()))
+			return err
+		}
+		if etag != "" && current.ETag != etag {
+			return b.conflict(ctx, view)
+		}
+		if current.Type == MaterializedViewTable {
+			materialized = true
+			return nil
+		}
+		tmdForUpdate, err := b.convertTmdToForUpdate(tmd, current)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = t.Update(ctx, tmdForUpdate, etag)
+		// The view was changed between the read and the update.
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed && etag != "" {
+			return b.conflict(ctx, view)
+		}
+		return err
+	})
 	if err != nil {
 		zap.L().Debug("Failed to update view", zap.String("err", err.Error()))
 		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
@@ -180,8 +459,19 @@ func (b BQManager) Update(ctx context.Context, view View) (View, error) {
 		}
 		return nil, errors.WithStack(err)
 	}
+	// A materialized view becomes a logical view.
+	if materialized {
+		return b.updateMaterialized(ctx, view)
+	}
+	// A new query clears the descriptions of columns.
+	if err := b.describeColumns(ctx, view, descriptions); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := b.authorize(ctx, view.DataSet(), view.Name(), b.datasetMapper.QueryToRemote(view.Query()), metadataAuthorizedFor(ManagedMetadata(view.Setting())), nil); err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-	view, err = b.Get(ctx, datasetPrefixForTest+view.DataSet(), view.Name())
+	view, err = b.Get(ctx, view.DataSet(), view.Name())
 	if err != nil {
 		zap.L().Debug("Failed to get view", zap.String("err", err.Error()))
 		if err == NotFoundError {
@@ -193,13 +483,109 @@ func (b BQManager) Update(ctx context.Context, view View) (View, error) {
 
 	return view, nil
 }
+
+// Delete deletes view from BigQuery.
+// If view has an etag (see WithETag), it returns ConflictError unless the view in BigQuery still has the etag.
+// BigQuery cannot delete a table conditionally, so a change just before the deletion may be lost.
+// The view is removed from the access lists of the datasets that authorized it.
 func (b BQManager) Delete(ctx context.Context, view View) error {
-	ds := b.bqClient.Dataset(datasetPrefixForTest + view.DataSet())
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(view.DataSet()))
 	t := ds.Table(view.Name())
-	return errors.WithStack(t.Delete(ctx))
+	routine := isRoutine(ManagedMetadata(view.Setting()))
+	if etag := ETagOf(view); etag != "" {
+		current, err := GetAs(ctx, b, view.DataSet(), view.Name(), routine)
+		if err == NotFoundError {
+			return errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name()})
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ETagOf(current) != etag {
+			return errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name(), Remote: current})
+		}
+	}
+	if routine {
+		return errors.WithStack(b.deleteRoutine(ctx, view.DataSet(), view.Name()))
+	}
+	err := b.retryPolicy.DoDelete(ctx, "tables.delete", func() error {
+		return t.Delete(ctx)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// The datasets in authorized_for of the view, e.g. the remote view listed for --prune, are read as well.
+	return errors.WithStack(b.authorize(ctx, view.DataSet(), view.Name(), b.datasetMapper.QueryToRemote(view.Query()), nil, metadataAuthorizedFor(ManagedMetadata(view.Setting()))))
+}
+
+// recreate replaces current, which is the view in BigQuery, with view by deleting current and creating view.
+// view is dry-run before current is deleted, and current is created again if view cannot be created.
+func (b BQManager) recreate(ctx context.Context, current View, view View) (View, error) {
+	if _, err := b.Validate(ctx, view); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	zap.L().Debug("Recreating view", zap.String("Dataset", view.DataSet()), zap.String("Table", view.Name()))
+	if err := b.Delete(ctx, current); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	created, err := b.Create(ctx, view)
+	if err == nil {
+		return created, nil
+	}
+	zap.L().Debug("Restoring view", zap.String("Dataset", view.DataSet()), zap.String("Table", view.Name()))
+	if _, rerr := b.Create(ctx, current); rerr != nil {
+		return nil, errors.WithMessagef(err, "%s.%s was dropped to create it again, and restoring it failed (%v)", view.DataSet(), view.Name(), rerr)
+	}
+	return nil, errors.WithStack(err)
+}
+
+// conflict returns ConflictError of view with the view in BigQuery now.
+func (b BQManager) conflict(ctx context.Context, view View) error {
+	remote, err := GetAs(ctx, b, view.DataSet(), view.Name(), IsRoutine(view))
+	if err == NotFoundError {
+		remote, err = nil, nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return ConflictError{DataSet: view.DataSet(), Name: view.Name(), Remote: remote}
+}
+
+// Validate dry-runs the query of view, and checks that the columns described in its metadata are in the schema of the query.
+// Routines are not dry-run, and are valid.
+func (b BQManager) Validate(ctx context.Context, view View) (int64, error) {
+	if isRoutine(ManagedMetadata(view.Setting())) {
+		return 0, nil
+	}
+	descriptions, err := columnDescriptions(view)
+	if err != nil {
+		return 0, &QueryError{Message: errors.Cause(err).Error()}
+	}
+	query := b.datasetMapper.QueryToRemote(view.Query())
+	q := b.bqClient.Query(query)
+	q.SetQueryConfig(bqiface.QueryConfig{QueryConfig: bigquery.QueryConfig{Q: query, DryRun: true}})
+	j, err := q.Run(ctx)
+	if err != nil {
+		zap.L().Debug("Dry run failed", zap.String("Dataset", view.DataSet()), zap.String("Table", view.Name()), zap.String("err", err.Error()))
+		// Invalid queries and references to missing tables.
+		if e, ok := err.(*googleapi.Error); ok && (e.Code == 400 || e.Code == 404) {
+			return 0, newQueryError(e.Message)
+		}
+		return 0, errors.WithStack(err)
+	}
+
+	status := j.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return 0, nil
+	}
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && len(descriptions) != 0 {
+		if err := checkColumns(qs.Schema, descriptions); err != nil {
+			return status.Statistics.TotalBytesProcessed, &QueryError{Message: err.Error()}
+		}
+	}
+	return status.Statistics.TotalBytesProcessed, nil
 }
 
-func (b BQManager) convertTmdToMetadata(tmd *bigquery.TableMetadata) (map[string]interface{}, error) {
+func (b BQManager) convertTmdToMetadata(name string, tmd *bigquery.TableMetadata) (map[string]interface{}, error) {
 	out, err := json.Marshal(tmd)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -210,40 +596,66 @@ func (b BQManager) convertTmdToMetadata(tmd *bigquery.TableMetadata) (map[string
 		return nil, errors.WithStack(err)
 	}
 
+	// bqv uses the view name as the friendly name unless specified.
+	if tmd.Name != "" && tmd.Name != name {
+		res["friendly_name"] = tmd.Name
+	}
+	if tmd.Description != "" {
+		res["description"] = tmd.Description
+	}
+	if len(tmd.Labels) != 0 {
+		labels := make(map[string]interface{}, len(tmd.Labels))
+		for k, v := range tmd.Labels {
+			labels[k] = v
+		}
+		res["labels"] = labels
+	}
+	columns := map[string]interface{}{}
+	schemaColumns("", tmd.Schema, columns)
+	if len(columns) != 0 {
+		res["columns"] = columns
+	}
+
 	return res, nil
 }
 
-func (b BQManager) converToTmd(view View) (bigquery.TableMetadata, error) {
-	var description string
-	{
-		d := view.Setting().Metadata()["description"]
-		if d != nil {
-			description = d.(string)
-		}
+// viewDefinition returns the local query and the metadata of the view, including the settings of a materialized view
+// and the datasets that authorize it.
+func (b BQManager) viewDefinition(ctx context.Context, dataset, name string, tmd *bigquery.TableMetadata) (string, map[string]interface{}, error) {
+	metadata, err := b.convertTmdToMetadata(name, tmd)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
 	}
-	var labels map[string]string
-	{
-		l := view.Setting().Metadata()["labels"]
-		var ls map[interface{}]interface{}
-		if l != nil {
-			ls = l.(map[interface{}]interface{})
-		}
-		labels = map[string]string{}
-		for k, v := range ls {
-			if v != nil {
-				labels[fmt.Sprint(k)] = fmt.Sprint(v)
-			}
-		}
+	query, err := b.viewQuery(ctx, dataset, name, tmd, metadata)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	datasets, err := b.authorizedFor(ctx, dataset, name, query)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	if len(datasets) != 0 {
+		metadata["authorized_for"] = stringsToValues(datasets)
+	}
+	return b.datasetMapper.QueryToLocal(query), metadata, nil
+}
+
+func (b BQManager) converToTmd(view View) (bigquery.TableMetadata, error) {
+	metadata := ManagedMetadata(view.Setting())
+	friendlyName := view.Name()
+	if n := metadataFriendlyName(metadata); n != "" {
+		friendlyName = n
 	}
 	return bigquery.TableMetadata{
-		Name:        view.Name(),
-		ViewQuery:   view.Query(),
-		Description: description,
-		Labels:      labels,
+		Name:        friendlyName,
+		ViewQuery:   b.datasetMapper.QueryToRemote(view.Query()),
+		Description: metadataDescription(metadata),
+		Labels:      metadataLabels(metadata),
 	}, nil
 }
 
-func (b BQManager) convertTmdToForUpdate(tmd bigquery.TableMetadata) (bigquery.TableMetadataToUpdate, error) {
+// convertTmdToForUpdate returns the update from current to tmd.
+func (b BQManager) convertTmdToForUpdate(tmd bigquery.TableMetadata, current *bigquery.TableMetadata) (bigquery.TableMetadataToUpdate, error) {
 	tmdForUpdate := bigquery.TableMetadataToUpdate{
 		Name:        tmd.Name,
 		ViewQuery:   tmd.ViewQuery,
@@ -253,5 +665,10 @@ func (b BQManager) convertTmdToForUpdate(tmd bigquery.TableMetadata) (bigquery.T
 	for k, v := range tmd.Labels {
 		tmdForUpdate.SetLabel(k, v)
 	}
+	for k := range current.Labels {
+		if _, ok := tmd.Labels[k]; !ok {
+			tmdForUpdate.DeleteLabel(k)
+		}
+	}
 	return tmdForUpdate, nil
 }
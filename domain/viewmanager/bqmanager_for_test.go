@@ -1,10 +0,0 @@
-package viewmanager
-
-import (
-	"fmt"
-	"time"
-)
-
-func SetTest() {
-	datasetPrefixForTest = fmt.Sprintf("test_%d_", time.Now().Nanosecond())
-}
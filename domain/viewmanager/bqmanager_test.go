@@ -3,17 +3,23 @@ package viewmanager_test
 import (
 	"context"
 	"fmt"
-	"os"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/rerost/bqv/cmd"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
 	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/mocks/bqfake"
+	"google.golang.org/api/googleapi"
 )
 
 type dummyView struct {
-	dataset string
-	name    string
-	query   string
+	dataset  string
+	name     string
+	query    string
+	metadata map[string]interface{}
 }
 
 func (dv dummyView) DataSet() string {
@@ -29,32 +35,520 @@ func (dv dummyView) Query() string {
 }
 
 func (dv dummyView) Setting() viewmanager.Setting {
-	return dummyViewSetting{}
+	return dummyViewSetting{metadata: dv.metadata}
 }
 
 type dummyViewSetting struct {
+	metadata map[string]interface{}
 }
 
 func (dvs dummyViewSetting) Metadata() map[string]interface{} {
-	return map[string]interface{}{}
+	if dvs.metadata == nil {
+		return map[string]interface{}{}
+	}
+	return dvs.metadata
 }
 
 func TestCreate(t *testing.T) {
-	viewmanager.SetTest()
 	ctx := context.Background()
-	fmt.Println(os.Getenv("GOOGLE_APPLICATION_PROJECT_ID"))
-	bqClient, err := cmd.NewBQClient(ctx, cmd.Config{
-		ProjectID: os.Getenv("GOOGLE_APPLICATION_PROJECT_ID"),
-	})
+	bqClient := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(bqClient).WithLocation("EU")
+
+	_, err := bqManager.Create(ctx, dummyView{dataset: "test", name: "test", query: "SELECT 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dmd, err := bqClient.Dataset("test").Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dmd.Location != "EU" {
+		t.Errorf("want dataset in EU, got %s", dmd.Location)
+	}
+
+	v, err := bqManager.Get(ctx, "test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Query() != "SELECT 1" {
+		t.Errorf("query: %s", v.Query())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	bqManager := viewmanager.NewBQManager(bqfake.New("project"))
+
+	view := dummyView{dataset: "test", name: "test", query: "SELECT 1", metadata: map[string]interface{}{
+		"labels": map[string]interface{}{"team": "sales", "env": "dev"},
+	}}
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+
+	view.query = "SELECT 2"
+	view.metadata = map[string]interface{}{
+		"description": "updated",
+		"labels":      map[string]interface{}{"team": "sales"},
+	}
+	v, err := bqManager.Update(ctx, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Query() != "SELECT 2" {
+		t.Errorf("query: %s", v.Query())
+	}
+	if diff := cmp.Diff(view.metadata, viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+		t.Error(diff)
+	}
+
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqManager.Get(ctx, "test", "test"); err != viewmanager.NotFoundError {
+		t.Errorf("want NotFoundError, got %v", err)
+	}
+	if _, err := bqManager.Update(ctx, view); err != viewmanager.NotFoundError {
+		t.Errorf("want NotFoundError, got %v", err)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	ctx := context.Background()
+	bqManager := viewmanager.NewBQManager(bqfake.New("project"))
+
+	view := dummyView{dataset: "test", name: "test", query: "SELECT 1"}
+	read, err := bqManager.Create(ctx, view)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	etag := viewmanager.ETagOf(read)
+	if etag == "" {
+		t.Fatal("views read from BigQuery should have an etag")
+	}
+
+	// Someone else updates the view after it was read.
+	if _, err := bqManager.Update(ctx, dummyView{dataset: "test", name: "test", query: "SELECT 2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	view.query = "SELECT 3"
+	_, err = bqManager.Update(ctx, viewmanager.WithETag(view, etag))
+	cerr, ok := errors.Cause(err).(viewmanager.ConflictError)
+	if !ok {
+		t.Fatalf("want ConflictError, got %v", err)
+	}
+	if cerr.Remote == nil || cerr.Remote.Query() != "SELECT 2" {
+		t.Errorf("want the remote view in the error, got %v", cerr.Remote)
+	}
+	if err := bqManager.Delete(ctx, viewmanager.WithETag(view, etag)); err == nil {
+		t.Error("want ConflictError")
+	} else if _, ok := errors.Cause(err).(viewmanager.ConflictError); !ok {
+		t.Errorf("want ConflictError, got %v", err)
 	}
 
-	bqManager := viewmanager.NewBQManager(bqClient)
-	_, err = bqManager.Create(ctx, dummyView{dataset: "test", name: "test", query: "SELECT 1"})
+	// The view is written with the current etag.
+	if _, err := bqManager.Update(ctx, viewmanager.WithETag(view, viewmanager.ETagOf(cerr.Remote))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqManager.Update(ctx, viewmanager.WithETag(view, etag)); err == nil {
+		t.Error("the old etag should not be accepted")
+	}
+}
+
+func TestAuthorizedViews(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client)
+	if _, err := bqManager.Create(ctx, dummyView{dataset: "shared", name: "source", query: "SELECT 1 AS id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	authorizedViews := func() []string {
+		t.Helper()
+		md, err := client.Dataset("shared").Metadata(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := []string{}
+		for _, e := range md.Access {
+			res = append(res, e.View.DatasetID()+"."+e.View.TableID())
+		}
+		return res
+	}
+
+	view := dummyView{dataset: "report", name: "daily", query: "SELECT id FROM shared.source", metadata: map[string]interface{}{
+		"authorized_for": []interface{}{"shared"},
+	}}
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"report.daily"}, authorizedViews()); diff != "" {
+		t.Errorf("unexpected access (-want +got):\n%s", diff)
+	}
+
+	// The authorization is read from the dataset that the view refers to.
+	v, err := viewmanager.NewBQManager(client).Get(ctx, "report", "daily")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(view.metadata, viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+		t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+	}
+
+	view.metadata = nil
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if got := authorizedViews(); len(got) != 0 {
+		t.Errorf("want the authorization removed, got %v", got)
+	}
+
+	view.metadata = map[string]interface{}{"authorized_for": "shared"}
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if got := authorizedViews(); len(got) != 0 {
+		t.Errorf("want the authorization of the deleted view removed, got %v", got)
+	}
+
+	view.metadata = map[string]interface{}{"authorized_for": []interface{}{"missing"}}
+	if _, err := bqManager.Create(ctx, view); err == nil {
+		t.Error("want an error for a missing dataset")
+	}
+}
+
+func TestMaterializedView(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client).WithRESTClient(client).WithRetryPolicy(viewmanager.NoRetry)
+	if _, err := bqManager.Create(ctx, dummyView{dataset: "sales", name: "orders", query: "SELECT 1 AS id"}); err != nil {
+		t.Fatal(err)
+	}
+
+	view := dummyView{dataset: "report", name: "orders", query: "SELECT id FROM sales.orders", metadata: map[string]interface{}{
+		"type":         "materialized",
+		"materialized": map[string]interface{}{"refresh_interval": "1h", "cluster_by": []interface{}{"id"}, "enable_refresh": true},
+	}}
+	get := func() viewmanager.View {
+		t.Helper()
+		v, err := bqManager.Get(ctx, "report", "orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Query() != view.query {
+			t.Errorf("want query %q, got %q", view.query, v.Query())
+		}
+		if diff := cmp.Diff(viewmanager.ManagedMetadata(view.Setting()), viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+			t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+		}
+		return v
+	}
+
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	if views, err := bqManager.List(ctx); err != nil || len(views) != 2 {
+		t.Errorf("want the materialized view listed, got %v, %v", views, err)
+	}
+	if views, err := viewmanager.NewBQManager(client).List(ctx); err != nil || len(views) != 1 {
+		t.Errorf("want materialized views skipped without the client, got %v, %v", views, err)
+	}
+
+	// Refresh options are updated in place, but a new query needs the view dropped.
+	dropErr := &googleapi.Error{Code: http.StatusBadRequest, Message: "drop"}
+	client.FailNext("tables.delete", dropErr)
+	etag := viewmanager.ETagOf(get())
+	view.metadata = map[string]interface{}{"type": "materialized", "materialized": map[string]interface{}{"enable_refresh": false, "cluster_by": "id"}}
+	if _, err := bqManager.Update(ctx, viewmanager.WithETag(view, etag)); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	view.query = "SELECT id, 1 AS n FROM sales.orders"
+	if _, err := bqManager.Update(ctx, view); errors.Cause(err) != dropErr {
+		t.Errorf("want the view dropped, got %v", err)
+	}
+	// The view is kept if the new one fails a dry run or cannot be created.
+	view.query = "SELECT id FROM sales.missing"
+	if _, err := bqManager.Update(ctx, view); err == nil {
+		t.Error("want an error for a missing table")
+	}
+	view.query = "SELECT id, 2 AS n FROM sales.orders"
+	createErr := &googleapi.Error{Code: http.StatusBadRequest, Message: "create"}
+	client.FailNext("tables.insert", createErr)
+	if _, err := bqManager.Update(ctx, view); errors.Cause(err) != createErr {
+		t.Errorf("want the create error, got %v", err)
+	}
+	view.query = "SELECT id FROM sales.orders"
+	get()
+	view.query = "SELECT id, 1 AS n FROM sales.orders"
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	view.metadata = nil
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	// The type of time partitioning is kept, and changing it needs the view dropped.
+	monthly := dummyView{dataset: "report", name: "monthly", query: "SELECT id, CURRENT_DATE() AS d FROM sales.orders", metadata: map[string]interface{}{
+		"type":         "materialized",
+		"materialized": map[string]interface{}{"partition_by": "d", "partition_type": "month"},
+	}}
+	if _, err := bqManager.Create(ctx, monthly); err != nil {
+		t.Fatal(err)
+	}
+	v, err := bqManager.Get(ctx, monthly.dataset, monthly.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(viewmanager.ManagedMetadata(monthly.Setting()), viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+		t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+	}
+	daily := map[string]interface{}{"type": "materialized", "materialized": map[string]interface{}{"partition_by": "d"}}
+	if !viewmanager.RequiresRecreate(monthly.query, v.Setting().Metadata(), monthly.query, viewmanager.ManagedMetadata(dummyViewSetting{metadata: daily})) {
+		t.Error("a materialized view with another partitioning type should be recreated")
+	}
+
+	if !viewmanager.RequiresRecreate("SELECT 1", nil, "SELECT 1", map[string]interface{}{"type": "materialized"}) {
+		t.Error("a view becoming a materialized view should be recreated")
+	}
+	if viewmanager.RequiresRecreate("SELECT 1", nil, "SELECT 2", nil) {
+		t.Error("a view should be updated in place")
+	}
+}
+
+func TestRoutine(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client).WithRESTClient(client).WithRetryPolicy(viewmanager.NoRetry)
+
+	view := dummyView{dataset: "udf", name: "normalize", query: "LOWER(TRIM(s))", metadata: map[string]interface{}{
+		"type":        "function",
+		"description": "Normalizes names",
+		"labels":      map[string]interface{}{"ignored": "true"},
+		"routine": map[string]interface{}{
+			"arguments": []interface{}{map[string]interface{}{"name": "s", "type": "string"}},
+			"returns":   "string",
+		},
+	}}
+	get := func() viewmanager.View {
+		t.Helper()
+		v, err := bqManager.GetRoutine(ctx, view.dataset, view.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Query() != view.query {
+			t.Errorf("want query %q, got %q", view.query, v.Query())
+		}
+		if diff := cmp.Diff(viewmanager.ManagedMetadata(view.Setting()), viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+			t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+		}
+		return v
+	}
+
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if got := viewmanager.ManagedMetadata(get().Setting())["routine"]; !cmp.Equal(got, map[string]interface{}{
+		"arguments": []interface{}{map[string]interface{}{"name": "s", "type": "STRING"}},
+		"returns":   "STRING",
+	}) {
+		t.Errorf("want normalized types, got %v", got)
+	}
+	if views, err := bqManager.List(ctx); err != nil || len(views) != 1 {
+		t.Errorf("want the routine listed, got %v, %v", views, err)
+	}
+	if views, err := viewmanager.NewBQManager(client).List(ctx); err != nil || len(views) != 0 {
+		t.Errorf("want routines skipped without the client, got %v, %v", views, err)
+	}
+	routineDatasets := func(datasets ...string) func(context.Context) ([]string, error) {
+		return func(context.Context) ([]string, error) { return datasets, nil }
+	}
+	if views, err := bqManager.WithRoutineDatasets(routineDatasets("sales")).List(ctx); err != nil || len(views) != 0 {
+		t.Errorf("want routines listed only in the given datasets, got %v, %v", views, err)
+	}
+	if views, err := bqManager.WithRoutineDatasets(routineDatasets("udf")).List(ctx); err != nil || len(views) != 1 {
+		t.Errorf("want the routine listed, got %v, %v", views, err)
+	}
+
+	etag := viewmanager.ETagOf(get())
+	view.query = "LOWER(s)"
+	if _, err := bqManager.Update(ctx, viewmanager.WithETag(view, etag)); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	_, err := bqManager.Update(ctx, viewmanager.WithETag(view, etag))
+	if _, ok := errors.Cause(err).(viewmanager.ConflictError); !ok {
+		t.Errorf("want ConflictError, got %v", err)
+	}
+
+	// A function that becomes a table-valued function is dropped and created again.
+	view.query = "SELECT s"
+	view.metadata = map[string]interface{}{"type": "table_function", "routine": map[string]interface{}{"arguments": []interface{}{map[string]interface{}{"name": "s", "type": "STRING"}}}}
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	// Routines are apart from tables, and Get does not look them up.
+	if _, err := bqManager.Get(ctx, view.dataset, view.name); err != viewmanager.NotFoundError {
+		t.Errorf("want NotFoundError, got %v", err)
+	}
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if routines, err := client.ListRoutines(ctx, "udf"); err != nil || len(routines) != 0 {
+		t.Errorf("want the routine dropped, got %v, %v", routines, err)
+	}
+
+	view.metadata = map[string]interface{}{"type": "function", "routine": map[string]interface{}{"returns": "STRUCT<a INT64"}}
+	if _, err := bqManager.Create(ctx, view); err == nil {
+		t.Error("want an error for an invalid type")
+	}
+}
+
+func TestTableFunctionReturnTable(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client).WithRESTClient(client).WithRetryPolicy(viewmanager.NoRetry)
+
+	view := dummyView{dataset: "tvf", name: "recent_orders", query: "SELECT id, tags FROM sales.orders LIMIT n", metadata: map[string]interface{}{
+		"type": "table_function",
+		"routine": map[string]interface{}{
+			"arguments": []interface{}{map[string]interface{}{"name": "n", "type": "int64"}},
+			"returns":   "table<id integer, tags array<string>>",
+		},
+	}}
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	r, err := client.GetRoutine(ctx, "tvf", "recent_orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ReturnTableType == nil || len(r.ReturnTableType.Columns) != 2 || r.ReturnTableType.Columns[1].Type.TypeKind != "ARRAY" {
+		t.Errorf("unexpected return table %+v", r.ReturnTableType)
+	}
+	b, err := r.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"returnTableType":{"columns":[{"name":"id","type":{"typeKind":"INT64"}}`) {
+		t.Errorf("returnTableType is not in the request: %s", b)
+	}
+
+	v, err := bqManager.GetRoutine(ctx, "tvf", "recent_orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"arguments": []interface{}{map[string]interface{}{"name": "n", "type": "INT64"}},
+		"returns":   "TABLE<id INT64, tags ARRAY<STRING>>",
+	}
+	if diff := cmp.Diff(want, viewmanager.ManagedMetadata(v.Setting())["routine"]); diff != "" {
+		t.Errorf("unexpected routine (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(viewmanager.ManagedMetadata(view.Setting()), viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+		t.Errorf("want no diff, got (-want +got):\n%s", diff)
+	}
+
+	view.name = "scalar"
+	view.metadata = map[string]interface{}{"type": "function", "routine": map[string]interface{}{"returns": "TABLE<id INT64>"}}
+	if _, err := bqManager.Create(ctx, view); err == nil {
+		t.Error("want an error for a function that returns a table")
+	}
+}
+
+func TestColumnDescriptions(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client).WithRetryPolicy(viewmanager.NoRetry)
+
+	view := dummyView{dataset: "sales", name: "orders", query: "SELECT 1 AS id, 'x' AS status", metadata: map[string]interface{}{
+		"columns": map[string]interface{}{
+			"id":     map[string]interface{}{"description": "Order ID"},
+			"status": map[string]interface{}{"description": ""},
+		},
+	}}
+	get := func() {
+		t.Helper()
+		v, err := bqManager.Get(ctx, view.dataset, view.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(viewmanager.ManagedMetadata(view.Setting()), viewmanager.ManagedMetadata(v.Setting())); diff != "" {
+			t.Errorf("unexpected metadata (-want +got):\n%s", diff)
+		}
+	}
+
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	// Descriptions are kept when the query changes.
+	view.query = "SELECT 2 AS id, 'y' AS status"
+	view.metadata["columns"] = map[string]interface{}{"status": map[string]interface{}{"description": "Order status"}}
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+
+	view.metadata["columns"] = map[string]interface{}{"missing": map[string]interface{}{"description": "Missing"}}
+	// Validate finds the column with a dry run, before the view is written.
+	if _, err := bqManager.Validate(ctx, view); err == nil {
+		t.Error("want a validation error for a column not in the schema")
+	} else if _, ok := errors.Cause(err).(*viewmanager.QueryError); !ok {
+		t.Errorf("want QueryError, got %v", err)
+	}
+	if _, err := bqManager.Update(ctx, view); err == nil {
+		t.Error("want an error for a column not in the schema")
+	}
+	view.metadata["columns"] = map[string]interface{}{"id": map[string]interface{}{"policy_tags": []interface{}{"projects/p/locations/us/taxonomies/1/policyTags/2"}}}
+	if _, err := bqManager.Update(ctx, view); err == nil {
+		t.Error("want an error for policy tags")
+	}
+
+	delete(view.metadata, "columns")
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	get()
+}
+
+func BenchmarkBQManagerList(b *testing.B) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client)
+	for i := 0; i < 50; i++ {
+		view := dummyView{dataset: fmt.Sprintf("dataset%d", i%5), name: fmt.Sprintf("view%d", i), query: "SELECT 1"}
+		if _, err := bqManager.Create(ctx, view); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.SetLatency(time.Millisecond)
+
+	for _, concurrency := range []int{1, 8} {
+		m := bqManager.WithConcurrency(concurrency)
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				views, err := m.List(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(views) != 50 {
+					b.Fatalf("want 50 views, got %d", len(views))
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,126 @@
+package viewmanager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// metadataColumns returns `columns` in md, which are the descriptions of the columns of a view keyed by column name,
+// e.g. `{id: {description: Order ID}}`. Nested columns are named with dots, e.g. `address.city`.
+// Columns without descriptions are dropped.
+func metadataColumns(md map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	columns, _ := md["columns"].(map[string]interface{})
+	for name, v := range columns {
+		c, _ := v.(map[string]interface{})
+		if d, ok := c["description"]; ok && d != nil && fmt.Sprint(d) != "" {
+			res[name] = map[string]interface{}{"description": fmt.Sprint(d)}
+		}
+	}
+	return res
+}
+
+// columnDescriptions returns the descriptions of the columns of view keyed by column name.
+// It returns an error for policy tags, which BigQuery does not support on the columns of views.
+func columnDescriptions(view View) (map[string]string, error) {
+	var md map[string]interface{}
+	if view.Setting() != nil {
+		md = NormalizeMetadata(view.Setting().Metadata())
+	}
+	columns, _ := md["columns"].(map[string]interface{})
+	for name, v := range columns {
+		if c, _ := v.(map[string]interface{}); c["policy_tags"] != nil {
+			return nil, errors.Errorf("%s.%s: columns.%s.policy_tags: BigQuery does not support policy tags on the columns of views; set them on the underlying table", view.DataSet(), view.Name(), name)
+		}
+	}
+
+	res := map[string]string{}
+	for name, v := range metadataColumns(md) {
+		res[name] = v.(map[string]interface{})["description"].(string)
+	}
+	return res, nil
+}
+
+// schemaColumns adds the descriptions of the columns in schema to columns, as metadataColumns.
+func schemaColumns(prefix string, schema bigquery.Schema, columns map[string]interface{}) {
+	for _, f := range schema {
+		if f.Description != "" {
+			columns[prefix+f.Name] = map[string]interface{}{"description": f.Description}
+		}
+		schemaColumns(prefix+f.Name+".", f.Schema, columns)
+	}
+}
+
+// describeSchema returns a copy of schema with descriptions, which clears the descriptions of other columns,
+// and whether any description changes. The columns in descriptions that are in schema are added to found.
+func describeSchema(prefix string, schema bigquery.Schema, descriptions map[string]string, found map[string]bool) (bigquery.Schema, bool) {
+	res := make(bigquery.Schema, len(schema))
+	changed := false
+	for i, f := range schema {
+		fs := *f
+		name := prefix + f.Name
+		fs.Description = descriptions[name]
+		if _, ok := descriptions[name]; ok {
+			found[name] = true
+		}
+		if fs.Description != f.Description {
+			changed = true
+		}
+		if len(f.Schema) != 0 {
+			nested, c := describeSchema(name+".", f.Schema, descriptions, found)
+			fs.Schema = nested
+			changed = changed || c
+		}
+		res[i] = &fs
+	}
+	return res, changed
+}
+
+// checkColumns returns an error if a column in descriptions is not in schema.
+func checkColumns(schema bigquery.Schema, descriptions map[string]string) error {
+	found := map[string]bool{}
+	describeSchema("", schema, descriptions, found)
+	missing := []string{}
+	for name := range descriptions {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return errors.Errorf("columns %s are not in the schema of the view", strings.Join(missing, ", "))
+}
+
+// describeColumns sets the descriptions of the columns of the view in BigQuery to descriptions.
+// BigQuery infers the schema of a view from its query, so it is done after the view is created or its query is updated.
+// Validate checks the columns before anything is written.
+func (b BQManager) describeColumns(ctx context.Context, view View, descriptions map[string]string) error {
+	t := b.bqClient.Dataset(b.datasetMapper.ToRemote(view.DataSet())).Table(view.Name())
+	// The schema is read again on a retry, since the update is made from it.
+	return errors.WithStack(b.retryPolicy.DoUpdate(ctx, "tables.update", func() error {
+		tmd, err := t.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := checkColumns(tmd.Schema, descriptions); err != nil {
+			return errors.WithMessagef(err, "%s.%s", view.DataSet(), view.Name())
+		}
+		schema, changed := describeSchema("", tmd.Schema, descriptions, map[string]bool{})
+		if !changed {
+			return nil
+		}
+
+		zap.L().Debug("Updating column descriptions", zap.String("Dataset", view.DataSet()), zap.String("Table", view.Name()))
+		_, err = t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, tmd.ETag)
+		return err
+	}))
+}
@@ -0,0 +1,210 @@
+package viewmanager
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"gopkg.in/yaml.v2"
+)
+
+// DatasetFileName is the name of the file of dataset settings in the directory of a dataset.
+const DatasetFileName = "_dataset.yml"
+
+// DatasetSetting is the settings of a dataset in DatasetFileName.
+// Description, Labels and DefaultTableExpiration are kept as they are in the file, so omitted ones are cleared.
+// Location is used when the dataset is created; it cannot be changed afterwards.
+type DatasetSetting struct {
+	Name                   string            `yaml:"-" json:"-"`
+	Location               string            `yaml:"location,omitempty" json:"location,omitempty"`
+	Description            string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Labels                 map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	DefaultTableExpiration time.Duration     `yaml:"default_table_expiration,omitempty" json:"default_table_expiration,omitempty"`
+}
+
+type DatasetReader interface {
+	// ListDatasets returns the settings of the datasets. Datasets without settings are not returned.
+	ListDatasets(ctx context.Context) ([]DatasetSetting, error)
+	// GetDataset returns NotFoundError if the dataset or its settings do not exist.
+	GetDataset(ctx context.Context, name string) (DatasetSetting, error)
+}
+
+type DatasetWriter interface {
+	CreateDataset(ctx context.Context, setting DatasetSetting) error
+	// UpdateDataset updates the settings of an existing dataset except its location, which cannot be changed.
+	UpdateDataset(ctx context.Context, setting DatasetSetting) error
+}
+
+type DatasetReadWriter interface {
+	DatasetReader
+	DatasetWriter
+}
+
+// DatasetSettingPath returns the path of the settings of dataset.
+func (f FileManager) DatasetSettingPath(dataset string) string {
+	return path.Join(f.dir, dataset, DatasetFileName)
+}
+
+func (f FileManager) ListDatasets(ctx context.Context) ([]DatasetSetting, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	settings := []DatasetSetting{}
+	for _, file := range files {
+		if !file.IsDir() || !f.datasetFilter.Match(file.Name()) || !f.viewFilter.MatchDataset(file.Name()) {
+			continue
+		}
+		setting, err := f.GetDataset(ctx, file.Name())
+		if err == NotFoundError {
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+func (f FileManager) GetDataset(ctx context.Context, name string) (DatasetSetting, error) {
+	b, err := ioutil.ReadFile(f.DatasetSettingPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return DatasetSetting{}, NotFoundError
+		}
+		return DatasetSetting{}, errors.WithStack(err)
+	}
+
+	var setting DatasetSetting
+	if err := yaml.UnmarshalStrict(b, &setting); err != nil {
+		return DatasetSetting{}, errors.WithMessagef(err, "Failed to parse %s", f.DatasetSettingPath(name))
+	}
+	setting.Name = name
+	return setting, nil
+}
+
+func (f FileManager) CreateDataset(ctx context.Context, setting DatasetSetting) error {
+	if err := os.MkdirAll(path.Join(f.dir, setting.Name), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.UpdateDataset(ctx, setting))
+}
+
+// UpdateDataset writes setting including its location, which is only a record in a file.
+func (f FileManager) UpdateDataset(ctx context.Context, setting DatasetSetting) error {
+	out, err := yaml.Marshal(setting)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(f.DatasetSettingPath(setting.Name), out, 0644))
+}
+
+func (b BQManager) ListDatasets(ctx context.Context) ([]DatasetSetting, error) {
+	settings := []DatasetSetting{}
+	datasets := b.bqClient.Datasets(ctx)
+	for {
+		dataset, err := datasets.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		localDataset, ok := b.datasetMapper.ToLocal(dataset.DatasetID())
+		if !ok || !b.datasetFilter.Match(localDataset) || !b.viewFilter.MatchDataset(localDataset) {
+			continue
+		}
+
+		setting, err := b.GetDataset(ctx, localDataset)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		settings = append(settings, setting)
+	}
+	return settings, nil
+}
+
+func (b BQManager) GetDataset(ctx context.Context, name string) (DatasetSetting, error) {
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(name))
+	var md *bqiface.DatasetMetadata
+	err := b.retryPolicy.Do(ctx, "datasets.get", func() error {
+		var err error
+		md, err = ds.Metadata(ctx)
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return DatasetSetting{}, NotFoundError
+	}
+	if err != nil {
+		return DatasetSetting{}, errors.WithStack(err)
+	}
+
+	setting := DatasetSetting{
+		Name:                   name,
+		Location:               md.Location,
+		Description:            md.Description,
+		DefaultTableExpiration: md.DefaultTableExpiration,
+	}
+	if len(md.Labels) != 0 {
+		setting.Labels = md.Labels
+	}
+	return setting, nil
+}
+
+// CreateDataset creates a dataset with setting. The dataset is created in the location of BQManager unless setting has one.
+func (b BQManager) CreateDataset(ctx context.Context, setting DatasetSetting) error {
+	location := setting.Location
+	if location == "" {
+		location = b.location
+	}
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(setting.Name))
+	zap.L().Debug("Creating dataset", zap.String("Dataset", setting.Name), zap.String("Location", location))
+	return errors.WithStack(b.retryPolicy.DoInsert(ctx, "datasets.insert", func() error {
+		return ds.Create(ctx, &bqiface.DatasetMetadata{DatasetMetadata: bigquery.DatasetMetadata{
+			Location:               location,
+			Description:            setting.Description,
+			Labels:                 setting.Labels,
+			DefaultTableExpiration: setting.DefaultTableExpiration,
+		}})
+	}))
+}
+
+func (b BQManager) UpdateDataset(ctx context.Context, setting DatasetSetting) error {
+	ds := b.bqClient.Dataset(b.datasetMapper.ToRemote(setting.Name))
+	// The metadata is read again on a retry, since the update is made from it.
+	err := b.retryPolicy.DoUpdate(ctx, "datasets.update", func() error {
+		current, err := ds.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+
+		var dm bqiface.DatasetMetadataToUpdate
+		dm.Description = setting.Description
+		dm.DefaultTableExpiration = setting.DefaultTableExpiration
+		for k, v := range setting.Labels {
+			dm.SetLabel(k, v)
+		}
+		for k := range current.Labels {
+			if _, ok := setting.Labels[k]; !ok {
+				dm.DeleteLabel(k)
+			}
+		}
+		_, err = ds.Update(ctx, dm, current.ETag)
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return NotFoundError
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,45 @@
+package viewmanager
+
+import (
+	"fmt"
+)
+
+// Versioned is implemented by views that know their version in BigQuery, such as views read by BQManager.
+type Versioned interface {
+	// ETag is the etag of the view in BigQuery when it was read.
+	ETag() string
+}
+
+// ConflictError is returned when a view was changed in BigQuery after it was read, e.g. by another apply after diff.
+// Remote is the view in BigQuery now. It is nil if the view was deleted.
+type ConflictError struct {
+	DataSet string
+	Name    string
+	Remote  View
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("%s.%s was changed in BigQuery since it was read", e.DataSet, e.Name)
+}
+
+// ETagOf returns the etag of view, or "" if view is not Versioned.
+func ETagOf(view View) string {
+	if v, ok := view.(Versioned); ok {
+		return v.ETag()
+	}
+	return ""
+}
+
+// WithETag returns view with etag. BQManager writes it only if the view in BigQuery still has etag. An empty etag writes unconditionally.
+func WithETag(view View, etag string) View {
+	return versionedView{View: view, etag: etag}
+}
+
+type versionedView struct {
+	View
+	etag string
+}
+
+func (v versionedView) ETag() string {
+	return v.etag
+}
@@ -13,7 +13,10 @@ import (
 )
 
 type FileManager struct {
-	dir string
+	dir           string
+	datasetFilter DatasetFilter
+	viewFilter    ViewFilter
+	vars          map[string]string
 }
 
 type fileView struct {
@@ -51,6 +54,25 @@ func NewFileManager(dir string) FileManager {
 	return FileManager{dir: dir}
 }
 
+// WithDatasetFilter returns FileManager that lists views only in datasets matching filter.
+func (f FileManager) WithDatasetFilter(filter DatasetFilter) FileManager {
+	f.datasetFilter = filter
+	return f
+}
+
+// WithViewFilter returns FileManager that lists only views matching filter.
+func (f FileManager) WithViewFilter(filter ViewFilter) FileManager {
+	f.viewFilter = filter
+	return f
+}
+
+// WithVars returns FileManager that renders .sql files as text/template with vars, e.g. `{{ .project }}`.
+// `{{ env "NAME" }}` expands an environment variable.
+func (f FileManager) WithVars(vars map[string]string) FileManager {
+	f.vars = vars
+	return f
+}
+
 func (f FileManager) List(ctx context.Context) ([]View, error) {
 	zap.L().Debug("Open file", zap.String("dir", f.dir))
 	dir := f.dir
@@ -66,42 +88,43 @@ func (f FileManager) List(ctx context.Context) ([]View, error) {
 		}
 
 		dataSet := file.Name()
+		if !f.datasetFilter.Match(dataSet) || !f.viewFilter.MatchDataset(dataSet) {
+			continue
+		}
 		files, err := ioutil.ReadDir(path.Join(dir, file.Name()))
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		for _, file := range files {
+			if file.IsDir() && file.Name() == RoutinesDir {
+				routines, err := f.listRoutines(dataSet)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+				views = append(views, routines...)
+				continue
+			}
 			if file.IsDir() {
 				zap.L().Info("Unexpected dir found", zap.String("dir name", file.Name()))
 				continue
 			}
 
+			if file.Name() == DatasetFileName {
+				continue
+			}
 			if !strings.HasSuffix(file.Name(), ".sql") {
 				zap.L().Info("Not sql file found", zap.String("file name", file.Name()))
 				continue
 			}
 
 			name := strings.TrimSuffix(file.Name(), ".sql")
-			inCompleteFileView := fileView{dataSet: dataSet, name: name}
-
-			bquery, err := ioutil.ReadFile(f.Path(inCompleteFileView))
+			if !f.viewFilter.Match(dataSet, name) {
+				continue
+			}
+			v, err := f.read(dataSet, name)
 			if err != nil {
 				return nil, errors.WithStack(err)
 			}
-
-			setting := fileSetting{}
-			sSetting, err := ioutil.ReadFile(f.SettingPath(inCompleteFileView))
-			if err == nil {
-				if err := yaml.Unmarshal(sSetting, &setting); err != nil {
-					return nil, errors.WithMessagef(err, "Failed to parse %s", f.SettingPath(inCompleteFileView))
-				}
-			}
-			v := fileView{
-				dataSet: dataSet,
-				name:    name,
-				query:   string(bquery),
-				setting: setting,
-			}
 			views = append(views, v)
 		}
 	}
@@ -109,6 +132,64 @@ func (f FileManager) List(ctx context.Context) ([]View, error) {
 	return views, nil
 }
 
+// listRoutines returns the routines in RoutinesDir of dataset.
+func (f FileManager) listRoutines(dataset string) ([]View, error) {
+	files, err := ioutil.ReadDir(path.Join(f.dir, dataset, RoutinesDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	views := []View{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".sql")
+		if !f.viewFilter.Match(dataset, name) {
+			continue
+		}
+		v, err := f.read(dataset, name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// RoutineDatasets returns the datasets that have routines, for BQManager.WithRoutineDatasets. It returns none if the dir does not exist.
+func (f FileManager) RoutineDatasets(ctx context.Context) ([]string, error) {
+	views, err := f.List(ctx)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	res := []string{}
+	seen := map[string]bool{}
+	for _, v := range views {
+		if IsRoutine(v) && !seen[v.DataSet()] {
+			seen[v.DataSet()] = true
+			res = append(res, v.DataSet())
+		}
+	}
+	return res, nil
+}
+
+// AuthorizingDatasets returns the datasets in authorized_for of the view, for BQManager.WithAuthorizingDatasets.
+// It returns none if the view does not exist.
+func (f FileManager) AuthorizingDatasets(ctx context.Context, dataset string, name string) ([]string, error) {
+	v, err := f.Get(ctx, dataset, name)
+	if err == NotFoundError {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return metadataAuthorizedFor(ManagedMetadata(v.Setting())), nil
+}
+
 func (f FileManager) Get(ctx context.Context, dataset string, name string) (View, error) {
 	if _, err := os.Stat(f.Path(fileView{dataSet: dataset, name: name})); err != nil {
 		if os.IsNotExist(err) {
@@ -116,27 +197,52 @@ func (f FileManager) Get(ctx context.Context, dataset string, name string) (View
 		}
 		return nil, err
 	}
-	bquery, err := ioutil.ReadFile(f.Path(fileView{dataSet: dataset, name: name}))
+	v, err := f.read(dataset, name)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	return v, nil
+}
+
+func (f FileManager) read(dataset string, name string) (fileView, error) {
+	inCompleteFileView := fileView{dataSet: dataset, name: name}
+
+	bquery, err := ioutil.ReadFile(f.Path(inCompleteFileView))
+	if err != nil {
+		return fileView{}, errors.WithStack(err)
+	}
+	query, err := renderQuery(f.Path(inCompleteFileView), string(bquery), f.vars)
+	if err != nil {
+		return fileView{}, errors.WithMessagef(err, "Failed to render %s", f.Path(inCompleteFileView))
+	}
+
+	setting := fileSetting{}
+	sSetting, err := ioutil.ReadFile(f.SettingPath(inCompleteFileView))
+	if err == nil {
+		if err := yaml.Unmarshal(sSetting, &setting); err != nil {
+			return fileView{}, errors.WithMessagef(err, "Failed to parse %s", f.SettingPath(inCompleteFileView))
+		}
+	}
+	// Routines in RoutinesDir are functions unless specified.
+	if path.Base(path.Dir(f.Path(inCompleteFileView))) == RoutinesDir {
+		if setting.Metadata_ == nil {
+			setting.Metadata_ = map[string]interface{}{}
+		}
+		if _, ok := setting.Metadata_["type"]; !ok {
+			setting.Metadata_["type"] = FunctionType
+		}
+	}
 
 	return fileView{
 		dataSet: dataset,
 		name:    name,
-		query:   string(bquery),
+		query:   query,
+		setting: setting,
 	}, nil
 }
 func (f FileManager) Create(ctx context.Context, view View) (View, error) {
-	if _, err := os.Stat(f.DatasetPath(view)); err != nil {
-		if os.IsNotExist(err) {
-			err := os.Mkdir(f.DatasetPath(view), 0755)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-		} else {
-			return nil, err
-		}
+	if err := os.MkdirAll(path.Dir(f.Path(view)), 0755); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
 	// Create sql file.
@@ -175,26 +281,32 @@ func (f FileManager) Create(ctx context.Context, view View) (View, error) {
 }
 
 func (f FileManager) Update(ctx context.Context, view View) (View, error) {
-	if _, err := os.Stat(f.Path(view)); err != nil {
+	raw, err := ioutil.ReadFile(f.Path(view))
+	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, NotFoundError
 		}
 		return nil, err
 	}
+	// Keep the variables of the existing file so that the file does not change with the environment.
+	query, ok := unrenderQuery(f.Path(view), string(raw), view.Query(), f.vars)
+	if !ok {
+		zap.L().Warn("Template variables are replaced with their values", zap.String("file", f.Path(view)))
+	}
 	{
-		file, err := os.OpenFile(f.Path(view), os.O_WRONLY, 0222)
+		file, err := os.OpenFile(f.Path(view), os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 		defer file.Close()
 
-		_, err = file.WriteString(view.Query())
+		_, err = file.WriteString(query)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
 	}
 	{
-		file, err := os.OpenFile(f.SettingPath(view), os.O_WRONLY, 0222)
+		file, err := os.OpenFile(f.SettingPath(view), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -218,14 +330,37 @@ func (f FileManager) Delete(ctx context.Context, view View) error {
 		return errors.WithStack(err)
 	}
 
-	if err := os.Remove(f.SettingPath(view)); err != nil {
+	if err := os.Remove(f.SettingPath(view)); err != nil && !os.IsNotExist(err) {
 		return errors.WithStack(err)
 	}
 	return nil
 }
 
+// Path returns the path of the .sql file of view. New routines are in RoutinesDir.
 func (f FileManager) Path(view View) string {
-	return path.Join(f.dir, view.DataSet(), view.Name()+".sql")
+	p := f.QueryPath(view.DataSet(), view.Name())
+	if isRoutine(ManagedMetadata(view.Setting())) && !exists(p) {
+		return f.routinePath(view.DataSet(), view.Name())
+	}
+	return p
+}
+
+// QueryPath returns the path of the .sql file of the view, which is in RoutinesDir if the view is a routine there.
+func (f FileManager) QueryPath(dataset string, name string) string {
+	p := path.Join(f.dir, dataset, name+".sql")
+	if r := f.routinePath(dataset, name); !exists(p) && exists(r) {
+		return r
+	}
+	return p
+}
+
+func (f FileManager) routinePath(dataset string, name string) string {
+	return path.Join(f.dir, dataset, RoutinesDir, name+".sql")
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
 }
 
 func (f FileManager) DatasetPath(view View) string {
@@ -233,7 +368,7 @@ func (f FileManager) DatasetPath(view View) string {
 }
 
 func (f FileManager) SettingPath(view View) string {
-	return path.Join(f.dir, view.DataSet(), view.Name()+".yml")
+	return strings.TrimSuffix(f.Path(view), ".sql") + ".yml"
 }
 
 func (f FileManager) convertToFileView(view View) fileView {
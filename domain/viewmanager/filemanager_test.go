@@ -0,0 +1,83 @@
+package viewmanager_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+type testView struct {
+	dataset string
+	name    string
+	query   string
+}
+
+func (v testView) DataSet() string                  { return v.dataset }
+func (v testView) Name() string                     { return v.name }
+func (v testView) Query() string                    { return v.query }
+func (v testView) Setting() viewmanager.Setting     { return v }
+func (v testView) Metadata() map[string]interface{} { return nil }
+
+func TestFileManagerVars(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "bqv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := "SELECT * FROM `{{ .project }}.sales.orders` WHERE date >= '{{ .cutoff }}'"
+	if err := os.Mkdir(filepath.Join(dir, "sales"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sales", "recent.sql"), []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := viewmanager.NewFileManager(dir).WithVars(map[string]string{"project": "proj", "cutoff": "2019-01-01"})
+
+	v, err := fm.Get(ctx, "sales", "recent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered := "SELECT * FROM `proj.sales.orders` WHERE date >= '2019-01-01'"
+	if v.Query() != rendered {
+		t.Errorf("want %s, got %s", rendered, v.Query())
+	}
+
+	// Dump writes back the variables the file refers to.
+	changed := "SELECT id FROM `proj.sales.orders` WHERE date >= '2019-01-01'"
+	if _, err := fm.Update(ctx, testView{dataset: "sales", name: "recent", query: changed}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sales", "recent.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT id FROM `{{ .project }}.sales.orders` WHERE date >= '{{ .cutoff }}'"
+	if string(b) != want {
+		t.Errorf("want %s, got %s", want, string(b))
+	}
+
+	// Values that the template did not render are kept as they are.
+	changed = "SELECT id, 'proj' AS project, DATE '2019-01-01' AS since FROM `proj.sales.orders` WHERE date >= '2019-01-01'"
+	if _, err := fm.Update(ctx, testView{dataset: "sales", name: "recent", query: changed}); err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(filepath.Join(dir, "sales", "recent.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "SELECT id, 'proj' AS project, DATE '2019-01-01' AS since FROM `{{ .project }}.sales.orders` WHERE date >= '{{ .cutoff }}'"
+	if string(b) != want {
+		t.Errorf("want %s, got %s", want, string(b))
+	}
+
+	if _, err := viewmanager.NewFileManager(dir).Get(ctx, "sales", "recent"); err == nil {
+		t.Error("want error for an undefined variable")
+	}
+}
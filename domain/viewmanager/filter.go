@@ -0,0 +1,112 @@
+package viewmanager
+
+import (
+	"path"
+	"strings"
+)
+
+// DatasetFilter selects datasets by glob patterns in path.Match syntax.
+// All datasets match when Include is empty.
+type DatasetFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f DatasetFilter) Match(dataset string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, dataset); ok {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, dataset); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewFilter selects views by glob patterns of `<dataset>.<name>` in path.Match syntax.
+// A pattern without a dot selects a whole dataset, i.e. `sales` is the same as `sales.*`.
+// All views match when Include is empty.
+type ViewFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func (f ViewFilter) Match(dataset string, name string) bool {
+	for _, pattern := range f.Exclude {
+		if matchView(pattern, dataset, name) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if matchView(pattern, dataset, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDataset returns false if no view in dataset can match, so that the dataset need not be read.
+func (f ViewFilter) MatchDataset(dataset string) bool {
+	for _, pattern := range f.Exclude {
+		ds, name := splitPattern(pattern)
+		if ok, _ := path.Match(ds, dataset); ok && name == "*" {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		ds, _ := splitPattern(pattern)
+		if ok, _ := path.Match(ds, dataset); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Datasets returns the datasets that Include selects if all of them are written without glob characters.
+// It returns false if the datasets cannot be known without listing them.
+func (f ViewFilter) Datasets() ([]string, bool) {
+	if len(f.Include) == 0 {
+		return nil, false
+	}
+	datasets := []string{}
+	seen := map[string]bool{}
+	for _, pattern := range f.Include {
+		ds, _ := splitPattern(pattern)
+		if strings.ContainsAny(ds, `*?[\`) {
+			return nil, false
+		}
+		if !seen[ds] {
+			seen[ds] = true
+			datasets = append(datasets, ds)
+		}
+	}
+	return datasets, true
+}
+
+func matchView(pattern string, dataset string, name string) bool {
+	ds, n := splitPattern(pattern)
+	if ok, _ := path.Match(ds, dataset); !ok {
+		return false
+	}
+	ok, _ := path.Match(n, name)
+	return ok
+}
+
+func splitPattern(pattern string) (string, string) {
+	if i := strings.Index(pattern, "."); i >= 0 {
+		return pattern[:i], pattern[i+1:]
+	}
+	return pattern, "*"
+}
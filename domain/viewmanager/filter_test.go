@@ -0,0 +1,114 @@
+package viewmanager_test
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/mocks/bqfake"
+)
+
+func TestViewFilter(t *testing.T) {
+	f := viewmanager.ViewFilter{
+		Include: []string{"sales", "report.daily_*"},
+		Exclude: []string{"sales.tmp_*", "report.daily_old"},
+	}
+
+	cases := []struct {
+		dataset string
+		name    string
+		want    bool
+	}{
+		{"sales", "orders", true},
+		{"sales", "tmp_orders", false},
+		{"report", "daily_sales", true},
+		{"report", "daily_old", false},
+		{"report", "weekly", false},
+		{"sales_dev", "orders", false},
+	}
+	for _, c := range cases {
+		if got := f.Match(c.dataset, c.name); got != c.want {
+			t.Errorf("Match(%s, %s) = %v", c.dataset, c.name, got)
+		}
+	}
+
+	if !f.MatchDataset("report") || f.MatchDataset("tmp") {
+		t.Error("unexpected MatchDataset")
+	}
+	if datasets, ok := f.Datasets(); !ok || !cmp.Equal(datasets, []string{"sales", "report"}) {
+		t.Errorf("Datasets() = %v, %v", datasets, ok)
+	}
+	if _, ok := (viewmanager.ViewFilter{Include: []string{"sales_*"}}).Datasets(); ok {
+		t.Error("glob datasets cannot be known without listing")
+	}
+}
+
+// noListClient fails the test if datasets are listed.
+type noListClient struct {
+	*bqfake.Client
+	t *testing.T
+}
+
+func (c noListClient) Datasets(ctx context.Context) bqiface.DatasetIterator {
+	c.t.Error("datasets are listed")
+	return c.Client.Datasets(ctx)
+}
+
+func (c noListClient) DatasetsInProject(ctx context.Context, project string) bqiface.DatasetIterator {
+	c.t.Error("datasets are listed")
+	return c.Client.DatasetsInProject(ctx, project)
+}
+
+func TestBQManagerListWithViewFilter(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client)
+	for _, v := range []dummyView{
+		{dataset: "sales", name: "orders", query: "SELECT 1"},
+		{dataset: "sales", name: "tmp_orders", query: "SELECT 1"},
+		{dataset: "report", name: "daily", query: "SELECT 1"},
+	} {
+		if _, err := bqManager.Create(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(m viewmanager.BQManager) []string {
+		t.Helper()
+		views, err := m.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, v := range views {
+			ids = append(ids, v.DataSet()+"."+v.Name())
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	filter := viewmanager.ViewFilter{Include: []string{"sales", "missing"}, Exclude: []string{"*.tmp_*"}}
+	mapper := viewmanager.DatasetMapper{Project: "project"}
+	got := list(viewmanager.NewBQManager(noListClient{Client: client, t: t}).WithDatasetMapper(mapper).WithViewFilter(filter))
+	if diff := cmp.Diff([]string{"sales.orders"}, got); diff != "" {
+		t.Errorf("unexpected views (-want +got):\n%s", diff)
+	}
+
+	got = list(bqManager.WithViewFilter(viewmanager.ViewFilter{Include: []string{"*.daily"}}))
+	if diff := cmp.Diff([]string{"report.daily"}, got); diff != "" {
+		t.Errorf("unexpected views (-want +got):\n%s", diff)
+	}
+
+	views, err := viewmanager.NewBQManager(noListClient{Client: client, t: t}).WithDatasetMapper(mapper).ListMatching(ctx, []string{"sales", "missing"}, func(dataset, name string) bool {
+		return name != "orders"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 1 || views[0].Name() != "tmp_orders" {
+		t.Errorf("want only sales.tmp_orders, got %v", views)
+	}
+}
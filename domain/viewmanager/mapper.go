@@ -0,0 +1,85 @@
+package viewmanager
+
+import (
+	"strings"
+
+	"github.com/rerost/bqv/domain/sqlref"
+)
+
+// DatasetMapper maps dataset names in dir (local) to those in BigQuery (remote), e.g. `analytics` to `analytics_dev`.
+// A dataset in Names is mapped to the name given there, and the others are mapped to Prefix + name + Suffix.
+// Project is the BigQuery project, and LocalProject is the project that references in dir refer to, which is Project when empty.
+// References to LocalProject in queries are rewritten to Project, and references to other projects are not rewritten.
+type DatasetMapper struct {
+	Project      string
+	LocalProject string
+	Prefix       string
+	Suffix       string
+	Names        map[string]string
+}
+
+func (m DatasetMapper) identity() bool {
+	return m.Prefix == "" && m.Suffix == "" && len(m.Names) == 0 && m.localProject() == m.Project
+}
+
+func (m DatasetMapper) localProject() string {
+	if m.LocalProject == "" {
+		return m.Project
+	}
+	return m.LocalProject
+}
+
+// ToRemote returns the remote dataset name of a local dataset.
+func (m DatasetMapper) ToRemote(dataset string) string {
+	if name, ok := m.Names[dataset]; ok {
+		return name
+	}
+	return m.Prefix + dataset + m.Suffix
+}
+
+// ToLocal returns the local dataset name of a remote dataset.
+// It returns false if the remote dataset does not belong to this mapping.
+func (m DatasetMapper) ToLocal(dataset string) (string, bool) {
+	for local, remote := range m.Names {
+		if remote == dataset {
+			return local, true
+		}
+	}
+	if !strings.HasPrefix(dataset, m.Prefix) || !strings.HasSuffix(dataset, m.Suffix) || len(dataset) <= len(m.Prefix)+len(m.Suffix) {
+		return "", false
+	}
+	local := strings.TrimSuffix(strings.TrimPrefix(dataset, m.Prefix), m.Suffix)
+	if _, ok := m.Names[local]; ok {
+		// Mapped to another name explicitly.
+		return "", false
+	}
+	return local, true
+}
+
+// QueryToRemote rewrites datasets referenced in query from local to remote.
+// Arrays of aliased tables such as `o.items` in `FROM t o, o.items` are not references, and are kept as they are.
+func (m DatasetMapper) QueryToRemote(query string) string {
+	if m.identity() {
+		return query
+	}
+	return sqlref.Replace(query, func(ref sqlref.Reference) (string, string, bool) {
+		if ref.Project != "" && ref.Project != m.localProject() {
+			return "", "", false
+		}
+		return m.Project, m.ToRemote(ref.DataSet), true
+	})
+}
+
+// QueryToLocal rewrites datasets referenced in query from remote to local.
+func (m DatasetMapper) QueryToLocal(query string) string {
+	if m.identity() {
+		return query
+	}
+	return sqlref.Replace(query, func(ref sqlref.Reference) (string, string, bool) {
+		if ref.Project != "" && ref.Project != m.Project {
+			return "", "", false
+		}
+		dataset, ok := m.ToLocal(ref.DataSet)
+		return m.localProject(), dataset, ok
+	})
+}
@@ -0,0 +1,47 @@
+package viewmanager_test
+
+import (
+	"testing"
+
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+func TestDatasetMapper(t *testing.T) {
+	m := viewmanager.DatasetMapper{
+		Project:      "proj-dev",
+		LocalProject: "proj",
+		Suffix:       "_dev",
+		Names:        map[string]string{"shared": "shared_sandbox"},
+	}
+
+	local := "SELECT udf.normalize(name), SAFE.PARSE_DATE('%F', day) FROM analytics.orders JOIN `proj.shared.users` USING (id)\n" +
+		"JOIN `bigquery-public-data.stackoverflow.posts` USING (id) -- FROM analytics.comment"
+	remote := "SELECT udf_dev.normalize(name), SAFE.PARSE_DATE('%F', day) FROM analytics_dev.orders JOIN `proj-dev.shared_sandbox.users` USING (id)\n" +
+		"JOIN `bigquery-public-data.stackoverflow.posts` USING (id) -- FROM analytics.comment"
+
+	if got := m.QueryToRemote(local); got != remote {
+		t.Errorf("QueryToRemote:\n%s", got)
+	}
+	if got := m.QueryToLocal(remote); got != local {
+		t.Errorf("QueryToLocal:\n%s", got)
+	}
+
+	// Arrays of aliased tables are not tables, whether they are unnested by a comma or a join.
+	local = "SELECT item.sku FROM analytics.orders o, o.items AS item\n" +
+		"CROSS JOIN o.discounts JOIN analytics.skus s ON s.sku = item.sku, s.tags"
+	remote = "SELECT item.sku FROM analytics_dev.orders o, o.items AS item\n" +
+		"CROSS JOIN o.discounts JOIN analytics_dev.skus s ON s.sku = item.sku, s.tags"
+	if got := m.QueryToRemote(local); got != remote {
+		t.Errorf("QueryToRemote:\n%s", got)
+	}
+	if got := m.QueryToLocal(remote); got != local {
+		t.Errorf("QueryToLocal:\n%s", got)
+	}
+
+	if got, ok := m.ToLocal("shared_sandbox"); !ok || got != "shared" {
+		t.Errorf("ToLocal(shared_sandbox) = %s, %v", got, ok)
+	}
+	if _, ok := m.ToLocal("analytics"); ok {
+		t.Error("analytics is not in this environment")
+	}
+}
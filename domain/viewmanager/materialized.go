@@ -0,0 +1,287 @@
+package viewmanager
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/pkg/errors"
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+// MaterializedViewType is the `type` in metadata of materialized views. Views without type are logical views.
+const MaterializedViewType = "materialized"
+
+// MaterializedViewTable is the type of materialized views in bigquery.TableMetadata.
+const MaterializedViewTable bigquery.TableType = "MATERIALIZED_VIEW"
+
+// DefaultRefreshInterval is the refresh interval of materialized views unless specified.
+const DefaultRefreshInterval = 30 * time.Minute
+
+// DefaultPartitionType is the time partitioning type of materialized views unless specified.
+const DefaultPartitionType = "DAY"
+
+// partitionTypes are the time partitioning types of BigQuery.
+var partitionTypes = map[string]bool{"HOUR": true, "DAY": true, "MONTH": true, "YEAR": true}
+
+// materializedSetting is `materialized` in metadata of materialized views.
+type materializedSetting struct {
+	EnableRefresh   bool
+	RefreshInterval time.Duration
+	PartitionBy     string
+	// PartitionType is the time partitioning type of PartitionBy, e.g. DAY.
+	PartitionType string
+	ClusterBy     []string
+}
+
+// isMaterialized returns whether md is metadata of a materialized view.
+func isMaterialized(md map[string]interface{}) bool {
+	return md["type"] == MaterializedViewType
+}
+
+// parseMaterialized returns `materialized` in md with the defaults.
+func parseMaterialized(md map[string]interface{}) (materializedSetting, error) {
+	s := materializedSetting{EnableRefresh: true, RefreshInterval: DefaultRefreshInterval, PartitionType: DefaultPartitionType}
+	m, _ := NormalizeMetadata(map[string]interface{}{"materialized": md["materialized"]})["materialized"].(map[string]interface{})
+	if v, ok := m["enable_refresh"]; ok && v != nil {
+		b, ok := v.(bool)
+		if !ok {
+			return materializedSetting{}, errors.Errorf("materialized.enable_refresh must be true or false, got %v", v)
+		}
+		s.EnableRefresh = b
+	}
+	if v, ok := m["refresh_interval"]; ok && v != nil {
+		d, err := time.ParseDuration(fmt.Sprint(v))
+		if err != nil {
+			return materializedSetting{}, errors.WithMessage(err, "materialized.refresh_interval")
+		}
+		s.RefreshInterval = d
+	}
+	if v, ok := m["partition_by"]; ok && v != nil {
+		s.PartitionBy = fmt.Sprint(v)
+	}
+	if v, ok := m["partition_type"]; ok && v != nil {
+		s.PartitionType = strings.ToUpper(fmt.Sprint(v))
+		if !partitionTypes[s.PartitionType] {
+			return materializedSetting{}, errors.Errorf("materialized.partition_type must be HOUR, DAY, MONTH or YEAR, got %v", v)
+		}
+	}
+	switch v := m["cluster_by"].(type) {
+	case nil:
+	case []interface{}:
+		for _, f := range v {
+			s.ClusterBy = append(s.ClusterBy, fmt.Sprint(f))
+		}
+	default:
+		s.ClusterBy = []string{fmt.Sprint(v)}
+	}
+	return s, nil
+}
+
+// metadata returns s as `materialized` in metadata, without the defaults. It returns nil if s is the default.
+func (s materializedSetting) metadata() map[string]interface{} {
+	res := map[string]interface{}{}
+	if !s.EnableRefresh {
+		res["enable_refresh"] = false
+	}
+	if s.RefreshInterval != 0 && s.RefreshInterval != DefaultRefreshInterval {
+		res["refresh_interval"] = s.RefreshInterval.String()
+	}
+	if s.PartitionBy != "" {
+		res["partition_by"] = s.PartitionBy
+	}
+	if s.PartitionBy != "" && s.PartitionType != "" && s.PartitionType != DefaultPartitionType {
+		res["partition_type"] = s.PartitionType
+	}
+	if len(s.ClusterBy) != 0 {
+		res["cluster_by"] = stringsToValues(s.ClusterBy)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// RequiresRecreate returns whether a view has to be dropped and created again to change it from before to after,
+// which are queries and managed metadata (see ManagedMetadata).
+// It is when the view changes to or from a materialized view or a routine, the type of a routine changes,
+// or the query, partitioning or clustering of a materialized view changes.
+func RequiresRecreate(beforeQuery string, before map[string]interface{}, afterQuery string, after map[string]interface{}) bool {
+	if isRoutine(before) || isRoutine(after) {
+		return before["type"] != after["type"]
+	}
+	if isMaterialized(before) != isMaterialized(after) {
+		return true
+	}
+	if !isMaterialized(after) {
+		return false
+	}
+	if beforeQuery != afterQuery {
+		return true
+	}
+	b, berr := parseMaterialized(before)
+	a, aerr := parseMaterialized(after)
+	if berr != nil || aerr != nil {
+		return true
+	}
+	return b.PartitionBy != a.PartitionBy || (a.PartitionBy != "" && b.PartitionType != a.PartitionType) || !reflect.DeepEqual(b.ClusterBy, a.ClusterBy)
+}
+
+// WithRESTClient returns BQManager that manages materialized views and routines through client as well as views.
+// Materialized views and routines are not listed without it.
+func (b BQManager) WithRESTClient(client RESTClient) BQManager {
+	b.restClient = client
+	return b
+}
+
+// isView returns whether BQManager manages tables of tmd.
+func (b BQManager) isView(tmd *bigquery.TableMetadata) bool {
+	return tmd.Type == bigquery.ViewTable || (tmd.Type == MaterializedViewTable && b.restClient != nil)
+}
+
+// viewQuery returns the query of the view of tmd in BigQuery, and adds the settings of a materialized view to metadata.
+func (b BQManager) viewQuery(ctx context.Context, dataset, name string, tmd *bigquery.TableMetadata, metadata map[string]interface{}) (string, error) {
+	if tmd.Type != MaterializedViewTable || b.restClient == nil {
+		return tmd.ViewQuery, nil
+	}
+
+	var t *bq.Table
+	err := b.retryPolicy.Do(ctx, "tables.get", func() error {
+		var err error
+		t, err = b.restClient.GetTable(ctx, b.datasetMapper.ToRemote(dataset), name)
+		return err
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	def := t.MaterializedView
+	if def == nil {
+		return "", errors.Errorf("%s.%s is not a materialized view", dataset, name)
+	}
+
+	s := materializedSetting{EnableRefresh: def.EnableRefresh, RefreshInterval: time.Duration(def.RefreshIntervalMs) * time.Millisecond}
+	// The type of time partitioning is not in bigquery.TimePartitioning.
+	if t.TimePartitioning != nil {
+		s.PartitionBy = t.TimePartitioning.Field
+		s.PartitionType = t.TimePartitioning.Type
+	}
+	if tmd.Clustering != nil {
+		s.ClusterBy = tmd.Clustering.Fields
+	}
+	metadata["type"] = MaterializedViewType
+	if md := s.metadata(); md != nil {
+		metadata["materialized"] = md
+	}
+	return def.Query, nil
+}
+
+// createMaterialized creates view, which is a materialized view.
+func (b BQManager) createMaterialized(ctx context.Context, view View, tmd bigquery.TableMetadata) error {
+	if b.restClient == nil {
+		return errors.Errorf("%s.%s: materialized views are not supported by this BigQuery client", view.DataSet(), view.Name())
+	}
+	s, err := parseMaterialized(ManagedMetadata(view.Setting()))
+	if err != nil {
+		return errors.WithMessagef(err, "%s.%s", view.DataSet(), view.Name())
+	}
+
+	t := &bq.Table{
+		FriendlyName:     tmd.Name,
+		Description:      tmd.Description,
+		Labels:           tmd.Labels,
+		MaterializedView: materializedViewToBQ(b.datasetMapper.QueryToRemote(view.Query()), s),
+	}
+	if s.PartitionBy != "" {
+		t.TimePartitioning = &bq.TimePartitioning{Type: s.PartitionType, Field: s.PartitionBy}
+	}
+	if len(s.ClusterBy) != 0 {
+		t.Clustering = &bq.Clustering{Fields: s.ClusterBy}
+	}
+	return errors.WithStack(b.retryPolicy.DoInsert(ctx, "tables.insert", func() error {
+		return b.restClient.InsertTable(ctx, b.datasetMapper.ToRemote(view.DataSet()), view.Name(), t)
+	}))
+}
+
+// materializedViewToBQ returns the definition of a materialized view of query with s in the BigQuery API.
+func materializedViewToBQ(query string, s materializedSetting) *bq.MaterializedViewDefinition {
+	return &bq.MaterializedViewDefinition{
+		Query:             query,
+		EnableRefresh:     s.EnableRefresh,
+		RefreshIntervalMs: s.RefreshInterval.Milliseconds(),
+		// false is not sent unless forced.
+		ForceSendFields: []string{"EnableRefresh"},
+	}
+}
+
+// updateMaterialized updates view when it is or becomes a materialized view.
+// Changes that BigQuery cannot make to a materialized view are made by dropping it and creating it again (see RequiresRecreate).
+func (b BQManager) updateMaterialized(ctx context.Context, view View) (View, error) {
+	current, err := b.Get(ctx, view.DataSet(), view.Name())
+	if err == NotFoundError && ETagOf(view) != "" {
+		return nil, errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if etag := ETagOf(view); etag != "" && ETagOf(current) != etag {
+		return nil, errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name(), Remote: current})
+	}
+
+	md := ManagedMetadata(view.Setting())
+	if RequiresRecreate(current.Query(), ManagedMetadata(current.Setting()), view.Query(), md) {
+		return b.recreate(ctx, current, view)
+	}
+
+	tmd, err := b.converToTmd(view)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	descriptions, err := columnDescriptions(view)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	t := b.bqClient.Dataset(b.datasetMapper.ToRemote(view.DataSet())).Table(view.Name())
+	err = b.retryPolicy.DoUpdate(ctx, "tables.update", func() error {
+		currentTmd, err := t.Metadata(ctx)
+		if err != nil {
+			return err
+		}
+		tmdForUpdate, err := b.convertTmdToForUpdate(tmd, currentTmd)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// The query of a materialized view is not updated by BigQuery but by recreating it.
+		tmdForUpdate.ViewQuery = nil
+		_, err = t.Update(ctx, tmdForUpdate, currentTmd.ETag)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s, err := parseMaterialized(md)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "%s.%s", view.DataSet(), view.Name())
+	}
+	cs, _ := parseMaterialized(ManagedMetadata(current.Setting()))
+	if s.EnableRefresh != cs.EnableRefresh || s.RefreshInterval != cs.RefreshInterval {
+		patch := &bq.Table{MaterializedView: materializedViewToBQ(b.datasetMapper.QueryToRemote(view.Query()), s)}
+		err := b.retryPolicy.Do(ctx, "tables.update", func() error {
+			return b.restClient.PatchTable(ctx, b.datasetMapper.ToRemote(view.DataSet()), view.Name(), patch, "")
+		})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if err := b.describeColumns(ctx, view, descriptions); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := b.authorize(ctx, view.DataSet(), view.Name(), b.datasetMapper.QueryToRemote(view.Query()), metadataAuthorizedFor(md), nil); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b.Get(ctx, view.DataSet(), view.Name())
+}
@@ -0,0 +1,182 @@
+package viewmanager
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ManagedMetadataKeys are the metadata keys that bqv writes to BigQuery.
+// authorized_for is the datasets that authorize the view in their access lists, i.e. the view is an authorized view of them.
+// type is `materialized` for materialized views, whose refresh options, partitioning and clustering are in materialized,
+// and `function` or `table_function` for routines, whose language, arguments and return type are in routine.
+// columns are the descriptions of the columns of views (see metadataColumns).
+var ManagedMetadataKeys = []string{"friendly_name", "description", "labels", "authorized_for", "type", "materialized", "routine", "columns"}
+
+// ManagedMetadata returns the normalized subset of the metadata that bqv manages.
+// Empty values are dropped so that a missing key and an empty value are treated the same.
+func ManagedMetadata(setting Setting) map[string]interface{} {
+	res := map[string]interface{}{}
+	if setting == nil {
+		return res
+	}
+	md := NormalizeMetadata(setting.Metadata())
+	for _, k := range ManagedMetadataKeys {
+		v, ok := md[k]
+		if !ok || isEmpty(v) {
+			continue
+		}
+		res[k] = v
+	}
+	// Settings of materialized views and routines are without the defaults, and only for them.
+	switch {
+	case isMaterialized(res):
+		delete(res, "routine")
+		if m, err := parseMaterialized(res); err == nil {
+			delete(res, "materialized")
+			if md := m.metadata(); md != nil {
+				res["materialized"] = md
+			}
+		}
+	case isRoutine(res):
+		// Routines have neither friendly names, labels nor columns, and cannot be authorized views.
+		for _, k := range []string{"friendly_name", "labels", "authorized_for", "materialized", "columns"} {
+			delete(res, k)
+		}
+		if r, err := parseRoutine(res); err == nil {
+			delete(res, "routine")
+			if md := r.metadata(); md != nil {
+				res["routine"] = md
+			}
+		}
+	default:
+		delete(res, "type")
+		delete(res, "materialized")
+		delete(res, "routine")
+	}
+	// Only descriptions of columns are managed.
+	if _, ok := res["columns"]; ok {
+		delete(res, "columns")
+		if columns := metadataColumns(md); len(columns) != 0 {
+			res["columns"] = columns
+		}
+	}
+	// The order of datasets does not matter.
+	if datasets := metadataAuthorizedFor(res); len(datasets) != 0 {
+		res["authorized_for"] = stringsToValues(datasets)
+	}
+	return res
+}
+
+// NormalizeMetadata converts nested maps decoded from YAML (map[interface{}]interface{}) to map[string]interface{}.
+func NormalizeMetadata(md map[string]interface{}) map[string]interface{} {
+	if md == nil {
+		return nil
+	}
+	res := make(map[string]interface{}, len(md))
+	for k, v := range md {
+		res[k] = normalize(v)
+	}
+	return res
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[fmt.Sprint(k)] = normalize(vv)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[k] = normalize(vv)
+		}
+		return m
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[k] = vv
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, vv := range v {
+			s[i] = normalize(vv)
+		}
+		return s
+	}
+	return v
+}
+
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func metadataFriendlyName(md map[string]interface{}) string {
+	if n, ok := md["friendly_name"]; ok && n != nil {
+		return fmt.Sprint(n)
+	}
+	return ""
+}
+
+func metadataDescription(md map[string]interface{}) string {
+	if d, ok := md["description"]; ok && d != nil {
+		return fmt.Sprint(d)
+	}
+	return ""
+}
+
+func metadataLabels(md map[string]interface{}) map[string]string {
+	labels := map[string]string{}
+	ls, _ := md["labels"].(map[string]interface{})
+	for k, v := range ls {
+		if v != nil {
+			labels[k] = fmt.Sprint(v)
+		}
+	}
+	return labels
+}
+
+// metadataAuthorizedFor returns the sorted datasets in authorized_for, which is a list or a single dataset.
+func metadataAuthorizedFor(md map[string]interface{}) []string {
+	datasets := []string{}
+	switch v := md["authorized_for"].(type) {
+	case nil:
+	case []interface{}:
+		for _, d := range v {
+			if d != nil && fmt.Sprint(d) != "" {
+				datasets = append(datasets, fmt.Sprint(d))
+			}
+		}
+	default:
+		datasets = append(datasets, fmt.Sprint(v))
+	}
+	sort.Strings(datasets)
+
+	res := datasets[:0]
+	for i, d := range datasets {
+		if i == 0 || d != datasets[i-1] {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+func stringsToValues(ss []string) []interface{} {
+	res := make([]interface{}, len(ss))
+	for i, s := range ss {
+		res[i] = s
+	}
+	return res
+}
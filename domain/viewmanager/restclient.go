@@ -0,0 +1,180 @@
+package viewmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Routine is a routine of the BigQuery API. bq.Routine of google.golang.org/api v0.14.0 has no returnTableType,
+// the columns that a table-valued function returns, so it is added here.
+type Routine struct {
+	bq.Routine
+	ReturnTableType *StandardSQLTableType `json:"returnTableType,omitempty"`
+}
+
+// StandardSQLTableType is a table type of the BigQuery API.
+type StandardSQLTableType struct {
+	Columns []*bq.StandardSqlField `json:"columns,omitempty"`
+}
+
+// MarshalJSON adds returnTableType to the JSON of bq.Routine.
+func (r *Routine) MarshalJSON() ([]byte, error) {
+	b, err := r.Routine.MarshalJSON()
+	if err != nil || r.ReturnTableType == nil {
+		return b, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if fields["returnTableType"], err = json.Marshal(r.ReturnTableType); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// RESTClient is the part of the BigQuery API that bqiface.Client does not support yet, in the types of the API:
+// the definitions of materialized views and routines. Datasets are remote names.
+// Errors are *googleapi.Error as those of bqiface.Client.
+type RESTClient interface {
+	GetTable(ctx context.Context, dataset, table string) (*bq.Table, error)
+	InsertTable(ctx context.Context, dataset, table string, t *bq.Table) error
+	// PatchTable updates the fields of the table that are set in patch. It fails unless the table has etag, if etag is not empty.
+	PatchTable(ctx context.Context, dataset, table string, patch *bq.Table, etag string) error
+
+	// ListRoutines returns the IDs of the routines in dataset.
+	ListRoutines(ctx context.Context, dataset string) ([]string, error)
+	GetRoutine(ctx context.Context, dataset, routine string) (*Routine, error)
+	InsertRoutine(ctx context.Context, dataset, routine string, r *Routine) error
+	// UpdateRoutine replaces the routine with r. It fails unless the routine has etag, if etag is not empty.
+	UpdateRoutine(ctx context.Context, dataset, routine string, r *Routine, etag string) error
+	DeleteRoutine(ctx context.Context, dataset, routine string) error
+}
+
+// restClient is RESTClient of the BigQuery API.
+// Routines are got, inserted and updated by client, which service uses as well, since bq.Routine has no returnTableType.
+type restClient struct {
+	service *bq.Service
+	client  *http.Client
+	project string
+}
+
+// NewRESTClient returns RESTClient of project with the default credentials.
+func NewRESTClient(ctx context.Context, project string) (RESTClient, error) {
+	client, _, err := htransport.NewClient(ctx, option.WithScopes(bq.BigqueryScope))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	service, err := bq.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return restClient{service: service, client: client, project: project}, nil
+}
+
+func (c restClient) GetTable(ctx context.Context, dataset, table string) (*bq.Table, error) {
+	return c.service.Tables.Get(c.project, dataset, table).Context(ctx).Do()
+}
+
+func (c restClient) InsertTable(ctx context.Context, dataset, table string, t *bq.Table) error {
+	body := *t
+	body.TableReference = &bq.TableReference{ProjectId: c.project, DatasetId: dataset, TableId: table}
+	_, err := c.service.Tables.Insert(c.project, dataset, &body).Context(ctx).Do()
+	return err
+}
+
+func (c restClient) PatchTable(ctx context.Context, dataset, table string, patch *bq.Table, etag string) error {
+	call := c.service.Tables.Patch(c.project, dataset, table, patch).Context(ctx)
+	if etag != "" {
+		call.Header().Set("If-Match", etag)
+	}
+	_, err := call.Do()
+	return err
+}
+
+func (c restClient) ListRoutines(ctx context.Context, dataset string) ([]string, error) {
+	res := []string{}
+	err := c.service.Routines.List(c.project, dataset).Pages(ctx, func(page *bq.ListRoutinesResponse) error {
+		for _, r := range page.Routines {
+			res = append(res, r.RoutineReference.RoutineId)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c restClient) GetRoutine(ctx context.Context, dataset, routine string) (*Routine, error) {
+	res := &Routine{}
+	if err := c.doRoutine(ctx, http.MethodGet, dataset, routine, nil, "", res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c restClient) InsertRoutine(ctx context.Context, dataset, routine string, r *Routine) error {
+	body := *r
+	body.RoutineReference = &bq.RoutineReference{ProjectId: c.project, DatasetId: dataset, RoutineId: routine}
+	return c.doRoutine(ctx, http.MethodPost, dataset, "", &body, "", nil)
+}
+
+func (c restClient) UpdateRoutine(ctx context.Context, dataset, routine string, r *Routine, etag string) error {
+	body := *r
+	body.RoutineReference = &bq.RoutineReference{ProjectId: c.project, DatasetId: dataset, RoutineId: routine}
+	return c.doRoutine(ctx, http.MethodPut, dataset, routine, &body, etag, nil)
+}
+
+// doRoutine sends a request to the routine of dataset, or to the routines of dataset if routine is empty,
+// and decodes the response into res unless it is nil. Errors are *googleapi.Error as those of service.
+func (c restClient) doRoutine(ctx context.Context, method, dataset, routine string, body *Routine, etag string, res *Routine) error {
+	u := c.service.BasePath + "projects/" + url.PathEscape(c.project) + "/datasets/" + url.PathEscape(dataset) + "/routines"
+	if routine != "" {
+		u += "/" + url.PathEscape(routine)
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		b, err := body.MarshalJSON()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		reqBody.Write(b)
+	}
+	req, err := http.NewRequest(method, u, &reqBody)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	if res == nil {
+		return nil
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(res))
+}
+
+func (c restClient) DeleteRoutine(ctx context.Context, dataset, routine string) error {
+	return c.service.Routines.Delete(c.project, dataset, routine).Context(ctx).Do()
+}
@@ -0,0 +1,145 @@
+package viewmanager
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
+)
+
+// RetryPolicy is how BQManager retries requests that fail with transient errors. See IsRetryable.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one. 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. The wait is multiplied by Multiplier on every retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomizes each wait by up to this fraction of it, e.g. 0.2 waits 80% to 120% of the backoff,
+	// so that concurrent requests do not retry at the same time.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the RetryPolicy of BQManager unless specified.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// NoRetry is a RetryPolicy that does not retry.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// retryableReasons are the reasons of googleapi errors that succeed if retried later.
+var retryableReasons = map[string]bool{
+	"rateLimitExceeded": true,
+	"backendError":      true,
+	"internalError":     true,
+}
+
+// IsRetryable returns whether err is a transient error of BigQuery: a rate limit (429 or rateLimitExceeded) or a server error (5xx).
+// Other errors, such as invalid requests, missing or duplicated resources and failed preconditions (412), fail again if retried.
+func IsRetryable(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	switch {
+	case e.Code == http.StatusTooManyRequests, e.Code >= 500:
+		return true
+	}
+	for _, item := range e.Errors {
+		if retryableReasons[item.Reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls f until it succeeds, returns an error that is not retryable, or has been called p.MaxAttempts times.
+// op names the request in logs.
+func (p RetryPolicy) Do(ctx context.Context, op string, f func() error) error {
+	return p.do(ctx, op, IsRetryable, f)
+}
+
+// DoUpdate is Do for f that reads a resource and writes it with the etag that it read.
+// It also retries when the resource was changed between the read and the write (412), since f reads it again.
+// A write with an etag read before f must use Do, since its 412 is a conflict.
+func (p RetryPolicy) DoUpdate(ctx context.Context, op string, f func() error) error {
+	return p.do(ctx, op, func(err error) bool {
+		return IsRetryable(err) || hasCode(err, http.StatusPreconditionFailed)
+	}, f)
+}
+
+// DoInsert is Do for f that creates a resource. The resource that exists (409) on a retry is created by an earlier attempt
+// whose response was lost, so the retry succeeds.
+func (p RetryPolicy) DoInsert(ctx context.Context, op string, f func() error) error {
+	return p.doIdempotent(ctx, op, http.StatusConflict, f)
+}
+
+// DoDelete is Do for f that deletes a resource. The resource that is missing (404) on a retry is deleted by an earlier attempt
+// whose response was lost, so the retry succeeds.
+func (p RetryPolicy) DoDelete(ctx context.Context, op string, f func() error) error {
+	return p.doIdempotent(ctx, op, http.StatusNotFound, f)
+}
+
+// doIdempotent calls f by Do, and ignores the error of code on retries.
+func (p RetryPolicy) doIdempotent(ctx context.Context, op string, code int, f func() error) error {
+	attempt := 0
+	return p.Do(ctx, op, func() error {
+		attempt++
+		err := f()
+		if attempt > 1 && hasCode(err, code) {
+			zap.L().Debug("Earlier attempt succeeded", zap.String("op", op), zap.Error(err))
+			return nil
+		}
+		return err
+	})
+}
+
+func (p RetryPolicy) do(ctx context.Context, op string, retryable func(error) bool, f func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		wait := p.jitter(backoff)
+		zap.L().Warn("Retrying BigQuery request",
+			zap.String("op", op),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		if p.Multiplier > 1 {
+			backoff = time.Duration(float64(backoff) * p.Multiplier)
+		}
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func hasCode(err error, code int) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == code
+}
+
+func (p RetryPolicy) jitter(d time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 - p.Jitter + 2*p.Jitter*rand.Float64()))
+}
@@ -0,0 +1,136 @@
+package viewmanager_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"github.com/rerost/bqv/mocks/bqfake"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{bqfake.RateLimitError(), true},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{&googleapi.Error{Code: http.StatusPreconditionFailed}, false},
+		{&googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "invalid"}}}, false},
+		{&googleapi.Error{Code: http.StatusNotFound}, false},
+		{&googleapi.Error{Code: http.StatusConflict}, false},
+		{errors.New("not a googleapi error"), false},
+	}
+	for _, c := range cases {
+		if got := viewmanager.IsRetryable(c.err); got != c.want {
+			t.Errorf("IsRetryable(%v) = %v", c.err, got)
+		}
+	}
+}
+
+func TestBQManagerRetry(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	policy := viewmanager.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2, Jitter: 0.5}
+	bqManager := viewmanager.NewBQManager(client).WithRetryPolicy(policy)
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+
+	// Transient errors are retried.
+	client.FailNext("datasets.insert", unavailable)
+	client.FailNext("tables.insert", bqfake.RateLimitError(), unavailable)
+	view := dummyView{dataset: "test", name: "test", query: "SELECT 1"}
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+
+	// An update retries with the metadata read again.
+	client.FailNext("tables.update", unavailable)
+	view.query = "SELECT 2"
+	updated, err := bqManager.Update(ctx, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed precondition is a conflict, not retried.
+	client.FailNext("tables.update", &googleapi.Error{Code: http.StatusPreconditionFailed})
+	_, err = bqManager.Update(ctx, viewmanager.WithETag(view, viewmanager.ETagOf(updated)))
+	if _, ok := errors.Cause(err).(viewmanager.ConflictError); !ok {
+		t.Errorf("want ConflictError, got %v", err)
+	}
+
+	// Permanent errors are not retried.
+	invalid := &googleapi.Error{Code: http.StatusBadRequest, Errors: []googleapi.ErrorItem{{Reason: "invalid"}}}
+	client.FailNext("tables.update", invalid)
+	if _, err := bqManager.Update(ctx, view); err == nil {
+		t.Error("want the invalid error")
+	}
+	if _, err := bqManager.Update(ctx, view); err != nil {
+		t.Errorf("the invalid error should be returned only once, got %v", err)
+	}
+
+	// Requests give up after MaxAttempts.
+	client.FailNext("tables.delete", unavailable, unavailable, unavailable, unavailable)
+	if err := bqManager.Delete(ctx, view); err == nil {
+		t.Error("want the unavailable error after 3 attempts")
+	}
+	if err := bqManager.WithRetryPolicy(viewmanager.NoRetry).Delete(ctx, view); err == nil {
+		t.Error("want the 4th unavailable error")
+	}
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqManager.Get(ctx, "test", "test"); err != viewmanager.NotFoundError {
+		t.Errorf("want NotFoundError, got %v", err)
+	}
+}
+
+func TestBQManagerRetryIdempotent(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	policy := viewmanager.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	bqManager := viewmanager.NewBQManager(client).WithRetryPolicy(policy)
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "Service unavailable"}
+	view := dummyView{dataset: "test", name: "test", query: "SELECT 1"}
+
+	// The view exists on the retry of a create whose first attempt created it without a response.
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	client.FailNext("tables.insert", unavailable)
+	if _, err := bqManager.Create(ctx, view); err != nil {
+		t.Errorf("want the retried create to succeed, got %v", err)
+	}
+	// The first attempt fails if the view exists.
+	if _, err := bqManager.Create(ctx, view); err == nil {
+		t.Error("want the conflict of the first attempt")
+	}
+
+	// The view is missing on the retry of a delete whose first attempt deleted it without a response.
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Fatal(err)
+	}
+	client.FailNext("tables.delete", unavailable)
+	if err := bqManager.Delete(ctx, view); err != nil {
+		t.Errorf("want the retried delete to succeed, got %v", err)
+	}
+	if err := bqManager.Delete(ctx, view); err == nil {
+		t.Error("want the not found error of the first attempt")
+	}
+}
+
+func TestBQManagerCreateDatasetError(t *testing.T) {
+	ctx := context.Background()
+	client := bqfake.New("project")
+	bqManager := viewmanager.NewBQManager(client)
+
+	client.FailNext("datasets.get", &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}})
+	_, err := bqManager.Create(ctx, dummyView{dataset: "test", name: "test", query: "SELECT 1"})
+	if e, ok := errors.Cause(err).(*googleapi.Error); !ok || e.Code != http.StatusForbidden {
+		t.Errorf("want the access denied error, got %v", err)
+	}
+}
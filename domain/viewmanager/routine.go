@@ -0,0 +1,377 @@
+package viewmanager
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// FunctionType and TableFunctionType are the `type` in metadata of routines, which are SQL or JavaScript functions
+// and table-valued functions. The query of a routine is its body.
+const (
+	FunctionType      = "function"
+	TableFunctionType = "table_function"
+)
+
+// RoutinesDir is the directory of routines in the directory of a dataset. Routines in it are functions unless their type is specified.
+const RoutinesDir = "routines"
+
+// Types of routines in the BigQuery API.
+const (
+	ScalarFunctionRoutine = "SCALAR_FUNCTION"
+	TableFunctionRoutine  = "TABLE_VALUED_FUNCTION"
+)
+
+var routineTypes = map[string]string{
+	FunctionType:      ScalarFunctionRoutine,
+	TableFunctionType: TableFunctionRoutine,
+}
+
+// RoutineArgument is an argument of a routine. Its type is in Standard SQL, e.g. `ARRAY<INT64>`, or AnyType for templated arguments.
+type RoutineArgument struct {
+	Name string
+	Type string
+}
+
+// routineSetting is `routine` in metadata of routines.
+type routineSetting struct {
+	// Language is sql or javascript.
+	Language  string
+	Arguments []RoutineArgument
+	// Returns is the return type, which is a table type such as `TABLE<id INT64>` for table-valued functions.
+	Returns           string
+	ImportedLibraries []string
+}
+
+// IsRoutine returns whether view is a routine by the type in its metadata.
+func IsRoutine(view View) bool {
+	return isRoutine(ManagedMetadata(view.Setting()))
+}
+
+// isRoutine returns whether md is metadata of a routine.
+func isRoutine(md map[string]interface{}) bool {
+	_, ok := routineTypes[fmt.Sprint(md["type"])]
+	return ok
+}
+
+// parseRoutine returns `routine` in md with the types normalized.
+func parseRoutine(md map[string]interface{}) (routineSetting, error) {
+	s := routineSetting{Language: "sql"}
+	m, _ := NormalizeMetadata(map[string]interface{}{"routine": md["routine"]})["routine"].(map[string]interface{})
+	if v, ok := m["language"]; ok && v != nil {
+		s.Language = strings.ToLower(fmt.Sprint(v))
+	}
+	switch s.Language {
+	case "sql", "javascript":
+	case "js":
+		s.Language = "javascript"
+	default:
+		return routineSetting{}, errors.Errorf("routine.language must be sql or javascript, got %v", m["language"])
+	}
+
+	args, ok := m["arguments"].([]interface{})
+	if !ok && m["arguments"] != nil {
+		return routineSetting{}, errors.New("routine.arguments must be a list of {name, type}")
+	}
+	for i, a := range args {
+		arg, ok := a.(map[string]interface{})
+		if !ok || arg["name"] == nil || arg["type"] == nil {
+			return routineSetting{}, errors.Errorf("routine.arguments[%d] must be {name, type}", i)
+		}
+		t, err := validSQLType(fmt.Sprint(arg["type"]), true)
+		if err != nil {
+			return routineSetting{}, errors.WithMessagef(err, "routine.arguments[%d].type", i)
+		}
+		s.Arguments = append(s.Arguments, RoutineArgument{Name: fmt.Sprint(arg["name"]), Type: t})
+	}
+
+	if v, ok := m["returns"]; ok && v != nil {
+		returns, err := validReturnType(fmt.Sprint(v), fmt.Sprint(md["type"]))
+		if err != nil {
+			return routineSetting{}, errors.WithMessage(err, "routine.returns")
+		}
+		s.Returns = returns
+	}
+
+	switch v := m["imported_libraries"].(type) {
+	case nil:
+	case []interface{}:
+		for _, l := range v {
+			s.ImportedLibraries = append(s.ImportedLibraries, fmt.Sprint(l))
+		}
+	default:
+		s.ImportedLibraries = []string{fmt.Sprint(v)}
+	}
+	return s, nil
+}
+
+// validReturnType returns the normalized return type s of a routine of routineType, which is a table type only for table-valued functions.
+func validReturnType(s, routineType string) (string, error) {
+	if !isTableType(s) {
+		return validSQLType(s, false)
+	}
+	if routineType != TableFunctionType {
+		return "", errors.New("only table-valued functions return TABLE")
+	}
+	t, err := parseTableType(s)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return formatTableType(t), nil
+}
+
+// validSQLType returns the normalized type of s, which is AnyType only if any is true.
+func validSQLType(s string, any bool) (string, error) {
+	t := normalizeSQLType(s)
+	if t == AnyType && any {
+		return t, nil
+	}
+	if _, err := parseSQLType(t); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return t, nil
+}
+
+// metadata returns s as `routine` in metadata, without the defaults. It returns nil if s is the default.
+func (s routineSetting) metadata() map[string]interface{} {
+	res := map[string]interface{}{}
+	if l := strings.ToLower(s.Language); l != "" && l != "sql" {
+		res["language"] = l
+	}
+	if len(s.Arguments) != 0 {
+		args := make([]interface{}, len(s.Arguments))
+		for i, a := range s.Arguments {
+			args[i] = map[string]interface{}{"name": a.Name, "type": a.Type}
+		}
+		res["arguments"] = args
+	}
+	if s.Returns != "" {
+		res["returns"] = s.Returns
+	}
+	if len(s.ImportedLibraries) != 0 {
+		res["imported_libraries"] = stringsToValues(s.ImportedLibraries)
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// WithRoutineDatasets returns BQManager whose List lists routines only in the local datasets that datasets returns,
+// since every dataset takes a request to list its routines. datasets is called once per List.
+// Routines in every dataset are listed without it.
+func (b BQManager) WithRoutineDatasets(datasets func(ctx context.Context) ([]string, error)) BQManager {
+	b.routineDatasets = datasets
+	return b
+}
+
+// routineDatasetSet returns the local datasets whose routines are listed. It returns nil for every dataset.
+func (b BQManager) routineDatasetSet(ctx context.Context) (map[string]bool, error) {
+	if b.routineDatasets == nil || b.restClient == nil {
+		return nil, nil
+	}
+	datasets, err := b.routineDatasets(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	res := map[string]bool{}
+	for _, d := range datasets {
+		res[d] = true
+	}
+	return res, nil
+}
+
+// listRoutines returns the routines in the remote dataset of localDataset that List reads.
+func (b BQManager) listRoutines(ctx context.Context, localDataset string) ([]datasetTable, error) {
+	res := []datasetTable{}
+	if b.restClient == nil {
+		return res, nil
+	}
+
+	var routines []string
+	err := b.retryPolicy.Do(ctx, "routines.list", func() error {
+		var err error
+		routines, err = b.restClient.ListRoutines(ctx, b.datasetMapper.ToRemote(localDataset))
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, r := range routines {
+		if b.matches(localDataset, r) {
+			res = append(res, datasetTable{localDataset: localDataset, routine: r})
+		}
+	}
+	return res, nil
+}
+
+// GetRoutine returns the routine as a view. It returns NotFoundError if the routine does not exist or is not a function,
+// e.g. a procedure, which bqv does not manage.
+func (b BQManager) GetRoutine(ctx context.Context, dataset, name string) (View, error) {
+	if b.restClient == nil {
+		return nil, NotFoundError
+	}
+
+	var r *Routine
+	err := b.retryPolicy.Do(ctx, "routines.get", func() error {
+		var err error
+		r, err = b.restClient.GetRoutine(ctx, b.datasetMapper.ToRemote(dataset), name)
+		return err
+	})
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil, NotFoundError
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	metadata := map[string]interface{}{}
+	for t, rt := range routineTypes {
+		if rt == r.RoutineType {
+			metadata["type"] = t
+		}
+	}
+	if metadata["type"] == nil {
+		return nil, NotFoundError
+	}
+	if r.Description != "" {
+		metadata["description"] = r.Description
+	}
+	s := routineSetting{
+		Language:          r.Language,
+		Returns:           formatSQLType(r.ReturnType),
+		ImportedLibraries: r.ImportedLibraries,
+	}
+	if r.ReturnTableType != nil {
+		s.Returns = formatTableType(r.ReturnTableType)
+	}
+	for _, a := range r.Arguments {
+		arg := RoutineArgument{Name: a.Name, Type: formatSQLType(a.DataType)}
+		if a.ArgumentKind == "ANY_TYPE" {
+			arg.Type = AnyType
+		}
+		s.Arguments = append(s.Arguments, arg)
+	}
+	if md := s.metadata(); md != nil {
+		metadata["routine"] = md
+	}
+
+	body := r.DefinitionBody
+	if !strings.EqualFold(r.Language, "javascript") {
+		body = b.datasetMapper.QueryToLocal(body)
+	}
+	return bqView{
+		dataSet: dataset,
+		name:    name,
+		query:   body,
+		setting: bqSetting{
+			metadata: metadata,
+		},
+		etag: r.Etag,
+	}, nil
+}
+
+// routineToBQ returns the routine of view in the BigQuery API.
+func (b BQManager) routineToBQ(view View) (*Routine, error) {
+	md := ManagedMetadata(view.Setting())
+	s, err := parseRoutine(md)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "%s.%s", view.DataSet(), view.Name())
+	}
+
+	body := view.Query()
+	// References in JavaScript are not datasets.
+	if s.Language == "sql" {
+		body = b.datasetMapper.QueryToRemote(body)
+	}
+	r := &Routine{Routine: bq.Routine{
+		RoutineType:       routineTypes[fmt.Sprint(md["type"])],
+		Language:          strings.ToUpper(s.Language),
+		ImportedLibraries: s.ImportedLibraries,
+		DefinitionBody:    body,
+		Description:       metadataDescription(md),
+	}}
+	for _, a := range s.Arguments {
+		arg := &bq.Argument{Name: a.Name}
+		if a.Type == AnyType {
+			arg.ArgumentKind = "ANY_TYPE"
+		} else if arg.DataType, err = parseSQLType(a.Type); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		r.Arguments = append(r.Arguments, arg)
+	}
+	switch {
+	case isTableType(s.Returns):
+		if r.ReturnTableType, err = parseTableType(s.Returns); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	case s.Returns != "":
+		if r.ReturnType, err = parseSQLType(s.Returns); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return r, nil
+}
+
+// createRoutine creates view, which is a routine.
+func (b BQManager) createRoutine(ctx context.Context, view View) error {
+	if b.restClient == nil {
+		return errors.Errorf("%s.%s: routines are not supported by this BigQuery client", view.DataSet(), view.Name())
+	}
+	r, err := b.routineToBQ(view)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(b.retryPolicy.DoInsert(ctx, "routines.insert", func() error {
+		return b.restClient.InsertRoutine(ctx, b.datasetMapper.ToRemote(view.DataSet()), view.Name(), r)
+	}))
+}
+
+// updateRoutine updates view, which is a routine. A routine whose type changes is dropped and created again.
+func (b BQManager) updateRoutine(ctx context.Context, view View) (View, error) {
+	current, err := b.GetRoutine(ctx, view.DataSet(), view.Name())
+	if err == NotFoundError && ETagOf(view) != "" {
+		return nil, errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	etag := ETagOf(view)
+	if etag != "" && ETagOf(current) != etag {
+		return nil, errors.WithStack(ConflictError{DataSet: view.DataSet(), Name: view.Name(), Remote: current})
+	}
+	if RequiresRecreate(current.Query(), ManagedMetadata(current.Setting()), view.Query(), ManagedMetadata(view.Setting())) {
+		return b.recreate(ctx, current, view)
+	}
+
+	r, err := b.routineToBQ(view)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = b.retryPolicy.Do(ctx, "routines.update", func() error {
+		err := b.restClient.UpdateRoutine(ctx, b.datasetMapper.ToRemote(view.DataSet()), view.Name(), r, etag)
+		// The routine was changed between the read and the update.
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed && etag != "" {
+			return b.conflict(ctx, view)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b.GetRoutine(ctx, view.DataSet(), view.Name())
+}
+
+// deleteRoutine deletes the routine without checking its etag.
+func (b BQManager) deleteRoutine(ctx context.Context, dataset, name string) error {
+	zap.L().Debug("Deleting routine", zap.String("Dataset", dataset), zap.String("Routine", name))
+	return errors.WithStack(b.retryPolicy.DoDelete(ctx, "routines.delete", func() error {
+		return b.restClient.DeleteRoutine(ctx, b.datasetMapper.ToRemote(dataset), name)
+	}))
+}
@@ -0,0 +1,188 @@
+package viewmanager
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+// AnyType is the type of templated arguments of SQL functions, which accept any type.
+const AnyType = "ANY TYPE"
+
+var (
+	sqlTypeKind = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	// sqlTypeAliases are the names that BigQuery returns for aliases of types.
+	sqlTypeAliases = map[string]string{
+		"INT":        "INT64",
+		"INTEGER":    "INT64",
+		"SMALLINT":   "INT64",
+		"BIGINT":     "INT64",
+		"TINYINT":    "INT64",
+		"BYTEINT":    "INT64",
+		"BOOLEAN":    "BOOL",
+		"DECIMAL":    "NUMERIC",
+		"BIGDECIMAL": "BIGNUMERIC",
+	}
+)
+
+// parseSQLType parses a type in Standard SQL such as `INT64`, `ARRAY<STRING>` or `STRUCT<id INT64, tags ARRAY<STRING>>`.
+func parseSQLType(s string) (*bq.StandardSqlDataType, error) {
+	s = strings.TrimSpace(s)
+	upper := strings.ToUpper(s)
+	switch {
+	case strings.HasPrefix(upper, "ARRAY") && strings.HasPrefix(strings.TrimSpace(s[len("ARRAY"):]), "<"):
+		params, err := typeParams(s[len("ARRAY"):])
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid type %q", s)
+		}
+		elem, err := parseSQLType(params)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &bq.StandardSqlDataType{TypeKind: "ARRAY", ArrayElementType: elem}, nil
+	case strings.HasPrefix(upper, "STRUCT") && strings.HasPrefix(strings.TrimSpace(s[len("STRUCT"):]), "<"):
+		params, err := typeParams(s[len("STRUCT"):])
+		if err != nil {
+			return nil, errors.WithMessagef(err, "invalid type %q", s)
+		}
+		fields, err := parseFields(s, params)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &bq.StandardSqlDataType{TypeKind: "STRUCT", StructType: &bq.StandardSqlStructType{Fields: fields}}, nil
+	}
+
+	if !sqlTypeKind.MatchString(upper) {
+		return nil, errors.Errorf("invalid type %q", s)
+	}
+	if alias, ok := sqlTypeAliases[upper]; ok {
+		upper = alias
+	}
+	return &bq.StandardSqlDataType{TypeKind: upper}, nil
+}
+
+// parseFields parses the fields of STRUCT or TABLE in params, such as `id INT64, tags ARRAY<STRING>`. s is the whole type.
+func parseFields(s, params string) ([]*bq.StandardSqlField, error) {
+	fields := []*bq.StandardSqlField{}
+	for _, field := range splitTypeParams(params) {
+		field = strings.TrimSpace(field)
+		i := strings.IndexAny(field, " \t\n")
+		if i < 0 {
+			return nil, errors.Errorf("invalid type %q: the field %q has no name or type", s, field)
+		}
+		t, err := parseSQLType(field[i:])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		fields = append(fields, &bq.StandardSqlField{Name: strings.Trim(field[:i], "`"), Type: t})
+	}
+	return fields, nil
+}
+
+// isTableType returns whether s is a table type such as `TABLE<id INT64>`, which table-valued functions return.
+func isTableType(s string) bool {
+	s = strings.TrimSpace(s)
+	return strings.HasPrefix(strings.ToUpper(s), "TABLE") && strings.HasPrefix(strings.TrimSpace(s[len("TABLE"):]), "<")
+}
+
+// parseTableType parses a table type such as `TABLE<id INT64, name STRING>`.
+func parseTableType(s string) (*StandardSQLTableType, error) {
+	s = strings.TrimSpace(s)
+	if !isTableType(s) {
+		return nil, errors.Errorf("invalid table type %q", s)
+	}
+	params, err := typeParams(s[len("TABLE"):])
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid type %q", s)
+	}
+	columns, err := parseFields(s, params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &StandardSQLTableType{Columns: columns}, nil
+}
+
+// typeParams returns the parameters of a type, i.e. what is in `<...>` of s.
+func typeParams(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "<") || !strings.HasSuffix(s, ">") {
+		return "", errors.New("type parameters must be in <>")
+	}
+	return s[1 : len(s)-1], nil
+}
+
+// splitTypeParams splits the parameters of a type at commas that are not in nested types.
+func splitTypeParams(s string) []string {
+	res := []string{}
+	depth, last := 0, 0
+	for i, r := range s {
+		switch r {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		case ',':
+			if depth == 0 {
+				res = append(res, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(res, s[last:])
+}
+
+// formatSQLType returns t in Standard SQL, in the form that parseSQLType parses.
+func formatSQLType(t *bq.StandardSqlDataType) string {
+	if t == nil {
+		return ""
+	}
+	switch t.TypeKind {
+	case "ARRAY":
+		return "ARRAY<" + formatSQLType(t.ArrayElementType) + ">"
+	case "STRUCT":
+		var fields []*bq.StandardSqlField
+		if t.StructType != nil {
+			fields = t.StructType.Fields
+		}
+		return "STRUCT<" + formatFields(fields) + ">"
+	}
+	return t.TypeKind
+}
+
+// formatTableType returns t in the form that parseTableType parses.
+func formatTableType(t *StandardSQLTableType) string {
+	if t == nil {
+		return ""
+	}
+	return "TABLE<" + formatFields(t.Columns) + ">"
+}
+
+func formatFields(fields []*bq.StandardSqlField) string {
+	res := make([]string, len(fields))
+	for i, f := range fields {
+		res[i] = f.Name + " " + formatSQLType(f.Type)
+	}
+	return strings.Join(res, ", ")
+}
+
+// normalizeSQLType returns s as BigQuery returns it, e.g. `ARRAY<INT64>` for `array<integer>`.
+// s is returned as it is if it is not a valid type.
+func normalizeSQLType(s string) string {
+	if strings.Join(strings.Fields(strings.ToUpper(s)), " ") == AnyType {
+		return AnyType
+	}
+	if isTableType(s) {
+		t, err := parseTableType(s)
+		if err != nil {
+			return s
+		}
+		return formatTableType(t)
+	}
+	t, err := parseSQLType(s)
+	if err != nil {
+		return s
+	}
+	return formatSQLType(t)
+}
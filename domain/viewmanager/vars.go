@@ -0,0 +1,158 @@
+package viewmanager
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// templateFuncs are the functions available in .sql files in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+// varAction matches a plain variable reference such as `{{ .project }}`, which dump can reverse.
+var varAction = regexp.MustCompile(`{{-?\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*-?}}`)
+
+// renderQuery renders query as text/template with vars. name is used in error messages.
+func renderQuery(name string, query string, vars map[string]string) (string, error) {
+	if !strings.Contains(query, "{{") {
+		return query, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return buf.String(), nil
+}
+
+// maxAlignCells bounds the work of aligning the changed parts of two queries in unrenderQuery.
+const maxAlignCells = 1 << 22
+
+// unrenderQuery returns the template of query based on the existing template raw.
+// `{{ .name }}` in raw is written back where its rendered value is kept unchanged in query. Occurrences of the value elsewhere are kept as they are.
+// It returns false when some of the template actions of raw are lost, e.g. raw uses functions or a rendered value is edited.
+func unrenderQuery(name string, raw string, query string, vars map[string]string) (string, bool) {
+	if rendered, err := renderQuery(name, raw, vars); err == nil && rendered == query {
+		return raw, true
+	}
+	if !strings.Contains(raw, "{{") {
+		return query, true
+	}
+
+	// Render raw piece by piece to know where the values of the variables are.
+	type span struct {
+		start, end int
+		action     string
+	}
+	var rendered strings.Builder
+	spans := []span{}
+	last := 0
+	for _, m := range varAction.FindAllStringSubmatchIndex(raw, -1) {
+		value, ok := vars[raw[m[2]:m[3]]]
+		if !ok {
+			return query, false
+		}
+		rendered.WriteString(raw[last:m[0]])
+		spans = append(spans, span{start: rendered.Len(), end: rendered.Len() + len(value), action: raw[m[0]:m[1]]})
+		rendered.WriteString(value)
+		last = m[1]
+	}
+	rendered.WriteString(raw[last:])
+	if strings.Contains(rendered.String(), "{{") || strings.Contains(query, "{{") {
+		// raw has other actions, or query cannot be a template as it is.
+		return query, false
+	}
+
+	aligned := align(rendered.String(), query)
+	var sb strings.Builder
+	ok := true
+	last = 0
+	for _, s := range spans {
+		if s.start == s.end {
+			// An empty value has no position.
+			ok = false
+			continue
+		}
+		start := aligned[s.start]
+		kept := start >= 0
+		for i := s.start + 1; kept && i < s.end; i++ {
+			kept = aligned[i] == start+i-s.start
+		}
+		if !kept || start < last {
+			ok = false
+			continue
+		}
+		sb.WriteString(query[last:start])
+		sb.WriteString(s.action)
+		last = start + s.end - s.start
+	}
+	sb.WriteString(query[last:])
+	return sb.String(), ok
+}
+
+// align returns the position in b of each byte of a that is kept in b, or -1 for a byte that is not.
+// Common prefix and suffix are kept, and the rest is aligned by the longest common subsequence unless it is too large.
+func align(a, b string) []int {
+	res := make([]int, len(a))
+	for i := range res {
+		res[i] = -1
+	}
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		res[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		res[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) == 0 || len(b) == 0 || (len(a)+1)*(len(b)+1) > maxAlignCells {
+		return res
+	}
+
+	// lcs[i*w+j] is the length of the longest common subsequence of a[i:] and b[j:].
+	w := len(b) + 1
+	lcs := make([]int32, (len(a)+1)*w)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i*w+j] = lcs[(i+1)*w+j+1] + 1
+			case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+				lcs[i*w+j] = lcs[(i+1)*w+j]
+			default:
+				lcs[i*w+j] = lcs[i*w+j+1]
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			res[prefix+i] = prefix + j
+			i++
+			j++
+		case lcs[(i+1)*w+j] >= lcs[i*w+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return res
+}
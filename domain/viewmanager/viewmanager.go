@@ -2,6 +2,9 @@ package viewmanager
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"strconv"
 
 	"github.com/pkg/errors"
 )
@@ -33,4 +36,58 @@ type ViewReadWriter interface {
 	ViewWriter
 }
 
+// Validator checks views without writing them.
+type Validator interface {
+	// Validate returns the bytes that the query of view would process. It returns *QueryError if the query is invalid.
+	Validate(ctx context.Context, view View) (int64, error)
+}
+
+// RoutineReader is a ViewReader that keeps routines apart from views as BigQuery does. Its Get does not return routines.
+type RoutineReader interface {
+	GetRoutine(ctx context.Context, dataset string, name string) (View, error)
+}
+
+// MatchingLister is a ViewReader that can list only some of the views without reading the others.
+type MatchingLister interface {
+	// ListMatching lists the views in datasets for which match returns true.
+	ListMatching(ctx context.Context, datasets []string, match func(dataset, name string) bool) ([]View, error)
+}
+
+// GetAs returns the view of r, which is looked up as a routine if routine is true and r is a RoutineReader.
+// routine is usually IsRoutine of the view that the caller has, such as the one to write.
+func GetAs(ctx context.Context, r ViewReader, dataset string, name string, routine bool) (View, error) {
+	if rr, ok := r.(RoutineReader); ok && routine {
+		return rr.GetRoutine(ctx, dataset, name)
+	}
+	return r.Get(ctx, dataset, name)
+}
+
 var NotFoundError = errors.New("NotFound")
+
+// QueryError is an error in the query of a view, or in its metadata that only the query can tell, such as unknown columns.
+// Line and Column are 1-based positions in the query. They are 0 if BigQuery does not report the position.
+type QueryError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+var queryErrorPosition = regexp.MustCompile(`\s*at \[(\d+):(\d+)\]$`)
+
+// newQueryError returns QueryError of a BigQuery error message such as `Syntax error: Unexpected end of script at [3:1]`.
+func newQueryError(message string) *QueryError {
+	e := &QueryError{Message: message}
+	if m := queryErrorPosition.FindStringSubmatchIndex(message); m != nil {
+		e.Line, _ = strconv.Atoi(message[m[2]:m[3]])
+		e.Column, _ = strconv.Atoi(message[m[4]:m[5]])
+		e.Message = message[:m[0]]
+	}
+	return e
+}
@@ -0,0 +1,104 @@
+package viewservice
+
+import (
+	"sync"
+)
+
+// WithConcurrency makes the service read and write up to n views at once.
+// Views are still written after the views they depend on.
+func WithConcurrency(n int) Option {
+	return func(s *viewServiceImpl) {
+		if n > 0 {
+			s.concurrency = n
+		}
+	}
+}
+
+// forEach calls f with 0 to n-1, up to s.concurrency at once, and returns the errors by index.
+func (s viewServiceImpl) forEach(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	concurrency := s.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = f(i)
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// dependencyLevels groups views, which are in the order to write them, into levels that can be written at once.
+// A view is in a later level than every view before it that it refers to or that refers to it, so levels keep the order where it matters.
+// nil views are ignored.
+func dependencyLevels(views [][]View) [][]int {
+	all := []View{}
+	positions := map[string][]int{}
+	for i, vs := range views {
+		for _, v := range vs {
+			if v == nil {
+				continue
+			}
+			all = append(all, v)
+			if ps := positions[viewID(v)]; len(ps) == 0 || ps[len(ps)-1] != i {
+				positions[viewID(v)] = append(ps, i)
+			}
+		}
+	}
+
+	// neighbors are the views that refer to each view or that it refers to.
+	graph := newDependencyGraph(all)
+	neighbors := make([][]int, len(views))
+	for i, vs := range views {
+		for _, v := range vs {
+			if v == nil {
+				continue
+			}
+			for _, dep := range graph.dependencies(v) {
+				for _, k := range positions[dep] {
+					neighbors[i] = append(neighbors[i], k)
+					neighbors[k] = append(neighbors[k], i)
+				}
+			}
+		}
+	}
+
+	// Views are visited in order, so the levels of the views before each view are already known.
+	levels := [][]int{}
+	level := make([]int, len(views))
+	for j := range views {
+		for _, i := range neighbors[j] {
+			if i < j && level[i] >= level[j] {
+				level[j] = level[i] + 1
+			}
+		}
+		if level[j] == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[level[j]] = append(levels[level[j]], j)
+	}
+
+	return levels
+}
+
+// diffLevels returns dependencyLevels of the views of diffs.
+func diffLevels(diffs []ViewDiff) [][]int {
+	views := make([][]View, len(diffs))
+	for i, d := range diffs {
+		views[i] = []View{d.Source, d.Destination}
+	}
+	return dependencyLevels(views)
+}
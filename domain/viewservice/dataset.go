@@ -0,0 +1,153 @@
+package viewservice
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+type DatasetSetting = viewmanager.DatasetSetting
+type DatasetReader = viewmanager.DatasetReader
+type DatasetWriter = viewmanager.DatasetWriter
+type DatasetReadWriter = viewmanager.DatasetReadWriter
+
+// DatasetDiff is a change to the settings of a dataset. Destination is nil when the dataset is created.
+type DatasetDiff struct {
+	Name        string
+	Source      *DatasetSetting
+	Destination *DatasetSetting
+	// Fields are the changed settings of an existing dataset, except its location.
+	Fields []FieldDiff
+	// LocationDrift is true when the dataset is in another location than Source.Location.
+	// It is not fixed by an apply, since the location of a dataset cannot be changed.
+	LocationDrift bool
+}
+
+// Changed returns whether an apply writes d.
+func (d DatasetDiff) Changed() bool {
+	return d.Destination == nil || len(d.Fields) != 0
+}
+
+// DiffDatasets returns the changes from dst to the datasets that have settings in src.
+// Datasets without settings in src are left as they are.
+func (s viewServiceImpl) DiffDatasets(ctx context.Context, src DatasetReader, dst DatasetReader) ([]DatasetDiff, error) {
+	settings, err := src.ListDatasets(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	diffs := []DatasetDiff{}
+	for i := range settings {
+		source := settings[i]
+		current, err := dst.GetDataset(ctx, source.Name)
+		if err == viewmanager.NotFoundError {
+			diffs = append(diffs, DatasetDiff{Name: source.Name, Source: &source})
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		d := DatasetDiff{
+			Name:          source.Name,
+			Source:        &source,
+			Destination:   &current,
+			Fields:        DiffMetadata(datasetFields(current), datasetFields(source)),
+			LocationDrift: source.Location != "" && !strings.EqualFold(source.Location, current.Location),
+		}
+		if d.Changed() || d.LocationDrift {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// changedDatasets returns the diffs that an apply writes, i.e. without the ones that are only location drifts.
+func changedDatasets(diffs []DatasetDiff) []DatasetDiff {
+	res := []DatasetDiff{}
+	for _, d := range diffs {
+		if d.Changed() {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// writeDatasets writes diffs in order and returns the diffs written. It stops at the first failure.
+func (s viewServiceImpl) writeDatasets(ctx context.Context, diffs []DatasetDiff, dst DatasetWriter) ([]DatasetDiff, error) {
+	written := []DatasetDiff{}
+	for _, d := range diffs {
+		if d.Destination == nil {
+			zap.L().Debug("Creating dataset", zap.String("Dataset", d.Name))
+			if err := dst.CreateDataset(ctx, *d.Source); err != nil {
+				return written, errors.WithMessagef(err, "Failed to create dataset %s", d.Name)
+			}
+		} else {
+			zap.L().Debug("Updating dataset", zap.String("Dataset", d.Name))
+			if err := dst.UpdateDataset(ctx, *d.Source); err != nil {
+				return written, errors.WithMessagef(err, "Failed to update dataset %s", d.Name)
+			}
+		}
+		written = append(written, d)
+	}
+	return written, nil
+}
+
+// revertDatasets restores the previous settings of the updated datasets in written, in reverse order,
+// and returns the diffs reverted and the ones that could not be reverted with the error.
+// Created datasets are kept, since they are empty once the views created in them are rolled back.
+func (s viewServiceImpl) revertDatasets(ctx context.Context, written []DatasetDiff, dst DatasetWriter) ([]DatasetDiff, []DatasetDiff, error) {
+	reverted, failed := []DatasetDiff{}, []DatasetDiff{}
+	var errs []error
+	for i := len(written) - 1; i >= 0; i-- {
+		d := written[i]
+		if d.Destination == nil {
+			continue
+		}
+		zap.L().Debug("Rolling back dataset", zap.String("Dataset", d.Name))
+		if err := dst.UpdateDataset(ctx, *d.Destination); err != nil {
+			failed = append(failed, d)
+			errs = append(errs, errors.WithMessagef(err, "dataset %s", d.Name))
+			continue
+		}
+		reverted = append(reverted, d)
+	}
+	return reverted, failed, multierr.Combine(errs...)
+}
+
+// CopyDatasets writes the settings of the datasets in src to dst.
+func (s viewServiceImpl) CopyDatasets(ctx context.Context, src DatasetReader, dst DatasetWriter) error {
+	settings, err := src.ListDatasets(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, setting := range settings {
+		if err := dst.CreateDataset(ctx, setting); err != nil {
+			return errors.WithMessagef(err, "Failed to write dataset %s", setting.Name)
+		}
+	}
+	return nil
+}
+
+// datasetFields returns the settings of a dataset that are diffed, as metadata of a view is.
+func datasetFields(setting DatasetSetting) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if setting.Description != "" {
+		fields["description"] = setting.Description
+	}
+	if len(setting.Labels) != 0 {
+		labels := map[string]interface{}{}
+		for k, v := range setting.Labels {
+			labels[k] = v
+		}
+		fields["labels"] = labels
+	}
+	if setting.DefaultTableExpiration != 0 {
+		fields["default_table_expiration"] = setting.DefaultTableExpiration.String()
+	}
+	return fields
+}
@@ -0,0 +1,110 @@
+package viewservice
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rerost/bqv/domain/sqlref"
+)
+
+// CycleError is returned when managed views reference each other.
+type CycleError struct {
+	Cycle []string
+}
+
+func (e CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle detected: %s", strings.Join(e.Cycle, " -> "))
+}
+
+func viewID(v View) string {
+	return v.DataSet() + "." + v.Name()
+}
+
+// Dependencies returns IDs (`<dataset>.<name>`) of the views in `views` that `view` refers to,
+// including the routines that it calls.
+func Dependencies(view View, views []View) []string {
+	return newDependencyGraph(views).dependencies(view)
+}
+
+// dependencyGraph finds the references between a set of views. Build it once for the set instead of calling Dependencies for each view.
+type dependencyGraph struct {
+	managed map[string]bool
+}
+
+func newDependencyGraph(views []View) dependencyGraph {
+	managed := make(map[string]bool, len(views))
+	for _, v := range views {
+		if v != nil {
+			managed[viewID(v)] = true
+		}
+	}
+	return dependencyGraph{managed: managed}
+}
+
+// dependencies returns IDs of the views in the graph that view refers to.
+func (g dependencyGraph) dependencies(view View) []string {
+	deps := []string{}
+	seen := map[string]bool{viewID(view): true}
+	for _, ref := range append(sqlref.Find(view.Query()), sqlref.FindCalls(view.Query())...) {
+		id := ref.ID()
+		if !g.managed[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		deps = append(deps, id)
+	}
+	return deps
+}
+
+// sortByDependency sorts views so that every view comes after the views it refers to.
+// The original order is kept as much as possible.
+func sortByDependency(views []View) ([]View, error) {
+	byID := make(map[string]View, len(views))
+	for _, v := range views {
+		byID[viewID(v)] = v
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	graph := newDependencyGraph(views)
+	state := make(map[string]int, len(views))
+	sorted := make([]View, 0, len(views))
+	stack := []string{}
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			for i, s := range stack {
+				if s == id {
+					return CycleError{Cycle: append(append([]string{}, stack[i:]...), id)}
+				}
+			}
+		}
+
+		state[id] = visiting
+		stack = append(stack, id)
+		for _, dep := range graph.dependencies(byID[id]) {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = visited
+		sorted = append(sorted, byID[id])
+		return nil
+	}
+
+	for _, v := range views {
+		if err := visit(viewID(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
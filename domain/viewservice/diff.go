@@ -0,0 +1,144 @@
+package viewservice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/textdiff"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// DiffContext is the number of context lines in ViewDiff.Query.
+const DiffContext = 3
+
+// ViewDiff is the difference of a view from destination to source.
+// A view is added (ActionCreate) when it exists only in source, removed (ActionDelete) when it exists only in destination,
+// and modified (ActionUpdateQuery and/or ActionUpdateMetadata) otherwise. Source or Destination is nil accordingly.
+type ViewDiff struct {
+	DataSet     string
+	Name        string
+	Actions     []Action
+	Source      View
+	Destination View
+	Query       []textdiff.Hunk
+	// Fields are the changed metadata fields of a modified view.
+	Fields []FieldDiff
+}
+
+func newViewDiff(source View, destination View) ViewDiff {
+	d := ViewDiff{
+		Source:      source,
+		Destination: destination,
+	}
+	if source != nil {
+		d.DataSet, d.Name = source.DataSet(), source.Name()
+	} else if destination != nil {
+		d.DataSet, d.Name = destination.DataSet(), destination.Name()
+	}
+
+	before, after := NewDefinition(destination), NewDefinition(source)
+	d.Actions = planActions(before, after)
+
+	var beforeQuery, afterQuery string
+	if before != nil {
+		beforeQuery = before.Query
+	}
+	if after != nil {
+		afterQuery = after.Query
+	}
+	d.Query = textdiff.Hunks(beforeQuery, afterQuery, DiffContext)
+	if before != nil && after != nil {
+		d.Fields = DiffMetadata(before.Metadata, after.Metadata)
+	}
+
+	return d
+}
+
+func (d ViewDiff) Has(action Action) bool {
+	for _, a := range d.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+type Summary struct {
+	Create int `json:"create" yaml:"create"`
+	Change int `json:"change" yaml:"change"`
+	Delete int `json:"delete" yaml:"delete"`
+}
+
+func Summarize(diffs []ViewDiff) Summary {
+	var s Summary
+	for _, d := range diffs {
+		switch {
+		case d.Has(ActionCreate):
+			s.Create++
+		case d.Has(ActionDelete):
+			s.Delete++
+		case len(d.Actions) != 0:
+			s.Change++
+		}
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d to create, %d to change, %d to delete", s.Create, s.Change, s.Delete)
+}
+
+// Diff returns the changes from dst to src in the order they should be applied.
+// Views that exist only in dst are reported as deletions when they are in a dataset that src manages.
+func (s viewServiceImpl) Diff(ctx context.Context, src ViewReader, dst ViewReader) ([]ViewDiff, error) {
+	return s.diff(ctx, src, dst)
+}
+
+func (s viewServiceImpl) diff(ctx context.Context, src ViewReader, dst ViewReader) ([]ViewDiff, error) {
+	zap.L().Debug("Start Diff")
+	srcList, err := src.List(ctx)
+	if err != nil {
+		zap.L().Debug("Failed to List", zap.String("src type", fmt.Sprintf("%T", src)))
+		return nil, errors.WithStack(err)
+	}
+
+	srcList, err = sortByDependency(srcList)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	dstViews := make([]View, len(srcList))
+	errs := s.forEach(len(srcList), func(i int) error {
+		v, err := viewmanager.GetAs(ctx, dst, srcList[i].DataSet(), srcList[i].Name(), viewmanager.IsRoutine(srcList[i]))
+		if err == viewmanager.NotFoundError {
+			return nil
+		}
+		dstViews[i] = v
+		return err
+	})
+	if err := multierr.Combine(errs...); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	diffs := []ViewDiff{}
+	for i, srcView := range srcList {
+		d := newViewDiff(srcView, dstViews[i])
+		if len(d.Actions) == 0 {
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+
+	orphans, err := s.orphans(ctx, srcList, dst)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, orphan := range orphans {
+		diffs = append(diffs, newViewDiff(nil, orphan))
+	}
+
+	return diffs, nil
+}
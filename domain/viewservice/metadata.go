@@ -0,0 +1,62 @@
+package viewservice
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// FieldDiff is a change to a metadata field. Field is a dotted path such as `labels.env`.
+// Before is nil when the field is added, and After is nil when the field is removed.
+type FieldDiff struct {
+	Field  string      `json:"field" yaml:"field"`
+	Before interface{} `json:"before,omitempty" yaml:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" yaml:"after,omitempty"`
+}
+
+// DiffMetadata returns changed fields from before to after, sorted by field.
+// Nested maps are compared per key, and other values (including lists) are compared as a whole.
+func DiffMetadata(before, after map[string]interface{}) []FieldDiff {
+	b, a := map[string]interface{}{}, map[string]interface{}{}
+	flatten("", before, b)
+	flatten("", after, a)
+
+	fields := []string{}
+	for k := range b {
+		fields = append(fields, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	diffs := []FieldDiff{}
+	for _, f := range fields {
+		if equalValue(b[f], a[f]) {
+			continue
+		}
+		diffs = append(diffs, FieldDiff{Field: f, Before: b[f], After: a[f]})
+	}
+	return diffs
+}
+
+func flatten(prefix string, md map[string]interface{}, out map[string]interface{}) {
+	for k, v := range md {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			flatten(key, m, out)
+			continue
+		}
+		out[key] = v
+	}
+}
+
+func equalValue(v1, v2 interface{}) bool {
+	b1, err1 := json.Marshal(v1)
+	b2, err2 := json.Marshal(v2)
+	return err1 == nil && err2 == nil && string(b1) == string(b2)
+}
@@ -0,0 +1,323 @@
+package viewservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+// PlanVersion is the version of the plan file format.
+const PlanVersion = 1
+
+type Action string
+
+const (
+	ActionCreate         Action = "create"
+	ActionUpdateQuery    Action = "update_query"
+	ActionUpdateMetadata Action = "update_metadata"
+	ActionDelete         Action = "delete"
+	// ActionRecreate is with ActionUpdateQuery or ActionUpdateMetadata when the view is dropped and created again to change it.
+	// See viewmanager.RequiresRecreate.
+	ActionRecreate Action = "recreate"
+)
+
+// Definition is the managed content of a view.
+type Definition struct {
+	Query    string                 `json:"query"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// PlannedChange is a change to one view.
+// Fingerprint is the fingerprint of the destination view when the plan was made. It is empty if the view did not exist.
+// ETag is the etag of the destination view when the plan was made, if the destination is BigQuery.
+// The view is updated or deleted only if it still has the etag.
+type PlannedChange struct {
+	DataSet     string      `json:"dataset"`
+	Name        string      `json:"name"`
+	Actions     []Action    `json:"actions"`
+	Before      *Definition `json:"before,omitempty"`
+	After       *Definition `json:"after,omitempty"`
+	Fingerprint string      `json:"fingerprint"`
+	ETag        string      `json:"etag,omitempty"`
+}
+
+// PlannedDatasetChange is a change to the settings of a dataset. Before is nil if the dataset did not exist.
+// The dataset is written only if it still has the settings of Before.
+type PlannedDatasetChange struct {
+	Name   string          `json:"name"`
+	Before *DatasetSetting `json:"before,omitempty"`
+	After  DatasetSetting  `json:"after"`
+}
+
+type Plan struct {
+	Version   int                    `json:"version"`
+	CreatedAt time.Time              `json:"created_at"`
+	Datasets  []PlannedDatasetChange `json:"datasets,omitempty"`
+	Changes   []PlannedChange        `json:"changes"`
+}
+
+// DriftError is returned when the destination changed after the plan was made.
+// Views are <dataset>.<name> of the views and the names of the datasets that changed.
+type DriftError struct {
+	Views []string
+}
+
+func (e DriftError) Error() string {
+	return fmt.Sprintf("destination changed since the plan was made: %s", strings.Join(e.Views, ", "))
+}
+
+// NewDefinition returns the managed content of view. It returns nil if view is nil.
+func NewDefinition(view View) *Definition {
+	if view == nil {
+		return nil
+	}
+	return &Definition{
+		Query:    view.Query(),
+		Metadata: viewmanager.ManagedMetadata(view.Setting()),
+	}
+}
+
+// Fingerprint returns a hash of the managed content of view. It returns "" if view is nil.
+func Fingerprint(view View) (string, error) {
+	d := NewDefinition(view)
+	if d == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", errors.WithMessagef(err, "Failed to marshal %s.%s", view.DataSet(), view.Name())
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s viewServiceImpl) Plan(ctx context.Context, src ViewReader, dst ViewReader, opts ApplyOptions) (Plan, error) {
+	diffs, err := s.diff(ctx, src, dst)
+	if err != nil {
+		return Plan{}, errors.WithStack(err)
+	}
+
+	plan := Plan{
+		Version:   PlanVersion,
+		CreatedAt: time.Now(),
+		Changes:   []PlannedChange{},
+	}
+	for _, d := range changedDatasets(opts.Datasets) {
+		plan.Datasets = append(plan.Datasets, PlannedDatasetChange{Name: d.Name, Before: d.Destination, After: *d.Source})
+	}
+	for _, d := range diffs {
+		if d.Has(ActionDelete) && !opts.Prune {
+			continue
+		}
+		fingerprint, err := Fingerprint(d.Destination)
+		if err != nil {
+			return Plan{}, errors.WithStack(err)
+		}
+		plan.Changes = append(plan.Changes, PlannedChange{
+			DataSet:     d.DataSet,
+			Name:        d.Name,
+			Actions:     d.Actions,
+			Before:      NewDefinition(d.Destination),
+			After:       NewDefinition(d.Source),
+			Fingerprint: fingerprint,
+			ETag:        viewmanager.ETagOf(d.Destination),
+		})
+	}
+
+	return plan, nil
+}
+
+// DatasetDiffs returns the changes to the settings of datasets in p.
+func (p Plan) DatasetDiffs() []DatasetDiff {
+	diffs := make([]DatasetDiff, 0, len(p.Datasets))
+	for _, c := range p.Datasets {
+		after := c.After
+		after.Name = c.Name
+		d := DatasetDiff{Name: c.Name, Source: &after}
+		if c.Before != nil {
+			before := *c.Before
+			before.Name = c.Name
+			d.Destination = &before
+			d.Fields = DiffMetadata(datasetFields(before), datasetFields(after))
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+func (p Plan) Summary() Summary {
+	var s Summary
+	for _, c := range p.Changes {
+		switch {
+		case c.Before == nil:
+			s.Create++
+		case c.After == nil:
+			s.Delete++
+		default:
+			s.Change++
+		}
+	}
+	return s
+}
+
+func planActions(before, after *Definition) []Action {
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []Action{ActionCreate}
+	case after == nil:
+		return []Action{ActionDelete}
+	}
+
+	actions := []Action{}
+	if before.Query != after.Query {
+		actions = append(actions, ActionUpdateQuery)
+	}
+	if len(DiffMetadata(before.Metadata, after.Metadata)) != 0 {
+		actions = append(actions, ActionUpdateMetadata)
+	}
+	if viewmanager.RequiresRecreate(before.Query, before.Metadata, after.Query, after.Metadata) {
+		actions = append(actions, ActionRecreate)
+	}
+	return actions
+}
+
+// ApplyPlan applies plan if dst has not changed since the plan was made.
+// Deletions in the plan are confirmed with opts.Confirm. opts.Prune and opts.Datasets are ignored because the plan already decided them.
+func (s viewServiceImpl) ApplyPlan(ctx context.Context, plan Plan, dst ViewReadWriter, opts ApplyOptions) error {
+	if plan.Version != PlanVersion {
+		return errors.Errorf("unsupported plan version %d (expected %d)", plan.Version, PlanVersion)
+	}
+
+	datasets := plan.DatasetDiffs()
+	drifted, err := s.driftedDatasets(ctx, datasets, dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, change := range plan.Changes {
+		current, err := viewmanager.GetAs(ctx, dst, change.DataSet, change.Name, change.routine())
+		if err == viewmanager.NotFoundError {
+			current, err = nil, nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fingerprint, err := Fingerprint(current)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fingerprint != change.Fingerprint {
+			drifted = append(drifted, change.DataSet+"."+change.Name)
+		}
+	}
+	if len(drifted) != 0 {
+		return errors.WithStack(DriftError{Views: drifted})
+	}
+
+	diffs := make([]ViewDiff, 0, len(plan.Changes))
+	deletions := []ViewDiff{}
+	for _, change := range plan.Changes {
+		d := newViewDiff(change.view(change.After, ""), change.view(change.Before, change.ETag))
+		diffs = append(diffs, d)
+		if d.Has(ActionDelete) {
+			deletions = append(deletions, d)
+		}
+	}
+	if !opts.SkipValidation {
+		if err := s.preflight(ctx, diffs, dst); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	_, err = s.commit(ctx, diffs, deletions, datasets, dst, opts)
+	return errors.WithStack(err)
+}
+
+// driftedDatasets returns the names of the datasets in diffs whose settings in dst are no longer their destinations.
+func (s viewServiceImpl) driftedDatasets(ctx context.Context, diffs []DatasetDiff, dst ViewReader) ([]string, error) {
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+	r, ok := dst.(DatasetReader)
+	if !ok {
+		return nil, errors.Errorf("%T cannot read the settings of datasets", dst)
+	}
+
+	var drifted []string
+	for _, d := range diffs {
+		current, err := r.GetDataset(ctx, d.Name)
+		if err == viewmanager.NotFoundError {
+			if d.Destination != nil {
+				drifted = append(drifted, d.Name)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if d.Destination == nil || len(DiffMetadata(datasetFields(*d.Destination), datasetFields(current))) != 0 {
+			drifted = append(drifted, d.Name)
+		}
+	}
+	return drifted, nil
+}
+
+// routine returns whether the view of c is a routine.
+func (c PlannedChange) routine() bool {
+	d := c.After
+	if d == nil {
+		d = c.Before
+	}
+	return d != nil && viewmanager.IsRoutine(c.view(d, ""))
+}
+
+// view returns the view of d with etag. It returns nil if d is nil.
+func (c PlannedChange) view(d *Definition, etag string) View {
+	if d == nil {
+		return nil
+	}
+	return planView{
+		dataSet:    c.DataSet,
+		name:       c.Name,
+		definition: *d,
+		etag:       etag,
+	}
+}
+
+type planView struct {
+	dataSet    string
+	name       string
+	definition Definition
+	etag       string
+}
+
+func (p planView) ETag() string {
+	return p.etag
+}
+
+func (p planView) DataSet() string {
+	return p.dataSet
+}
+
+func (p planView) Name() string {
+	return p.name
+}
+
+func (p planView) Query() string {
+	return p.definition.Query
+}
+
+func (p planView) Setting() viewmanager.Setting {
+	return p
+}
+
+func (p planView) Metadata() map[string]interface{} {
+	return p.definition.Metadata
+}
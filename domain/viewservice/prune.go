@@ -0,0 +1,70 @@
+package viewservice
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+	"go.uber.org/zap"
+)
+
+// orphans returns views in dst that are not in srcList, in datasets that srcList manages.
+// Protected views are excluded. Views are ordered so that dependents come first, which is the order to delete them.
+// Only the views missing from srcList are read if dst is a viewmanager.MatchingLister.
+func (s viewServiceImpl) orphans(ctx context.Context, srcList []View, dst ViewReader) ([]View, error) {
+	managed := map[string]bool{}
+	exists := map[string]bool{}
+	datasets := []string{}
+	for _, v := range srcList {
+		if !managed[v.DataSet()] {
+			datasets = append(datasets, v.DataSet())
+		}
+		managed[v.DataSet()] = true
+		exists[viewID(v)] = true
+	}
+
+	var dstList []View
+	var err error
+	if l, ok := dst.(viewmanager.MatchingLister); ok {
+		dstList, err = l.ListMatching(ctx, datasets, func(dataset, name string) bool {
+			return !exists[dataset+"."+name]
+		})
+	} else {
+		dstList, err = dst.List(ctx)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	orphans := []View{}
+	for _, v := range dstList {
+		if !managed[v.DataSet()] || exists[viewID(v)] {
+			continue
+		}
+		if s.isProtected(v) {
+			zap.L().Debug("Skip protected view", zap.String("Dataset", v.DataSet()), zap.String("Table", v.Name()))
+			continue
+		}
+		orphans = append(orphans, v)
+	}
+
+	orphans, err = sortByDependency(orphans)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for i, j := 0, len(orphans)-1; i < j; i, j = i+1, j-1 {
+		orphans[i], orphans[j] = orphans[j], orphans[i]
+	}
+
+	return orphans, nil
+}
+
+func (s viewServiceImpl) isProtected(v View) bool {
+	for _, pattern := range s.protected {
+		if ok, _ := path.Match(pattern, viewID(v)); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package viewservice
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+// Snapshot is a view at some point. View is nil if the view did not exist.
+// Routine is whether the view is a routine, which is looked up apart from views (see viewmanager.GetAs).
+type Snapshot struct {
+	DataSet string
+	Name    string
+	View    View
+	Routine bool
+}
+
+// Restore writes opts.Datasets and then snapshots to dst in reverse order, so that snapshots taken in apply order are undone in the opposite order.
+// Views in snapshots that are nil are deleted. Views that are the same as the snapshot are skipped.
+// Deletions are confirmed with opts.Confirm, and opts.Prune and opts.SkipValidation are ignored.
+func (s viewServiceImpl) Restore(ctx context.Context, snapshots []Snapshot, dst ViewReadWriter, opts ApplyOptions) (Result, error) {
+	diffs := []ViewDiff{}
+	deletions := []ViewDiff{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		routine := snapshot.Routine || (snapshot.View != nil && viewmanager.IsRoutine(snapshot.View))
+		current, err := viewmanager.GetAs(ctx, dst, snapshot.DataSet, snapshot.Name, routine)
+		if err == viewmanager.NotFoundError {
+			current, err = nil, nil
+		}
+		if err != nil {
+			return Result{}, errors.WithStack(err)
+		}
+
+		d := newViewDiff(snapshot.View, current)
+		if len(d.Actions) == 0 {
+			continue
+		}
+		diffs = append(diffs, d)
+		if d.Has(ActionDelete) {
+			deletions = append(deletions, d)
+		}
+	}
+
+	res, err := s.commit(ctx, diffs, deletions, changedDatasets(opts.Datasets), dst, opts)
+	return res, errors.WithStack(err)
+}
@@ -0,0 +1,111 @@
+package viewservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// RollbackError is returned by an atomic apply that failed.
+// The changes applied before the failure are reverted in reverse order.
+type RollbackError struct {
+	// Failed is the change that failed with Err.
+	Failed ViewDiff
+	Err    error
+	// RolledBack are the changes that were reverted.
+	RolledBack []ViewDiff
+	// NotRolledBack are the changes that could not be reverted with RollbackErr. They are still applied.
+	NotRolledBack []ViewDiff
+	RollbackErr   error
+	// RolledBackDatasets are the updated datasets whose settings were restored. Created datasets are kept.
+	RolledBackDatasets []DatasetDiff
+	// NotRolledBackDatasets are the datasets whose settings could not be restored with DatasetRollbackErr.
+	NotRolledBackDatasets []DatasetDiff
+	DatasetRollbackErr    error
+}
+
+func (e RollbackError) Error() string {
+	msg := fmt.Sprintf("failed to apply %s.%s: %v; rolled back %d views", e.Failed.DataSet, e.Failed.Name, e.Err, len(e.RolledBack))
+	if len(e.NotRolledBack) != 0 {
+		ids := make([]string, 0, len(e.NotRolledBack))
+		for _, d := range e.NotRolledBack {
+			ids = append(ids, d.DataSet+"."+d.Name)
+		}
+		msg += fmt.Sprintf("; failed to roll back %s: %v", strings.Join(ids, ", "), e.RollbackErr)
+	}
+	if len(e.NotRolledBackDatasets) != 0 {
+		names := make([]string, 0, len(e.NotRolledBackDatasets))
+		for _, d := range e.NotRolledBackDatasets {
+			names = append(names, d.Name)
+		}
+		msg += fmt.Sprintf("; failed to roll back datasets %s: %v", strings.Join(names, ", "), e.DatasetRollbackErr)
+	}
+	return msg
+}
+
+// writeAll writes diffs in order and returns the diffs written.
+// Diffs that do not depend on each other are written at once, up to s.concurrency.
+// Unless atomic, it writes as many as possible and returns the combined errors.
+// If atomic, it stops after the first failure and reverts the diffs written so far, returning RollbackError.
+func (s viewServiceImpl) writeAll(ctx context.Context, diffs []ViewDiff, dst ViewWriter, atomic bool) ([]ViewDiff, error) {
+	applied := []ViewDiff{}
+	var errs []error
+	for _, level := range diffLevels(diffs) {
+		results := s.forEach(len(level), func(i int) error {
+			return s.write(ctx, diffs[level[i]], dst)
+		})
+
+		var failed *ViewDiff
+		var cause error
+		for i, err := range results {
+			d := diffs[level[i]]
+			if err == nil {
+				applied = append(applied, d)
+				continue
+			}
+
+			zap.L().Debug("Failed to apply view", zap.String("Dataset", d.DataSet), zap.String("Table", d.Name))
+			if atomic {
+				// Views written at once may fail together. The first one is reported as the failure.
+				if failed == nil {
+					failed = &d
+				}
+				cause = multierr.Append(cause, err)
+				continue
+			}
+			errs = append(errs, errors.WithStack(err))
+		}
+		if failed != nil {
+			return nil, errors.WithStack(s.rollback(ctx, applied, *failed, cause, dst))
+		}
+	}
+
+	return applied, errors.WithStack(multierr.Combine(errs...))
+}
+
+// rollback reverts applied in reverse order: created views are deleted, and updated or deleted views are restored.
+func (s viewServiceImpl) rollback(ctx context.Context, applied []ViewDiff, failed ViewDiff, cause error, dst ViewWriter) RollbackError {
+	e := RollbackError{Failed: failed, Err: cause}
+	var errs []error
+	for i := len(applied) - 1; i >= 0; i-- {
+		d := applied[i]
+		zap.L().Debug("Rolling back view", zap.String("Dataset", d.DataSet), zap.String("Table", d.Name))
+		if err := s.write(ctx, d.reverse(), dst); err != nil {
+			e.NotRolledBack = append(e.NotRolledBack, d)
+			errs = append(errs, errors.WithMessagef(err, "%s.%s", d.DataSet, d.Name))
+			continue
+		}
+		e.RolledBack = append(e.RolledBack, d)
+	}
+	e.RollbackErr = multierr.Combine(errs...)
+	return e
+}
+
+// reverse returns the change that reverts d.
+func (d ViewDiff) reverse() ViewDiff {
+	return newViewDiff(d.Destination, d.Source)
+}
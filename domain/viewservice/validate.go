@@ -0,0 +1,130 @@
+package viewservice
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/viewmanager"
+)
+
+type Validator = viewmanager.Validator
+
+// Validation is the result of a dry run of a view.
+type Validation struct {
+	DataSet             string
+	Name                string
+	TotalBytesProcessed int64
+	// Err is why the query is invalid. It is nil if the query is valid or skipped.
+	Err *viewmanager.QueryError
+	// SkippedBy is the view that the query refers to and that does not exist yet.
+	// The query cannot be dry-run until the view is created.
+	SkippedBy string
+}
+
+func (v Validation) Valid() bool {
+	return v.Err == nil
+}
+
+// ValidationError is returned when a view to apply is invalid. Nothing is written.
+type ValidationError struct {
+	Validations []Validation
+}
+
+func (e ValidationError) Error() string {
+	invalid := []string{}
+	for _, v := range e.Validations {
+		if !v.Valid() {
+			invalid = append(invalid, fmt.Sprintf("%s.%s: %s", v.DataSet, v.Name, v.Err))
+		}
+	}
+	return fmt.Sprintf("%d views are invalid:\n%s", len(invalid), strings.Join(invalid, "\n"))
+}
+
+// Validate dry-runs every view in src against v, which is the destination of src.
+// A view that refers to a view in src missing from dst is skipped.
+func (s viewServiceImpl) Validate(ctx context.Context, src ViewReader, dst ViewReader, v Validator) ([]Validation, error) {
+	views, err := src.List(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	views, err = sortByDependency(views)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	diffs, err := s.diff(ctx, src, dst)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return s.validate(ctx, views, diffs, v)
+}
+
+// validate dry-runs views. diffs are the changes to the destination, which tell the views that do not exist yet.
+func (s viewServiceImpl) validate(ctx context.Context, views []View, diffs []ViewDiff, v Validator) ([]Validation, error) {
+	missing := map[string]bool{}
+	sources := []View{}
+	for _, d := range diffs {
+		if d.Has(ActionCreate) {
+			missing[d.DataSet+"."+d.Name] = true
+		}
+		if d.Source != nil {
+			sources = append(sources, d.Source)
+		}
+	}
+
+	graph := newDependencyGraph(sources)
+	validations := make([]Validation, 0, len(views))
+	for _, view := range views {
+		validation := Validation{DataSet: view.DataSet(), Name: view.Name()}
+		for _, dep := range graph.dependencies(view) {
+			if missing[dep] {
+				validation.SkippedBy = dep
+				break
+			}
+		}
+		if validation.SkippedBy == "" {
+			bytes, err := v.Validate(ctx, view)
+			if qerr, ok := err.(*viewmanager.QueryError); ok {
+				validation.Err = qerr
+			} else if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			validation.TotalBytesProcessed = bytes
+		}
+		validations = append(validations, validation)
+	}
+	return validations, nil
+}
+
+// preflight dry-runs the views that diffs create or update if dst is a Validator.
+// Views with only metadata changes are dry-run as well, since their metadata may refer to columns of the query.
+// It returns ValidationError if any of them is invalid.
+func (s viewServiceImpl) preflight(ctx context.Context, diffs []ViewDiff, dst interface{}) error {
+	v, ok := dst.(Validator)
+	if !ok {
+		return nil
+	}
+
+	views := []View{}
+	for _, d := range diffs {
+		if d.Source != nil && (d.Has(ActionCreate) || d.Has(ActionUpdateQuery) || d.Has(ActionUpdateMetadata)) {
+			views = append(views, d.Source)
+		}
+	}
+	if len(views) == 0 {
+		return nil
+	}
+
+	validations, err := s.validate(ctx, views, diffs, v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, validation := range validations {
+		if !validation.Valid() {
+			return errors.WithStack(ValidationError{Validations: validations})
+		}
+	}
+	return nil
+}
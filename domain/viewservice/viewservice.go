@@ -2,9 +2,7 @@ package viewservice
 
 import (
 	"context"
-	"fmt"
 
-	"github.com/google/go-cmp/cmp"
 	"github.com/pkg/errors"
 	"github.com/rerost/bqv/domain/viewmanager"
 	"go.uber.org/multierr"
@@ -18,51 +16,69 @@ type ViewReader = viewmanager.ViewReader
 
 type ViewService interface {
 	List(ctx context.Context, src ViewReader) ([]View, error)
-	Diff(ctx context.Context, src ViewReader, dst ViewReader) ([]View, error)
+	Diff(ctx context.Context, src ViewReader, dst ViewReader) ([]ViewDiff, error)
 	Copy(ctx context.Context, src ViewReader, dst ViewWriter) error
+	Apply(ctx context.Context, src ViewReader, dst ViewReadWriter, opts ApplyOptions) (Result, error)
+	Plan(ctx context.Context, src ViewReader, dst ViewReader, opts ApplyOptions) (Plan, error)
+	ApplyPlan(ctx context.Context, plan Plan, dst ViewReadWriter, opts ApplyOptions) error
+	Validate(ctx context.Context, src ViewReader, dst ViewReader, v Validator) ([]Validation, error)
+	Restore(ctx context.Context, snapshots []Snapshot, dst ViewReadWriter, opts ApplyOptions) (Result, error)
+	DiffDatasets(ctx context.Context, src DatasetReader, dst DatasetReader) ([]DatasetDiff, error)
+	CopyDatasets(ctx context.Context, src DatasetReader, dst DatasetWriter) error
 }
 
-type viewServiceImpl struct {
-	source      ViewReader
-	destination ViewWriter
+type ApplyOptions struct {
+	// Prune deletes views that exist only in the destination, in datasets that the source manages.
+	Prune bool
+	// Confirm is called with the views to be deleted before anything is written. Nothing is written unless it returns true.
+	// Deletions are not confirmed when Confirm is nil.
+	Confirm func(deletions []ViewDiff) bool
+	// SkipValidation skips the dry run of the views to create or update.
+	// Otherwise nothing is written if any of them is invalid, when the destination is a Validator.
+	SkipValidation bool
+	// Atomic stops at the first failure and reverts the changes applied before it. See RollbackError.
+	Atomic bool
+	// Datasets are the changes to the settings of datasets (see DiffDatasets), which are written before the views.
+	// Location drifts are not written. The destination must be a DatasetWriter if any is written.
+	Datasets []DatasetDiff
+	// BeforeWrite is called with the changes to views and datasets after they are confirmed and before anything is written.
+	// Nothing is written if it returns an error. It is not called when there are no changes.
+	BeforeWrite func(changes []ViewDiff, datasets []DatasetDiff) error
 }
 
-func NewService() ViewService {
-	return viewServiceImpl{}
+// Result is the changes that an apply wrote.
+type Result struct {
+	Datasets []DatasetDiff
+	Views    []ViewDiff
 }
 
-func (s viewServiceImpl) List(ctx context.Context, src ViewReader) ([]View, error) {
-	return src.List(ctx)
-}
+var AbortedError = errors.New("Aborted")
 
-func (s viewServiceImpl) Diff(ctx context.Context, src ViewReader, dst ViewReader) ([]View, error) {
-	zap.L().Debug("Start Diff")
-	srcList, err := src.List(ctx)
-	if err != nil {
-		zap.L().Debug("Failed to List", zap.String("src type", fmt.Sprintf("%T", src)))
-		return nil, errors.WithStack(err)
+type Option func(*viewServiceImpl)
+
+// WithProtected protects views matching patterns from being deleted.
+// Patterns are `<dataset>.<name>` in path.Match syntax, e.g. `reporting.*`.
+func WithProtected(patterns ...string) Option {
+	return func(s *viewServiceImpl) {
+		s.protected = append(s.protected, patterns...)
 	}
+}
 
-	diffViews := []View{}
-	for _, srcView := range srcList {
-		dstView, err := dst.Get(ctx, srcView.DataSet(), srcView.Name())
-		if err == viewmanager.NotFoundError {
-			err = nil
-			diffView, err := diff(srcView, nil)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-			diffViews = append(diffViews, diffView)
-		}
-		diffView, err := diff(srcView, dstView)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
+type viewServiceImpl struct {
+	protected   []string
+	concurrency int
+}
 
-		diffViews = append(diffViews, diffView)
+func NewService(opts ...Option) ViewService {
+	s := viewServiceImpl{concurrency: 1}
+	for _, opt := range opts {
+		opt(&s)
 	}
+	return s
+}
 
-	return diffViews, nil
+func (s viewServiceImpl) List(ctx context.Context, src ViewReader) ([]View, error) {
+	return src.List(ctx)
 }
 
 func (s viewServiceImpl) copy(ctx context.Context, item viewmanager.View, dst ViewWriter) error {
@@ -91,120 +107,115 @@ func (s viewServiceImpl) Copy(ctx context.Context, src ViewReader, dst ViewWrite
 		return errors.WithStack(err)
 	}
 
-	var errs []error
-	for _, srcView := range srcList {
-		err := s.copy(ctx, srcView, dst)
-		if err != nil {
-			zap.L().Debug("Failed to copy view", zap.String("Dataset", srcView.DataSet()), zap.String("Table", srcView.Name()))
-			errs = append(errs, errors.WithStack(err))
-		}
-	}
-
-	return errors.WithStack(multierr.Combine(errs...))
-}
-
-func (s viewServiceImpl) DeleteOld(ctx context.Context, src ViewReader, dst ViewReadWriter) error {
-	srcList, err := src.List(ctx)
+	srcList, err = sortByDependency(srcList)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	dstList, err := dst.List(ctx)
-	if err != nil {
-		return errors.WithStack(err)
+
+	views := make([][]View, len(srcList))
+	for i, v := range srcList {
+		views[i] = []View{v}
 	}
 
-	for _, dstView := range dstList {
-		if !matchInclude(dstView, srcList) {
-			err := dst.Delete(ctx, dstView)
+	var errs []error
+	for _, level := range dependencyLevels(views) {
+		results := s.forEach(len(level), func(i int) error {
+			return s.copy(ctx, srcList[level[i]], dst)
+		})
+		for i, err := range results {
 			if err != nil {
-				return errors.WithStack(err)
+				srcView := srcList[level[i]]
+				zap.L().Debug("Failed to copy view", zap.String("Dataset", srcView.DataSet()), zap.String("Table", srcView.Name()))
+				errs = append(errs, errors.WithStack(err))
 			}
 		}
 	}
 
-	return nil
-}
-
-type diffView struct {
-	dataSet string
-	name    string
-	query   string
-}
-
-func (d diffView) DataSet() string {
-	return d.dataSet
-}
-
-func (d diffView) Name() string {
-	return d.name
-}
-
-func (d diffView) Query() string {
-	return d.query
+	return errors.WithStack(multierr.Combine(errs...))
 }
 
-func (d diffView) Setting() viewmanager.Setting {
-	panic("NOT IMPLEMENTED") // TODO(@rerost)
-}
+// Apply writes opts.Datasets and then only the views that differ between src and dst, in dependency order.
+// Views that exist only in dst are deleted when opts.Prune is set.
+// It returns the changes that were applied successfully, which are none when opts.Atomic is set and it failed.
+func (s viewServiceImpl) Apply(ctx context.Context, src ViewReader, dst ViewReadWriter, opts ApplyOptions) (Result, error) {
+	diffs, err := s.diff(ctx, src, dst)
+	if err != nil {
+		return Result{}, errors.WithStack(err)
+	}
 
-func diff(source View, destination View) (diffView, error) {
-	if source == nil && destination == nil {
-		return diffView{}, nil
-	}
-	if source == nil {
-		return diffView{
-			dataSet: destination.DataSet(),
-			name:    destination.Name(),
-			query:   destination.Query(),
-		}, nil
-	}
-	if destination == nil {
-		return diffView{
-			dataSet: source.DataSet(),
-			name:    source.Name(),
-			query:   source.Query(),
-		}, nil
-	}
-	if !match(source, destination) {
-		zap.L().Debug(
-			"Failed to diff",
-			zap.String("source name", source.Name()),
-			zap.String("destination name", destination.Name()),
-			zap.String("source dataset", source.DataSet()),
-			zap.String("destination dataset", destination.DataSet()),
-		)
-		return diffView{}, errors.New("Failed to diff")
-	}
-	if equal(source, destination) {
-		return diffView{}, nil
-	}
-
-	return diffView{
-		dataSet: source.DataSet(),
-		name:    source.Name(),
-		query:   cmp.Diff(source.Query(), destination.Query()),
-	}, nil
+	changes := make([]ViewDiff, 0, len(diffs))
+	deletions := []ViewDiff{}
+	for _, d := range diffs {
+		if d.Has(ActionDelete) {
+			if !opts.Prune {
+				continue
+			}
+			deletions = append(deletions, d)
+		}
+		changes = append(changes, d)
+	}
+	if !opts.SkipValidation {
+		if err := s.preflight(ctx, changes, dst); err != nil {
+			return Result{}, errors.WithStack(err)
+		}
+	}
+	res, err := s.commit(ctx, changes, deletions, changedDatasets(opts.Datasets), dst, opts)
+	return res, errors.WithStack(err)
 }
 
-func matchInclude(v View, vs []View) bool {
-	for _, vv := range vs {
-		if match(v, vv) {
-			return true
+// commit confirms deletions with opts.Confirm, calls opts.BeforeWrite, and writes datasets and then changes to dst.
+// If opts.Atomic, a failure also reverts the datasets written before it.
+func (s viewServiceImpl) commit(ctx context.Context, changes []ViewDiff, deletions []ViewDiff, datasets []DatasetDiff, dst ViewWriter, opts ApplyOptions) (Result, error) {
+	var datasetWriter DatasetWriter
+	if len(datasets) != 0 {
+		w, ok := dst.(DatasetWriter)
+		if !ok {
+			return Result{}, errors.Errorf("%T cannot write the settings of datasets", dst)
+		}
+		datasetWriter = w
+	}
+	if len(deletions) != 0 && opts.Confirm != nil && !opts.Confirm(deletions) {
+		return Result{}, errors.WithStack(AbortedError)
+	}
+	if (len(changes) != 0 || len(datasets) != 0) && opts.BeforeWrite != nil {
+		if err := opts.BeforeWrite(changes, datasets); err != nil {
+			return Result{}, errors.WithStack(err)
 		}
 	}
-	return false
-}
 
-func match(v1, v2 View) bool {
-	if v1 == nil && v1 == v2 {
-		return true
+	written, err := s.writeDatasets(ctx, datasets, datasetWriter)
+	if err != nil {
+		if !opts.Atomic {
+			return Result{Datasets: written}, errors.WithStack(err)
+		}
+		_, _, rerr := s.revertDatasets(ctx, written, datasetWriter)
+		if rerr != nil {
+			err = errors.WithMessagef(err, "failed to roll back datasets (%v)", rerr)
+		}
+		return Result{}, errors.WithStack(err)
 	}
-	if v1 == nil || v2 == nil {
-		return false
+
+	applied, err := s.writeAll(ctx, changes, dst, opts.Atomic)
+	if rerr, ok := errors.Cause(err).(RollbackError); ok {
+		rerr.RolledBackDatasets, rerr.NotRolledBackDatasets, rerr.DatasetRollbackErr = s.revertDatasets(ctx, written, datasetWriter)
+		return Result{}, errors.WithStack(rerr)
 	}
-	return v1.Name() == v2.Name() && v1.DataSet() == v2.DataSet()
+	return Result{Datasets: written, Views: applied}, errors.WithStack(err)
 }
 
-func equal(v1, v2 View) bool {
-	return match(v1, v2) && v1.Query() == v2.Query()
+func (s viewServiceImpl) write(ctx context.Context, d ViewDiff, dst ViewWriter) error {
+	switch {
+	case d.Destination == nil:
+		zap.L().Debug("Creating view", zap.String("Dataset", d.DataSet), zap.String("Table", d.Name))
+		_, err := dst.Create(ctx, d.Source)
+		return errors.WithStack(err)
+	case d.Source == nil:
+		zap.L().Debug("Deleting view", zap.String("Dataset", d.DataSet), zap.String("Table", d.Name))
+		return errors.WithStack(dst.Delete(ctx, d.Destination))
+	default:
+		zap.L().Debug("Updating view", zap.String("Dataset", d.DataSet), zap.String("Table", d.Name))
+		// The view is updated only if it has not changed since d was made.
+		_, err := dst.Update(ctx, viewmanager.WithETag(d.Source, viewmanager.ETagOf(d.Destination)))
+		return errors.WithStack(err)
+	}
 }
@@ -3,13 +3,22 @@ package viewservice_test
 import (
 	"context"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
+	"github.com/rerost/bqv/domain/sqlref"
 	"github.com/rerost/bqv/domain/viewmanager"
 	"github.com/rerost/bqv/domain/viewservice"
+	"github.com/rerost/bqv/mocks/bqfake"
+	"go.uber.org/multierr"
+	"google.golang.org/api/googleapi"
 )
 
 func PrepareDirForTest(dir string) error {
@@ -70,3 +79,908 @@ func TestViewServiceCopy(t *testing.T) {
 		}
 	}
 }
+
+type recordWriter struct {
+	created []string
+}
+
+func (r *recordWriter) Create(ctx context.Context, view viewmanager.View) (viewmanager.View, error) {
+	r.created = append(r.created, view.DataSet()+"."+view.Name())
+	return view, nil
+}
+
+func (r *recordWriter) Update(ctx context.Context, view viewmanager.View) (viewmanager.View, error) {
+	return nil, viewmanager.NotFoundError
+}
+
+func (r *recordWriter) Delete(ctx context.Context, view viewmanager.View) error {
+	return nil
+}
+
+func writeViews(dir string, views map[string]string) error {
+	for p, query := range views {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, p)), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(dir, p), []byte(query), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestViewServiceCopyDependencyOrder(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dependency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = writeViews(dir, map[string]string{
+		"reporting/summary.sql": "SELECT * FROM staging.base JOIN `staging.users` USING (id)",
+		"staging/base.sql":      "SELECT * FROM `staging.users`",
+		"staging/users.sql":     "SELECT 1 AS id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &recordWriter{}
+	if err := viewservice.NewService().Copy(ctx, viewmanager.NewFileManager(dir), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"staging.users", "staging.base", "reporting.summary"}
+	if diff := cmp.Diff(expected, dst.created); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestViewServiceCopyDependencyCycle(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dependency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = writeViews(dir, map[string]string{
+		"a/x.sql": "SELECT * FROM b.y",
+		"b/y.sql": "SELECT * FROM a.x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := &recordWriter{}
+	err = viewservice.NewService().Copy(ctx, viewmanager.NewFileManager(dir), dst)
+	if _, ok := errors.Cause(err).(viewservice.CycleError); !ok {
+		t.Errorf("expected CycleError, got %v", err)
+	}
+	if len(dst.created) != 0 {
+		t.Errorf("nothing should be written, got %v", dst.created)
+	}
+}
+
+func TestViewServiceApplyPlan(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "plan_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "plan_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	if err := writeViews(srcDir, map[string]string{"a/x.sql": "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	src, dst := viewmanager.NewFileManager(srcDir), viewmanager.NewFileManager(dstDir)
+	plan, err := service.Plan(ctx, src, dst, viewservice.ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Actions[0] != viewservice.ActionCreate {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	// Someone else created the view after the plan was made.
+	if err := writeViews(dstDir, map[string]string{"a/x.sql": "SELECT 2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := errors.Cause(service.ApplyPlan(ctx, plan, dst, viewservice.ApplyOptions{})).(viewservice.DriftError); !ok {
+		t.Error("expected DriftError")
+	}
+
+	if err := os.RemoveAll(path.Join(dstDir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ApplyPlan(ctx, plan, dst, viewservice.ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.Get(ctx, "a", "x"); err != nil || v.Query() != "SELECT 1" {
+		t.Errorf("unexpected view %v, %v", v, err)
+	}
+}
+
+func TestViewServiceApplyPrune(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "prune_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "prune_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	if err := writeViews(srcDir, map[string]string{"a/x.sql": "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+	err = writeViews(dstDir, map[string]string{
+		"a/x.sql":     "SELECT 1",
+		"a/old.sql":   "SELECT 1",
+		"a/keep.sql":  "SELECT 1",
+		"b/other.sql": "SELECT 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService(viewservice.WithProtected("a.keep"))
+	src, dst := viewmanager.NewFileManager(srcDir), viewmanager.NewFileManager(dstDir)
+
+	_, err = service.Apply(ctx, src, dst, viewservice.ApplyOptions{
+		Prune:   true,
+		Confirm: func([]viewservice.ViewDiff) bool { return false },
+	})
+	if errors.Cause(err) != viewservice.AbortedError {
+		t.Errorf("expected AbortedError, got %v", err)
+	}
+
+	var confirmed []string
+	applied, err := service.Apply(ctx, src, dst, viewservice.ApplyOptions{
+		Prune: true,
+		Confirm: func(deletions []viewservice.ViewDiff) bool {
+			for _, d := range deletions {
+				confirmed = append(confirmed, d.DataSet+"."+d.Name)
+			}
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a.old"}, confirmed); diff != "" {
+		t.Error(diff)
+	}
+	if len(applied.Views) != 1 {
+		t.Errorf("unexpected applied changes %v", applied.Views)
+	}
+
+	views, err := dst.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range views {
+		names = append(names, v.DataSet()+"."+v.Name())
+	}
+	if diff := cmp.Diff([]string{"a.keep", "a.x", "b.other"}, names); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestViewServiceDiffMetadata(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "diff_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "diff_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"a/x.sql": "SELECT 1",
+		"a/x.yml": "metadata:\n  description: new\n  labels:\n    env: prod\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeViews(dstDir, map[string]string{
+		"a/x.sql":    "SELECT 1",
+		"a/x.yml":    "metadata:\n  description: old\n  labels:\n    env: dev\n    team: x\n",
+		"a/only.sql": "SELECT 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := viewservice.NewService().Diff(ctx, viewmanager.NewFileManager(srcDir), viewmanager.NewFileManager(dstDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 {
+		t.Fatalf("unexpected diffs %+v", diffs)
+	}
+
+	if diff := cmp.Diff([]viewservice.Action{viewservice.ActionUpdateMetadata}, diffs[0].Actions); diff != "" {
+		t.Error(diff)
+	}
+	expected := []viewservice.FieldDiff{
+		{Field: "description", Before: "old", After: "new"},
+		{Field: "labels.env", Before: "dev", After: "prod"},
+		{Field: "labels.team", Before: "x"},
+	}
+	if diff := cmp.Diff(expected, diffs[0].Fields); diff != "" {
+		t.Error(diff)
+	}
+
+	if diffs[1].Name != "only" || !diffs[1].Has(viewservice.ActionDelete) {
+		t.Errorf("expected a.only to be removed, got %+v", diffs[1])
+	}
+}
+
+func TestViewServiceApplyDumpWithFakeBigQuery(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "cycle_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dumpDir, err := ioutil.TempDir("", "cycle_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/orders.sql":  "SELECT 1 AS id",
+		"sales/orders.yml":  "metadata:\n  description: Orders\n  labels:\n    team: sales\n  columns:\n    id:\n      description: Order ID\n",
+		"report/daily.sql":  "SELECT id FROM sales.orders",
+		"report/weekly.sql": "SELECT id FROM report.daily",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	bq := viewmanager.NewBQManager(bqfake.New("project"))
+
+	applied, err := service.Apply(ctx, files, bq, viewservice.ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := viewservice.Summarize(applied.Views); s != (viewservice.Summary{Create: 3}) {
+		t.Errorf("unexpected summary %v", s)
+	}
+
+	diffs, err := service.Diff(ctx, files, bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after apply, got %v", diffs)
+	}
+
+	if err := service.Copy(ctx, bq, viewmanager.NewFileManager(dumpDir)); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = service.Diff(ctx, viewmanager.NewFileManager(dumpDir), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after dump, got %v", diffs)
+	}
+}
+
+func TestViewServiceApplyDumpAuthorizedViews(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "authorized_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dumpDir, err := ioutil.TempDir("", "authorized_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/orders.sql":  "SELECT 1 AS id",
+		"shared/source.sql": "SELECT 1 AS id",
+		"report/daily.sql":  "SELECT id FROM sales.orders",
+		"report/daily.yml":  "metadata:\n  authorized_for: [sales, shared]\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	client := bqfake.New("project")
+	newBQManager := func() viewmanager.BQManager {
+		return viewmanager.NewBQManager(client).WithDatasetMapper(viewmanager.DatasetMapper{Project: "project"}).WithAuthorizingDatasets(files.AuthorizingDatasets)
+	}
+	if _, err := service.Apply(ctx, files, newBQManager(), viewservice.ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The authorization in shared, which the query does not refer to, is found by another run from authorized_for in dir.
+	bq := newBQManager()
+	diffs, err := service.Diff(ctx, files, bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after apply, got %v", diffs)
+	}
+
+	if err := service.Copy(ctx, bq, viewmanager.NewFileManager(dumpDir)); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = service.Diff(ctx, viewmanager.NewFileManager(dumpDir), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after dump, got %v", diffs)
+	}
+}
+
+func TestViewServiceApplyValidation(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = writeViews(dir, map[string]string{
+		"sales/orders.sql":  "SELECT 1 AS id",
+		"sales/broken.sql":  "SELECT id\nFROM sales.missing",
+		"report/daily.sql":  "SELECT id FROM sales.orders",
+		"report/public.sql": "SELECT * FROM `bigquery-public-data.samples.shakespeare`",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(dir)
+	bq := viewmanager.NewBQManager(bqfake.New("project"))
+
+	validations, err := service.Validate(ctx, files, bq, bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, v := range validations {
+		switch {
+		case !v.Valid():
+			got[v.DataSet+"."+v.Name] = v.Err.Error()
+		case v.SkippedBy != "":
+			got[v.DataSet+"."+v.Name] = "skipped by " + v.SkippedBy
+		default:
+			got[v.DataSet+"."+v.Name] = "valid"
+		}
+	}
+	want := map[string]string{
+		"sales.orders":  "valid",
+		"sales.broken":  "2:6: Not found: Table project:sales.missing was not found in location US",
+		"report.daily":  "skipped by sales.orders",
+		"report.public": "valid",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Error(diff)
+	}
+
+	_, err = service.Apply(ctx, files, bq, viewservice.ApplyOptions{})
+	if _, ok := errors.Cause(err).(viewservice.ValidationError); !ok {
+		t.Fatalf("want ValidationError, got %v", err)
+	}
+	views, err := bq.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 0 {
+		t.Errorf("nothing should be applied, got %d views", len(views))
+	}
+}
+
+type failingWriter struct {
+	viewmanager.ViewReadWriter
+	fail string
+}
+
+func (f failingWriter) Create(ctx context.Context, view viewmanager.View) (viewmanager.View, error) {
+	if view.DataSet()+"."+view.Name() == f.fail {
+		return nil, errors.New("injected failure")
+	}
+	return f.ViewReadWriter.Create(ctx, view)
+}
+
+func TestViewServiceApplyAtomic(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "atomic_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dstDir, err := ioutil.TempDir("", "atomic_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"a/x.sql": "SELECT 2",
+		"a/y.sql": "SELECT 1",
+		"a/z.sql": "SELECT 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeViews(dstDir, map[string]string{"a/x.sql": "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	dst := failingWriter{ViewReadWriter: viewmanager.NewFileManager(dstDir), fail: "a.z"}
+	applied, err := service.Apply(ctx, viewmanager.NewFileManager(srcDir), dst, viewservice.ApplyOptions{Atomic: true})
+	rerr, ok := errors.Cause(err).(viewservice.RollbackError)
+	if !ok {
+		t.Fatalf("want RollbackError, got %v", err)
+	}
+	if len(applied.Views) != 0 {
+		t.Errorf("nothing should be applied, got %v", applied.Views)
+	}
+	if rerr.Failed.Name != "z" || len(rerr.NotRolledBack) != 0 {
+		t.Errorf("unexpected error %v", rerr)
+	}
+	var rolledBack []string
+	for _, d := range rerr.RolledBack {
+		rolledBack = append(rolledBack, d.DataSet+"."+d.Name)
+	}
+	if diff := cmp.Diff([]string{"a.y", "a.x"}, rolledBack); diff != "" {
+		t.Error(diff)
+	}
+
+	views, err := dst.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(views) != 1 || views[0].Name() != "x" || views[0].Query() != "SELECT 1" {
+		t.Errorf("dst is not restored: %v", views)
+	}
+}
+
+// orderCheckingWriter fails a create of a view that refers to a view not created yet, and records how many writes run at once.
+type orderCheckingWriter struct {
+	viewmanager.ViewReadWriter
+
+	mu        *sync.Mutex
+	created   map[string]bool
+	running   *int
+	maxAtOnce *int
+}
+
+func (w orderCheckingWriter) Create(ctx context.Context, view viewmanager.View) (viewmanager.View, error) {
+	w.mu.Lock()
+	for _, ref := range sqlref.Find(view.Query()) {
+		if !w.created[ref.ID()] {
+			w.mu.Unlock()
+			return nil, errors.Errorf("%s.%s is created before %s", view.DataSet(), view.Name(), ref.ID())
+		}
+	}
+	*w.running++
+	if *w.running > *w.maxAtOnce {
+		*w.maxAtOnce = *w.running
+	}
+	w.mu.Unlock()
+
+	v, err := w.ViewReadWriter.Create(ctx, view)
+
+	w.mu.Lock()
+	*w.running--
+	w.created[view.DataSet()+"."+view.Name()] = true
+	w.mu.Unlock()
+	return v, err
+}
+
+func TestViewServiceApplyConcurrently(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "concurrent_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"a/top.sql":   "SELECT * FROM a.mid",
+		"a/mid.sql":   "SELECT * FROM a.base JOIN b.other USING (id)",
+		"a/base.sql":  "SELECT 1 AS id",
+		"b/other.sql": "SELECT 1 AS id",
+		"b/v1.sql":    "SELECT 1",
+		"b/v2.sql":    "SELECT 2",
+		"b/v3.sql":    "SELECT 3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := bqfake.New("project")
+	client.SetLatency(10 * time.Millisecond)
+	running, maxAtOnce := 0, 0
+	dst := orderCheckingWriter{
+		ViewReadWriter: viewmanager.NewBQManager(client),
+		mu:             &sync.Mutex{},
+		created:        map[string]bool{},
+		running:        &running,
+		maxAtOnce:      &maxAtOnce,
+	}
+
+	service := viewservice.NewService(viewservice.WithConcurrency(4))
+	applied, err := service.Apply(ctx, viewmanager.NewFileManager(srcDir), dst, viewservice.ApplyOptions{SkipValidation: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied.Views) != 7 {
+		t.Errorf("want 7 views applied, got %d", len(applied.Views))
+	}
+	if maxAtOnce < 2 || maxAtOnce > 4 {
+		t.Errorf("want 2 to 4 writes at once, got %d", maxAtOnce)
+	}
+}
+
+func TestViewServiceApplyConflict(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "conflict_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	bq := viewmanager.NewBQManager(bqfake.New("project"))
+	service := viewservice.NewService()
+	if err := writeViews(srcDir, map[string]string{"a/x.sql": "SELECT 1", "a/y.sql": "SELECT 1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Apply(ctx, viewmanager.NewFileManager(srcDir), bq, viewservice.ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeViews(srcDir, map[string]string{"a/x.sql": "SELECT 2", "a/y.sql": "SELECT 2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else applies a.x after the diff.
+	opts := viewservice.ApplyOptions{BeforeWrite: func([]viewservice.ViewDiff, []viewservice.DatasetDiff) error {
+		_, err := bq.Update(ctx, changedQuery{View: mustGet(t, bq, "a", "x"), query: "SELECT 3"})
+		return err
+	}}
+	applied, err := service.Apply(ctx, viewmanager.NewFileManager(srcDir), bq, opts)
+	cerr, ok := errors.Cause(multierr.Errors(errors.Cause(err))[0]).(viewmanager.ConflictError)
+	if !ok {
+		t.Fatalf("want ConflictError, got %v", err)
+	}
+	if cerr.Name != "x" || cerr.Remote.Query() != "SELECT 3" {
+		t.Errorf("unexpected conflict %v", cerr)
+	}
+	if len(applied.Views) != 1 || applied.Views[0].Name != "y" {
+		t.Errorf("want only a.y applied, got %v", applied.Views)
+	}
+	if got := mustGet(t, bq, "a", "x").Query(); got != "SELECT 3" {
+		t.Errorf("a.x is overwritten: %s", got)
+	}
+}
+
+type changedQuery struct {
+	viewmanager.View
+	query string
+}
+
+func (c changedQuery) Query() string {
+	return c.query
+}
+
+func mustGet(t *testing.T, r viewmanager.ViewReader, dataset, name string) viewmanager.View {
+	t.Helper()
+	v, err := r.Get(context.Background(), dataset, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestViewServiceApplyDatasets(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "datasets_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dumpDir, err := ioutil.TempDir("", "datasets_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/_dataset.yml": "location: EU\ndescription: Sales\nlabels:\n  team: sales\n  env: dev\ndefault_table_expiration: 24h\n",
+		"sales/orders.sql":   "SELECT 1 AS id",
+		"report/daily.sql":   "SELECT id FROM sales.orders",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	bq := viewmanager.NewBQManager(bqfake.New("project")).WithLocation("US")
+
+	applyDatasets := func() []viewservice.DatasetDiff {
+		t.Helper()
+		diffs, err := service.DiffDatasets(ctx, files, bq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := service.Apply(ctx, files, bq, viewservice.ApplyOptions{Datasets: diffs}); err != nil {
+			t.Fatal(err)
+		}
+		return diffs
+	}
+
+	if diffs := applyDatasets(); len(diffs) != 1 || diffs[0].Destination != nil {
+		t.Fatalf("want sales to be created, got %v", diffs)
+	}
+	want := viewmanager.DatasetSetting{
+		Name:                   "sales",
+		Location:               "EU",
+		Description:            "Sales",
+		Labels:                 map[string]string{"team": "sales", "env": "dev"},
+		DefaultTableExpiration: 24 * time.Hour,
+	}
+	got, err := bq.GetDataset(ctx, "sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected dataset (-want +got):\n%s", diff)
+	}
+	// Datasets without settings are not managed.
+	if diffs, err := service.DiffDatasets(ctx, files, bq); err != nil || len(diffs) != 0 {
+		t.Errorf("expected no diff after apply, got %v, %v", diffs, err)
+	}
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/_dataset.yml": "location: US\ndescription: Sales views\nlabels:\n  team: sales\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs := applyDatasets()
+	if len(diffs) != 1 || !diffs[0].LocationDrift {
+		t.Fatalf("want a location drift, got %v", diffs)
+	}
+	wantFields := []viewservice.FieldDiff{
+		{Field: "default_table_expiration", Before: "24h0m0s"},
+		{Field: "description", Before: "Sales", After: "Sales views"},
+		{Field: "labels.env", Before: "dev"},
+	}
+	if diff := cmp.Diff(wantFields, diffs[0].Fields); diff != "" {
+		t.Errorf("unexpected fields (-want +got):\n%s", diff)
+	}
+
+	// The location drift is reported until the dataset is recreated, but nothing else is changed.
+	diffs, err = service.DiffDatasets(ctx, files, bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || diffs[0].Changed() || !diffs[0].LocationDrift {
+		t.Errorf("want only the location drift, got %v", diffs)
+	}
+
+	dump := viewmanager.NewFileManager(dumpDir)
+	if err := service.Copy(ctx, bq, dump); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.CopyDatasets(ctx, bq, dump); err != nil {
+		t.Fatal(err)
+	}
+	got, err = dump.GetDataset(ctx, "sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = viewmanager.DatasetSetting{Name: "sales", Location: "EU", Description: "Sales views", Labels: map[string]string{"team": "sales"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected dumped dataset (-want +got):\n%s", diff)
+	}
+}
+
+func TestViewServiceDatasetsInApply(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "datasets_apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/_dataset.yml": "description: Sales\n",
+		"sales/orders.sql":   "SELECT 1 AS id",
+		"report/daily.sql":   "SELECT id FROM missing.orders",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	client := bqfake.New("project")
+	bq := viewmanager.NewBQManager(client)
+	diffDatasets := func() []viewservice.DatasetDiff {
+		t.Helper()
+		diffs, err := service.DiffDatasets(ctx, files, bq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diffs
+	}
+
+	// Datasets are not written when the views are invalid.
+	_, err = service.Apply(ctx, files, bq, viewservice.ApplyOptions{Datasets: diffDatasets()})
+	if _, ok := errors.Cause(err).(viewservice.ValidationError); !ok {
+		t.Fatalf("want ValidationError, got %v", err)
+	}
+	if _, err := bq.GetDataset(ctx, "sales"); err != viewmanager.NotFoundError {
+		t.Errorf("sales should not be created, got %v", err)
+	}
+
+	// Datasets are in the plan, and are passed to BeforeWrite with the views.
+	if err := os.Remove(path.Join(srcDir, "report", "daily.sql")); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := service.Plan(ctx, files, bq, viewservice.ApplyOptions{Datasets: diffDatasets()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Datasets) != 1 || plan.Datasets[0].Name != "sales" || plan.Datasets[0].Before != nil {
+		t.Fatalf("want sales to be created by the plan, got %+v", plan.Datasets)
+	}
+	var recorded []viewservice.DatasetDiff
+	opts := viewservice.ApplyOptions{BeforeWrite: func(_ []viewservice.ViewDiff, datasets []viewservice.DatasetDiff) error {
+		recorded = datasets
+		return nil
+	}}
+	if err := service.ApplyPlan(ctx, plan, bq, opts); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 1 || recorded[0].Name != "sales" {
+		t.Errorf("want sales passed to BeforeWrite, got %v", recorded)
+	}
+	if got, err := bq.GetDataset(ctx, "sales"); err != nil || got.Description != "Sales" {
+		t.Errorf("unexpected dataset %v, %v", got, err)
+	}
+
+	// A plan is not applied if the settings of its datasets changed.
+	if err := writeViews(srcDir, map[string]string{"sales/_dataset.yml": "description: Sales views\n"}); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = service.Plan(ctx, files, bq, viewservice.ApplyOptions{Datasets: diffDatasets()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bq.UpdateDataset(ctx, viewmanager.DatasetSetting{Name: "sales", Description: "Changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if derr, ok := errors.Cause(service.ApplyPlan(ctx, plan, bq, viewservice.ApplyOptions{})).(viewservice.DriftError); !ok || derr.Views[0] != "sales" {
+		t.Errorf("want DriftError of sales, got %v", derr)
+	}
+
+	// An atomic apply restores the settings of datasets when a view fails.
+	if err := writeViews(srcDir, map[string]string{"sales/items.sql": "SELECT 1 AS id"}); err != nil {
+		t.Fatal(err)
+	}
+	client.FailNext("tables.insert", &googleapi.Error{Code: http.StatusBadRequest, Message: "Invalid"})
+	_, err = service.Apply(ctx, files, bq, viewservice.ApplyOptions{Datasets: diffDatasets(), Atomic: true})
+	rerr, ok := errors.Cause(err).(viewservice.RollbackError)
+	if !ok {
+		t.Fatalf("want RollbackError, got %v", err)
+	}
+	if len(rerr.RolledBackDatasets) != 1 || len(rerr.NotRolledBackDatasets) != 0 {
+		t.Errorf("want sales rolled back, got %+v", rerr)
+	}
+	if got, err := bq.GetDataset(ctx, "sales"); err != nil || got.Description != "Changed" {
+		t.Errorf("want the settings of sales restored, got %v, %v", got, err)
+	}
+}
+
+func TestViewServiceApplyRoutines(t *testing.T) {
+	ctx := context.Background()
+	srcDir, err := ioutil.TempDir("", "routines_src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	dumpDir, err := ioutil.TempDir("", "routines_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dumpDir)
+
+	err = writeViews(srcDir, map[string]string{
+		"sales/orders.sql":           "SELECT 1 AS id, ' Alice ' AS name",
+		"udf/routines/normalize.sql": "LOWER(TRIM(s))",
+		"udf/routines/normalize.yml": "metadata:\n  routine:\n    arguments:\n      - {name: s, type: string}\n    returns: string\n",
+		"udf/recent.sql":             "SELECT id FROM sales.orders WHERE id > n",
+		"udf/recent.yml":             "metadata:\n  type: table_function\n  routine:\n    arguments: [{name: n, type: int64}]\n",
+		"report/names.sql":           "SELECT udf.normalize(name) AS name FROM sales.orders",
+		"report/recent.sql":          "SELECT id FROM udf.recent(0)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := viewservice.NewService()
+	files := viewmanager.NewFileManager(srcDir)
+	client := bqfake.New("project")
+	bq := viewmanager.NewBQManager(client).WithRESTClient(client)
+
+	// Routines are written before the views that use them.
+	dst := &recordWriter{}
+	if err := service.Copy(ctx, files, dst); err != nil {
+		t.Fatal(err)
+	}
+	index := map[string]int{}
+	for i, id := range dst.created {
+		index[id] = i
+	}
+	if index["udf.normalize"] > index["report.names"] || index["udf.recent"] > index["report.recent"] {
+		t.Errorf("routines should be written first, got %v", dst.created)
+	}
+
+	applied, err := service.Apply(ctx, files, bq, viewservice.ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := viewservice.Summarize(applied.Views); s != (viewservice.Summary{Create: 5}) {
+		t.Errorf("unexpected summary %v", s)
+	}
+
+	diffs, err := service.Diff(ctx, files, bq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after apply, got %v", diffs)
+	}
+
+	if err := service.Copy(ctx, bq, viewmanager.NewFileManager(dumpDir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dumpDir, "udf", "routines", "recent.sql")); err != nil {
+		t.Errorf("want routines dumped in the routines dir: %v", err)
+	}
+	diffs, err = service.Diff(ctx, viewmanager.NewFileManager(dumpDir), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("expected no diff after dump, got %v", diffs)
+	}
+}
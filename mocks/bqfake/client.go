@@ -0,0 +1,238 @@
+// Package bqfake is an in-memory implementation of bqiface.Client.
+// It supports datasets and tables (including views), their metadata, labels and etags,
+// and returns the same *googleapi.Error as BigQuery for missing, duplicated or modified resources.
+// Methods that bqv does not use panic.
+package bqfake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/rerost/bqv/domain/sqlref"
+	"github.com/rerost/bqv/domain/viewmanager"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultLocation is the location of datasets created without location.
+const DefaultLocation = "US"
+
+// Client is an in-memory BigQuery project. It is safe for concurrent use.
+type Client struct {
+	bqiface.Client
+
+	mu       sync.Mutex
+	project  string
+	location string
+	datasets map[string]*datasetData
+	version  int
+	now      func() time.Time
+	latency  time.Duration
+	failures map[string][]error
+	// materialized are the definitions and time partitioning of materialized views, which bigquery.TableMetadata does not have,
+	// keyed by <dataset>.<table>.
+	materialized map[string]bq.Table
+}
+
+type datasetData struct {
+	metadata bqiface.DatasetMetadata
+	tables   map[string]*bigquery.TableMetadata
+	routines map[string]*viewmanager.Routine
+}
+
+// New returns an empty Client of project.
+func New(project string) *Client {
+	return &Client{
+		project:  project,
+		datasets: map[string]*datasetData{},
+		now:      time.Now,
+	}
+}
+
+func (c *Client) Location() string {
+	return c.location
+}
+
+func (c *Client) SetLocation(location string) {
+	c.location = location
+}
+
+// SetLatency makes every request to datasets and tables take d, like a request to BigQuery over the network.
+// Requests wait concurrently.
+func (c *Client) SetLatency(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency = d
+}
+
+// FailNext makes the next requests of method fail with errs, one error per request, before they change anything.
+// method is the name of the request in the BigQuery API: datasets.get, datasets.insert, datasets.update, datasets.delete,
+// tables.get, tables.insert, tables.update, tables.delete, routines.list, routines.get, routines.insert, routines.update or routines.delete.
+// It is for testing how clients handle errors such as rate limits (see RateLimitError) and server errors.
+func (c *Client) FailNext(method string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures == nil {
+		c.failures = map[string][]error{}
+	}
+	c.failures[method] = append(c.failures[method], errs...)
+}
+
+// RateLimitError returns the error of BigQuery for requests that exceeded a rate limit.
+func RateLimitError() error {
+	return apiError(http.StatusForbidden, "rateLimitExceeded", "Exceeded rate limits: too many table update operations for this table.")
+}
+
+// call waits for the latency of a request of method, and returns the error given by FailNext if any.
+// It must be called without c.mu held.
+func (c *Client) call(method string) error {
+	c.mu.Lock()
+	latency := c.latency
+	var err error
+	if errs := c.failures[method]; len(errs) != 0 {
+		err, c.failures[method] = errs[0], errs[1:]
+	}
+	c.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+func (c *Client) Dataset(id string) bqiface.Dataset {
+	return &dataset{client: c, id: id}
+}
+
+func (c *Client) DatasetInProject(project string, id string) bqiface.Dataset {
+	if project != c.project {
+		panic(fmt.Sprintf("bqfake: project %s is not %s", project, c.project))
+	}
+	return c.Dataset(id)
+}
+
+func (c *Client) Datasets(ctx context.Context) bqiface.DatasetIterator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(c.datasets))
+	for id := range c.datasets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	datasets := make([]bqiface.Dataset, 0, len(ids))
+	for _, id := range ids {
+		datasets = append(datasets, c.Dataset(id))
+	}
+	return &datasetIterator{datasets: datasets}
+}
+
+func (c *Client) DatasetsInProject(ctx context.Context, project string) bqiface.DatasetIterator {
+	if project != c.project {
+		panic(fmt.Sprintf("bqfake: project %s is not %s", project, c.project))
+	}
+	return c.Datasets(ctx)
+}
+
+// Query returns a query that can only be dry-run. A dry run checks that the tables (or table-valued functions) in the project
+// that the query refers to exist, and returns the schema of its result as viewSchema infers it.
+func (c *Client) Query(q string) bqiface.Query {
+	return &query{client: c, config: bigquery.QueryConfig{Q: q}}
+}
+
+// etag returns a new etag. It must be called with c.mu held.
+func (c *Client) etag() string {
+	c.version++
+	return fmt.Sprintf("etag-%d", c.version)
+}
+
+func notFound(format string, args ...interface{}) error {
+	return apiError(http.StatusNotFound, "notFound", format, args...)
+}
+
+func apiError(code int, reason string, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	return &googleapi.Error{
+		Code:    code,
+		Message: message,
+		Errors:  []googleapi.ErrorItem{{Reason: reason, Message: message}},
+	}
+}
+
+type datasetIterator struct {
+	bqiface.DatasetIterator
+	datasets []bqiface.Dataset
+}
+
+func (it *datasetIterator) Next() (bqiface.Dataset, error) {
+	if len(it.datasets) == 0 {
+		return nil, iterator.Done
+	}
+	d := it.datasets[0]
+	it.datasets = it.datasets[1:]
+	return d, nil
+}
+
+type query struct {
+	bqiface.Query
+	client *Client
+	config bigquery.QueryConfig
+}
+
+func (q *query) SetQueryConfig(config bqiface.QueryConfig) {
+	q.config = config.QueryConfig
+}
+
+func (q *query) Run(ctx context.Context) (bqiface.Job, error) {
+	if !q.config.DryRun {
+		return nil, apiError(http.StatusNotImplemented, "notImplemented", "bqfake does not run queries")
+	}
+
+	c := q.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ref := range sqlref.Find(q.config.Q) {
+		if ref.Project != "" && ref.Project != c.project {
+			continue
+		}
+		if data, ok := c.datasets[ref.DataSet]; !ok || (data.tables[ref.Name] == nil && data.routines[ref.Name] == nil) {
+			line := strings.Count(q.config.Q[:ref.Start], "\n") + 1
+			column := ref.Start - strings.LastIndex(q.config.Q[:ref.Start], "\n")
+			return nil, notFound("Not found: Table %s:%s.%s was not found in location %s at [%d:%d]", c.project, ref.DataSet, ref.Name, DefaultLocation, line, column)
+		}
+	}
+
+	return &job{status: &bigquery.JobStatus{
+		State:      bigquery.Done,
+		Statistics: &bigquery.JobStatistics{Details: &bigquery.QueryStatistics{Schema: viewSchema(q.config.Q)}},
+	}}, nil
+}
+
+type job struct {
+	bqiface.Job
+	status *bigquery.JobStatus
+}
+
+func (j *job) ID() string {
+	return "bqfake_dry_run"
+}
+
+func (j *job) LastStatus() *bigquery.JobStatus {
+	return j.status
+}
+
+func (q *query) Read(ctx context.Context) (bqiface.RowIterator, error) {
+	return nil, apiError(http.StatusNotImplemented, "notImplemented", "bqfake does not run queries")
+}
@@ -0,0 +1,120 @@
+package bqfake_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rerost/bqv/mocks/bqfake"
+	"google.golang.org/api/googleapi"
+)
+
+func code(err error) int {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+func TestTable(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.New("project")
+	table := c.Dataset("ds").Table("view")
+
+	if err := table.Create(ctx, &bigquery.TableMetadata{ViewQuery: "SELECT 1"}); code(err) != 404 {
+		t.Errorf("want 404 for a missing dataset, got %v", err)
+	}
+	if err := c.Dataset("ds").Create(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Create(ctx, &bigquery.TableMetadata{ViewQuery: "SELECT 1", Labels: map[string]string{"a": "1", "b": "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Create(ctx, &bigquery.TableMetadata{ViewQuery: "SELECT 1"}); code(err) != 409 {
+		t.Errorf("want 409 for a duplicated table, got %v", err)
+	}
+
+	md, err := table.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Type != bigquery.ViewTable {
+		t.Errorf("want view, got %s", md.Type)
+	}
+
+	update := bigquery.TableMetadataToUpdate{ViewQuery: "SELECT 2"}
+	update.DeleteLabel("a")
+	updated, err := table.Update(ctx, update, md.ETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ViewQuery != "SELECT 2" || len(updated.Labels) != 1 || updated.Labels["b"] != "2" {
+		t.Errorf("unexpected metadata %+v", updated)
+	}
+	if updated.ETag == md.ETag {
+		t.Error("etag is not changed by update")
+	}
+	if _, err := table.Update(ctx, update, md.ETag); code(err) != 412 {
+		t.Errorf("want 412 for a stale etag, got %v", err)
+	}
+
+	if err := c.Dataset("ds").Delete(ctx); code(err) != 400 {
+		t.Errorf("want 400 for a dataset in use, got %v", err)
+	}
+	if err := table.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Metadata(ctx); code(err) != 404 {
+		t.Errorf("want 404 for a deleted table, got %v", err)
+	}
+}
+
+func TestViewSchema(t *testing.T) {
+	ctx := context.Background()
+	c := bqfake.New("project")
+	if err := c.Dataset("ds").Create(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	table := c.Dataset("ds").Table("view")
+	query := "WITH t AS (SELECT 1 AS x) SELECT t.x, COUNT(*) AS n, IF(x > 0, 'a, b', 'c'), * EXCEPT (y) FROM t GROUP BY 1"
+	if err := table.Create(ctx, &bigquery.TableMetadata{ViewQuery: query}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := table.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range md.Schema {
+		names = append(names, f.Name)
+	}
+	if want := []string{"x", "n", "f2_"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("want columns %v, got %v", want, names)
+	}
+
+	schema := bigquery.Schema{}
+	for _, f := range md.Schema {
+		fs := *f
+		fs.Description = "described " + f.Name
+		schema = append(schema, &fs)
+	}
+	updated, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Schema[0].Description != "described x" {
+		t.Errorf("want the description updated, got %+v", updated.Schema[0])
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema[:1]}, ""); code(err) != 400 {
+		t.Errorf("want 400 for a removed column, got %v", err)
+	}
+
+	updated, err = table.Update(ctx, bigquery.TableMetadataToUpdate{ViewQuery: "SELECT 1 AS x"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Schema) != 1 || updated.Schema[0].Description != "" {
+		t.Errorf("want the schema inferred again, got %+v", updated.Schema)
+	}
+}
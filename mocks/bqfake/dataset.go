@@ -0,0 +1,226 @@
+package bqfake
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+type dataset struct {
+	bqiface.Dataset
+	client *Client
+	id     string
+}
+
+func (d *dataset) ProjectID() string {
+	return d.client.project
+}
+
+func (d *dataset) DatasetID() string {
+	return d.id
+}
+
+func (d *dataset) Create(ctx context.Context, md *bqiface.DatasetMetadata) error {
+	c := d.client
+	if err := c.call("datasets.insert"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.datasets[d.id]; ok {
+		return apiError(http.StatusConflict, "duplicate", "Already Exists: Dataset %s:%s", c.project, d.id)
+	}
+
+	var metadata bqiface.DatasetMetadata
+	if md != nil {
+		if md.ETag != "" {
+			return errors.New("bigquery: Dataset.ETag is not writable")
+		}
+		metadata = *md
+	}
+	if metadata.Location == "" {
+		metadata.Location = c.location
+	}
+	if metadata.Location == "" {
+		metadata.Location = DefaultLocation
+	}
+	metadata.Labels = copyLabels(metadata.Labels)
+	metadata.CreationTime = c.now()
+	metadata.LastModifiedTime = metadata.CreationTime
+	metadata.FullID = c.project + ":" + d.id
+	metadata.ETag = c.etag()
+
+	c.datasets[d.id] = &datasetData{metadata: metadata, tables: map[string]*bigquery.TableMetadata{}}
+	return nil
+}
+
+func (d *dataset) Delete(ctx context.Context) error {
+	return d.delete(false)
+}
+
+func (d *dataset) DeleteWithContents(ctx context.Context) error {
+	return d.delete(true)
+}
+
+func (d *dataset) delete(withContents bool) error {
+	c := d.client
+	if err := c.call("datasets.delete"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.datasets[d.id]
+	if !ok {
+		return notFound("Not found: Dataset %s:%s", c.project, d.id)
+	}
+	if !withContents && (len(data.tables) != 0 || len(data.routines) != 0) {
+		return apiError(http.StatusBadRequest, "resourceInUse", "Dataset %s:%s is still in use", c.project, d.id)
+	}
+	delete(c.datasets, d.id)
+	return nil
+}
+
+func (d *dataset) Metadata(ctx context.Context) (*bqiface.DatasetMetadata, error) {
+	c := d.client
+	if err := c.call("datasets.get"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.datasets[d.id]
+	if !ok {
+		return nil, notFound("Not found: Dataset %s:%s", c.project, d.id)
+	}
+	md := data.metadata
+	md.Labels = copyLabels(md.Labels)
+	md.Access = append([]*bqiface.AccessEntry(nil), md.Access...)
+	return &md, nil
+}
+
+func (d *dataset) Update(ctx context.Context, dm bqiface.DatasetMetadataToUpdate, etag string) (*bqiface.DatasetMetadata, error) {
+	c := d.client
+	if err := c.call("datasets.update"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+
+	data, ok := c.datasets[d.id]
+	if !ok {
+		c.mu.Unlock()
+		return nil, notFound("Not found: Dataset %s:%s", c.project, d.id)
+	}
+	if etag != "" && etag != data.metadata.ETag {
+		c.mu.Unlock()
+		return nil, apiError(http.StatusPreconditionFailed, "conditionNotMet", "Precondition check failed.")
+	}
+
+	md := &data.metadata
+	if v, ok := dm.Description.(string); ok {
+		md.Description = v
+	}
+	if v, ok := dm.Name.(string); ok {
+		md.Name = v
+	}
+	if v, ok := dm.DefaultTableExpiration.(time.Duration); ok {
+		md.DefaultTableExpiration = v
+	}
+	if dm.Access != nil {
+		md.Access = append([]*bqiface.AccessEntry(nil), dm.Access...)
+	}
+	md.Labels = updateLabels(md.Labels, &dm.DatasetMetadataToUpdate)
+	md.LastModifiedTime = c.now()
+	md.ETag = c.etag()
+	c.mu.Unlock()
+
+	return d.Metadata(ctx)
+}
+
+func (d *dataset) Table(id string) bqiface.Table {
+	return &table{client: d.client, datasetID: d.id, id: id}
+}
+
+func (d *dataset) Tables(ctx context.Context) bqiface.TableIterator {
+	c := d.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it := &tableIterator{}
+	data, ok := c.datasets[d.id]
+	if !ok {
+		it.err = notFound("Not found: Dataset %s:%s", c.project, d.id)
+		return it
+	}
+
+	ids := make([]string, 0, len(data.tables))
+	for id := range data.tables {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		it.tables = append(it.tables, d.Table(id))
+	}
+	return it
+}
+
+type tableIterator struct {
+	bqiface.TableIterator
+	tables []bqiface.Table
+	err    error
+}
+
+func (it *tableIterator) Next() (bqiface.Table, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.tables) == 0 {
+		return nil, iterator.Done
+	}
+	t := it.tables[0]
+	it.tables = it.tables[1:]
+	return t, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// updateLabels applies SetLabel and DeleteLabel of update, which are unexported in bigquery, to labels.
+func updateLabels(labels map[string]string, update interface{}) map[string]string {
+	v := reflect.ValueOf(update).Elem()
+	set, del := v.FieldByName("setLabels"), v.FieldByName("deleteLabels")
+	if set.Len() == 0 && del.Len() == 0 {
+		return labels
+	}
+
+	labels = copyLabels(labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for it := set.MapRange(); it.Next(); {
+		labels[it.Key().String()] = it.Value().String()
+	}
+	for it := del.MapRange(); it.Next(); {
+		delete(labels, it.Key().String())
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
@@ -0,0 +1,163 @@
+package bqfake
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+// materializedViewTable is the type of materialized views, which the bigquery package does not have yet.
+const materializedViewTable bigquery.TableType = "MATERIALIZED_VIEW"
+
+// defaultRefreshIntervalMs is the refresh interval that BigQuery sets on materialized views without one.
+const defaultRefreshIntervalMs = 30 * 60 * 1000
+
+// GetTable, InsertTable and PatchTable are tables.get, tables.insert and tables.patch of the BigQuery API,
+// for the definitions of materialized views that bqiface.Table does not support.
+// They fail as the requests of bqiface.Table, e.g. FailNext("tables.insert") fails InsertTable.
+
+func (c *Client) GetTable(ctx context.Context, dataset, tableID string) (*bq.Table, error) {
+	if err := c.call("tables.get"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &table{client: c, datasetID: dataset, id: tableID}
+	_, current, err := t.lookup()
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, notFound("Not found: Table %s", t.FullyQualifiedName())
+	}
+
+	res := &bq.Table{
+		TableReference: &bq.TableReference{ProjectId: c.project, DatasetId: dataset, TableId: tableID},
+		Type:           string(current.Type),
+		FriendlyName:   current.Name,
+		Description:    current.Description,
+		Labels:         copyLabels(current.Labels),
+		Etag:           current.ETag,
+	}
+	if current.Type == bigquery.ViewTable {
+		res.View = &bq.ViewDefinition{Query: current.ViewQuery}
+	}
+	if current.Clustering != nil {
+		res.Clustering = &bq.Clustering{Fields: append([]string(nil), current.Clustering.Fields...)}
+	}
+	if mv, ok := c.materialized[dataset+"."+tableID]; ok {
+		def := *mv.MaterializedView
+		res.MaterializedView = &def
+		if mv.TimePartitioning != nil {
+			p := *mv.TimePartitioning
+			res.TimePartitioning = &p
+		}
+	}
+	return res, nil
+}
+
+// InsertTable only creates materialized views, which bqiface.Dataset cannot create.
+func (c *Client) InsertTable(ctx context.Context, dataset, tableID string, t *bq.Table) error {
+	if t.MaterializedView == nil {
+		panic("bqfake: InsertTable only creates materialized views")
+	}
+	if err := c.call("tables.insert"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ft := &table{client: c, datasetID: dataset, id: tableID}
+	data, current, err := ft.lookup()
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return apiError(http.StatusConflict, "duplicate", "Already Exists: Table %s", ft.FullyQualifiedName())
+	}
+	if t.MaterializedView.Query == "" {
+		return apiError(http.StatusBadRequest, "invalid", "Materialized view query is required")
+	}
+	if t.TimePartitioning != nil && t.TimePartitioning.Type == "" {
+		return apiError(http.StatusBadRequest, "invalid", "Time partitioning type is required")
+	}
+
+	def := *t.MaterializedView
+	def.ForceSendFields = nil
+	if def.RefreshIntervalMs == 0 {
+		def.RefreshIntervalMs = defaultRefreshIntervalMs
+	}
+	mv := bq.Table{MaterializedView: &def}
+	md := bigquery.TableMetadata{
+		Name:        t.FriendlyName,
+		Description: t.Description,
+		Labels:      copyLabels(t.Labels),
+		Type:        materializedViewTable,
+		Schema:      viewSchema(def.Query),
+	}
+	if t.TimePartitioning != nil {
+		p := *t.TimePartitioning
+		mv.TimePartitioning = &p
+		md.TimePartitioning = &bigquery.TimePartitioning{Field: p.Field}
+	}
+	if t.Clustering != nil {
+		md.Clustering = &bigquery.Clustering{Fields: append([]string(nil), t.Clustering.Fields...)}
+	}
+	md.FullID = ft.FullyQualifiedName()
+	md.CreationTime = c.now()
+	md.LastModifiedTime = md.CreationTime
+	md.ETag = c.etag()
+	data.tables[tableID] = &md
+
+	if c.materialized == nil {
+		c.materialized = map[string]bq.Table{}
+	}
+	c.materialized[dataset+"."+tableID] = mv
+	return nil
+}
+
+// PatchTable only updates the definitions of materialized views. Like BigQuery, their queries cannot be changed.
+func (c *Client) PatchTable(ctx context.Context, dataset, tableID string, patch *bq.Table, etag string) error {
+	if patch.MaterializedView == nil {
+		panic("bqfake: PatchTable only updates materialized views")
+	}
+	if err := c.call("tables.update"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &table{client: c, datasetID: dataset, id: tableID}
+	_, current, err := t.lookup()
+	if err == nil && current == nil {
+		err = notFound("Not found: Table %s", t.FullyQualifiedName())
+	}
+	if err == nil && etag != "" && etag != current.ETag {
+		err = apiError(http.StatusPreconditionFailed, "conditionNotMet", "Precondition check failed.")
+	}
+	if err != nil {
+		return err
+	}
+	if current.Type != materializedViewTable {
+		return apiError(http.StatusBadRequest, "invalid", "Table %s is not a materialized view", t.FullyQualifiedName())
+	}
+
+	key := dataset + "." + tableID
+	mv := c.materialized[key]
+	if patch.MaterializedView.Query != "" && patch.MaterializedView.Query != mv.MaterializedView.Query {
+		return apiError(http.StatusBadRequest, "invalid", "The query of materialized view %s cannot be changed", t.FullyQualifiedName())
+	}
+	def := *mv.MaterializedView
+	def.EnableRefresh = patch.MaterializedView.EnableRefresh
+	if patch.MaterializedView.RefreshIntervalMs != 0 {
+		def.RefreshIntervalMs = patch.MaterializedView.RefreshIntervalMs
+	}
+	mv.MaterializedView = &def
+	c.materialized[key] = mv
+	current.LastModifiedTime = c.now()
+	current.ETag = c.etag()
+	return nil
+}
@@ -0,0 +1,166 @@
+package bqfake
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/rerost/bqv/domain/viewmanager"
+	bq "google.golang.org/api/bigquery/v2"
+)
+
+// ListRoutines, GetRoutine, InsertRoutine, UpdateRoutine and DeleteRoutine are requests to routines of the BigQuery API,
+// which bqiface.Client does not support. Routines are kept as they are given, except that BigQuery sets their references and etags.
+
+func (c *Client) ListRoutines(ctx context.Context, dataset string) ([]string, error) {
+	if err := c.call("routines.list"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.datasets[dataset]
+	if !ok {
+		return nil, notFound("Not found: Dataset %s:%s", c.project, dataset)
+	}
+	ids := make([]string, 0, len(data.routines))
+	for id := range data.routines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (c *Client) GetRoutine(ctx context.Context, dataset, routine string) (*viewmanager.Routine, error) {
+	if err := c.call("routines.get"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, current, err := c.lookupRoutine(dataset, routine)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, notFound("Not found: Routine %s:%s.%s", c.project, dataset, routine)
+	}
+	return copyRoutine(current), nil
+}
+
+func (c *Client) InsertRoutine(ctx context.Context, dataset, routine string, r *viewmanager.Routine) error {
+	if err := c.call("routines.insert"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, current, err := c.lookupRoutine(dataset, routine)
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return apiError(http.StatusConflict, "duplicate", "Already Exists: Routine %s:%s.%s", c.project, dataset, routine)
+	}
+	if err := validateRoutine(r); err != nil {
+		return err
+	}
+
+	r = copyRoutine(r)
+	r.RoutineReference = &bq.RoutineReference{ProjectId: c.project, DatasetId: dataset, RoutineId: routine}
+	r.Etag = c.etag()
+	if data.routines == nil {
+		data.routines = map[string]*viewmanager.Routine{}
+	}
+	data.routines[routine] = r
+	return nil
+}
+
+func (c *Client) UpdateRoutine(ctx context.Context, dataset, routine string, r *viewmanager.Routine, etag string) error {
+	if err := c.call("routines.update"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, current, err := c.lookupRoutine(dataset, routine)
+	if err == nil && current == nil {
+		err = notFound("Not found: Routine %s:%s.%s", c.project, dataset, routine)
+	}
+	if err == nil && etag != "" && etag != current.Etag {
+		err = apiError(http.StatusPreconditionFailed, "conditionNotMet", "Precondition check failed.")
+	}
+	if err != nil {
+		return err
+	}
+	if err := validateRoutine(r); err != nil {
+		return err
+	}
+
+	r = copyRoutine(r)
+	r.RoutineReference = &bq.RoutineReference{ProjectId: c.project, DatasetId: dataset, RoutineId: routine}
+	r.Etag = c.etag()
+	data.routines[routine] = r
+	return nil
+}
+
+func (c *Client) DeleteRoutine(ctx context.Context, dataset, routine string) error {
+	if err := c.call("routines.delete"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, current, err := c.lookupRoutine(dataset, routine)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("Not found: Routine %s:%s.%s", c.project, dataset, routine)
+	}
+	delete(data.routines, routine)
+	return nil
+}
+
+// lookupRoutine returns the dataset and the routine, which is nil if it does not exist. It must be called with c.mu held.
+func (c *Client) lookupRoutine(dataset, routine string) (*datasetData, *viewmanager.Routine, error) {
+	data, ok := c.datasets[dataset]
+	if !ok {
+		return nil, nil, notFound("Not found: Dataset %s:%s", c.project, dataset)
+	}
+	return data, data.routines[routine], nil
+}
+
+func validateRoutine(r *viewmanager.Routine) error {
+	switch r.RoutineType {
+	case "SCALAR_FUNCTION", "TABLE_VALUED_FUNCTION", "PROCEDURE":
+	default:
+		return apiError(http.StatusBadRequest, "invalid", "Invalid value for routine type: %q", r.RoutineType)
+	}
+	if r.DefinitionBody == "" {
+		return apiError(http.StatusBadRequest, "invalid", "Routine body is required")
+	}
+	if r.Language == "JAVASCRIPT" && r.ReturnType == nil {
+		return apiError(http.StatusBadRequest, "invalid", "Return type is required for JavaScript functions")
+	}
+	if r.ReturnTableType != nil && r.RoutineType != "TABLE_VALUED_FUNCTION" {
+		return apiError(http.StatusBadRequest, "invalid", "Return table type is only for table-valued functions")
+	}
+	return nil
+}
+
+func copyRoutine(r *viewmanager.Routine) *viewmanager.Routine {
+	res := *r
+	res.Arguments = make([]*bq.Argument, len(r.Arguments))
+	for i, a := range r.Arguments {
+		arg := *a
+		res.Arguments[i] = &arg
+	}
+	res.ImportedLibraries = append([]string(nil), r.ImportedLibraries...)
+	if r.ReturnTableType != nil {
+		t := *r.ReturnTableType
+		t.Columns = append([]*bq.StandardSqlField(nil), t.Columns...)
+		res.ReturnTableType = &t
+	}
+	return &res
+}
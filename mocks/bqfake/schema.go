@@ -0,0 +1,96 @@
+package bqfake
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rerost/bqv/domain/sqlref"
+)
+
+var (
+	selectKeyword = regexp.MustCompile(`(?i)\bSELECT\b`)
+	fromKeyword   = regexp.MustCompile(`(?i)\bFROM\b`)
+	columnAlias   = regexp.MustCompile("(?is)\\bAS\\s+(`[^`]+`|[A-Za-z_][A-Za-z0-9_]*)\\s*$")
+	starColumn    = regexp.MustCompile("^(?:(?:`[^`]+`|[A-Za-z_][A-Za-z0-9_]*)\\s*\\.\\s*)*\\*")
+	columnPath    = regexp.MustCompile("^(?:`[^`]+`|[A-Za-z_][A-Za-z0-9_]*)(?:\\s*\\.\\s*(`[^`]+`|[A-Za-z_][A-Za-z0-9_]*))*$")
+)
+
+// viewSchema returns the schema of a view of query, which BigQuery infers from the query.
+// It only approximates BigQuery: the columns are those in the outermost select list, every column is a STRING,
+// and `*` is skipped.
+func viewSchema(query string) bigquery.Schema {
+	masked := sqlref.Mask(query)
+	start := -1
+	for _, m := range selectKeyword.FindAllStringIndex(masked, -1) {
+		if depth(masked[:m[0]]) == 0 {
+			start = m[1]
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	end := len(masked)
+	for _, m := range fromKeyword.FindAllStringIndex(masked[start:], -1) {
+		if depth(masked[start:start+m[0]]) == 0 {
+			end = start + m[0]
+			break
+		}
+	}
+
+	schema := bigquery.Schema{}
+	last := start
+	for i := start; i <= end; i++ {
+		if i < end && (masked[i] != ',' || depth(masked[start:i]) != 0) {
+			continue
+		}
+		item := strings.TrimSpace(masked[last:i])
+		last = i + 1
+		if item == "" || starColumn.MatchString(item) {
+			continue
+		}
+
+		name := fmt.Sprintf("f%d_", len(schema))
+		if m := columnAlias.FindStringSubmatch(item); m != nil {
+			name = m[1]
+		} else if columnPath.MatchString(item) {
+			parts := strings.Split(item, ".")
+			name = strings.TrimSpace(parts[len(parts)-1])
+		}
+		schema = append(schema, &bigquery.FieldSchema{Name: strings.Trim(name, "`"), Type: bigquery.StringFieldType})
+	}
+	return schema
+}
+
+// depth returns how many parentheses are open at the end of s.
+func depth(s string) int {
+	return strings.Count(s, "(") - strings.Count(s, ")")
+}
+
+// updateSchema returns current with the descriptions of schema.
+// Like BigQuery, the schema of a view can only be changed in the descriptions of its columns.
+func updateSchema(current, schema bigquery.Schema) (bigquery.Schema, error) {
+	if len(current) != len(schema) {
+		return nil, apiError(http.StatusBadRequest, "invalid", "Provided Schema does not match Table. Cannot add or remove fields of a view.")
+	}
+	res := make(bigquery.Schema, len(current))
+	for i, f := range current {
+		if schema[i].Name != f.Name || schema[i].Type != f.Type {
+			return nil, apiError(http.StatusBadRequest, "invalid", "Provided Schema does not match Table. Field %s has changed.", f.Name)
+		}
+		fs := *f
+		fs.Description = schema[i].Description
+		if len(f.Schema) != 0 {
+			nested, err := updateSchema(f.Schema, schema[i].Schema)
+			if err != nil {
+				return nil, err
+			}
+			fs.Schema = nested
+		}
+		res[i] = &fs
+	}
+	return res, nil
+}
@@ -0,0 +1,178 @@
+package bqfake
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+	"github.com/pkg/errors"
+)
+
+type table struct {
+	bqiface.Table
+	client    *Client
+	datasetID string
+	id        string
+}
+
+func (t *table) ProjectID() string {
+	return t.client.project
+}
+
+func (t *table) DatasetID() string {
+	return t.datasetID
+}
+
+func (t *table) TableID() string {
+	return t.id
+}
+
+func (t *table) FullyQualifiedName() string {
+	return t.client.project + ":" + t.datasetID + "." + t.id
+}
+
+// lookup returns the dataset and the metadata of t, which is nil if t does not exist. It must be called with client.mu held.
+func (t *table) lookup() (*datasetData, *bigquery.TableMetadata, error) {
+	data, ok := t.client.datasets[t.datasetID]
+	if !ok {
+		return nil, nil, notFound("Not found: Dataset %s:%s", t.client.project, t.datasetID)
+	}
+	return data, data.tables[t.id], nil
+}
+
+func (t *table) Create(ctx context.Context, tm *bigquery.TableMetadata) error {
+	c := t.client
+	if err := c.call("tables.insert"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, current, err := t.lookup()
+	if err != nil {
+		return err
+	}
+	if current != nil {
+		return apiError(http.StatusConflict, "duplicate", "Already Exists: Table %s", t.FullyQualifiedName())
+	}
+
+	var md bigquery.TableMetadata
+	if tm != nil {
+		if tm.ETag != "" {
+			return errors.New("cannot set ETag on create")
+		}
+		md = *tm
+	}
+	md.Type = bigquery.RegularTable
+	if md.ViewQuery != "" {
+		md.Type = bigquery.ViewTable
+		md.Schema = viewSchema(md.ViewQuery)
+	}
+	md.Labels = copyLabels(md.Labels)
+	md.FullID = t.FullyQualifiedName()
+	md.CreationTime = c.now()
+	md.LastModifiedTime = md.CreationTime
+	md.ETag = c.etag()
+
+	data.tables[t.id] = &md
+	return nil
+}
+
+func (t *table) Delete(ctx context.Context) error {
+	c := t.client
+	if err := c.call("tables.delete"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, current, err := t.lookup()
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return notFound("Not found: Table %s", t.FullyQualifiedName())
+	}
+	delete(data.tables, t.id)
+	delete(c.materialized, t.datasetID+"."+t.id)
+	return nil
+}
+
+func (t *table) Metadata(ctx context.Context) (*bigquery.TableMetadata, error) {
+	c := t.client
+	if err := c.call("tables.get"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, current, err := t.lookup()
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, notFound("Not found: Table %s", t.FullyQualifiedName())
+	}
+	md := *current
+	md.Labels = copyLabels(md.Labels)
+	return &md, nil
+}
+
+func (t *table) Update(ctx context.Context, tm bigquery.TableMetadataToUpdate, etag string) (*bigquery.TableMetadata, error) {
+	c := t.client
+	if err := c.call("tables.update"); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+
+	_, current, err := t.lookup()
+	if err == nil && current == nil {
+		err = notFound("Not found: Table %s", t.FullyQualifiedName())
+	}
+	if err == nil && etag != "" && etag != current.ETag {
+		err = apiError(http.StatusPreconditionFailed, "conditionNotMet", "Precondition check failed.")
+	}
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	if v, ok := tm.ViewQuery.(string); ok {
+		if current.Type != bigquery.ViewTable {
+			c.mu.Unlock()
+			return nil, apiError(http.StatusBadRequest, "invalid", "Table %s is not a view", t.FullyQualifiedName())
+		}
+		current.ViewQuery = v
+		// BigQuery infers the schema of the view again, without the descriptions of its columns.
+		current.Schema = viewSchema(v)
+	}
+	if v, ok := tm.Description.(string); ok {
+		current.Description = v
+	}
+	if v, ok := tm.Name.(string); ok {
+		current.Name = v
+	}
+	if v, ok := tm.UseLegacySQL.(bool); ok {
+		current.UseLegacySQL = v
+	}
+	if tm.Schema != nil && current.Type == bigquery.RegularTable {
+		current.Schema = tm.Schema
+	} else if tm.Schema != nil {
+		schema, err := updateSchema(current.Schema, tm.Schema)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		current.Schema = schema
+	}
+	if !tm.ExpirationTime.IsZero() {
+		current.ExpirationTime = tm.ExpirationTime
+	}
+	current.Labels = updateLabels(current.Labels, &tm)
+	current.LastModifiedTime = c.now()
+	current.ETag = c.etag()
+	c.mu.Unlock()
+
+	return t.Metadata(ctx)
+}